@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/palette-software/go-log-targets"
 
@@ -23,6 +24,52 @@ type InsightWebServiceConfig struct {
 	// The archive path for the serverlogs
 	ServerlogsArchivePath string
 
+	// The directory where the index of accepted uploads is stored
+	UploadIndexPath string
+	// How long do we remember accepted uploads
+	UploadIndexMaxAge time.Duration
+
+	// The JSON file with the upload routes (optional)
+	UploadRoutesFile string
+
+	// The directory where the failed uploads are kept
+	QuarantinePath string
+
+	// The JSON file with the expected columns of the tables (optional)
+	TableSchemasFile string
+
+	// The JSON file with the output codecs of the tables (optional)
+	TableOutputsFile string
+	// The root directory of the parquet outputs
+	ParquetPath string
+
+	// The concurrency and bandwidth limits of the uploads
+	UploadLimits UploadLimits
+
+	// The number of serverlog parser workers and the size of their queues
+	ParserWorkers, ParserQueueSize int
+	// The directory of the durable serverlog parse queue
+	ParseQueuePath string
+	// How long are the finished parse requests kept
+	ParseQueueMaxAge time.Duration
+	// JSON file with the regex log formats
+	LogFormatsFile string
+	// Write the spans of the requests and sessions of the JSON serverlogs
+	CorrelateRequests bool
+	// The masking rules of the serverlogs and the key of their hmac rules
+	MaskingRulesFile, MaskingKey string
+	// When the CSV outputs of the parsed serverlogs continue in a new file
+	OutputRotation OutputRotation
+	// The directory of the NDJSON copies of the parsed serverlogs
+	NdjsonPath string
+	// The number of the latest parsed serverlog rows kept for the live view
+	LiveRows int
+	// Copies the outputs into the database if its connection string is set
+	PgCopy PgCopyConfig
+
+	// The arguments left after the flags (the subcommand and its flags)
+	Args []string
+
 	// Should the filenames use the old format?
 	// like 'countersamples-2016-04-18--14-10-08--seq0000--part0000-csv-08-00--14-00-95755b03f960d2994dbad08067504e02.csv.gz'
 	// (with double timestamp)
@@ -75,6 +122,16 @@ func ParseOptions() InsightWebServiceConfig {
 	)
 
 	flag.StringVar(&archivePath, "archive_path", "", "The directory where the uploaded serverlogs are archived.")
+
+	var uploadIndexPath string
+	var uploadIndexMaxAge time.Duration
+
+	flag.StringVar(&uploadIndexPath, "upload_index_path", "", "The directory where the index of accepted uploads is stored.")
+	flag.DurationVar(&uploadIndexMaxAge, "upload_index_max_age", 7*24*time.Hour, "How long re-sent uploads are detected as duplicates.")
+
+	var quarantinePath string
+
+	flag.StringVar(&quarantinePath, "quarantine_path", "", "The directory where failed or corrupt uploads are kept.")
 	flag.IntVar(&bindPort, "port", 9000, "The port the server is binding itself to")
 	flag.StringVar(&bindAddress, "bind_address", "", "The address to bind to. Leave empty for default .")
 
@@ -88,6 +145,81 @@ func ParseOptions() InsightWebServiceConfig {
 	flag.StringVar(&tlsCert, "cert", "cert.pem", "The TLS certificate file to use when tls is set.")
 	flag.StringVar(&tlsKey, "key", "key.pem", "The TLS certificate key file to use when tls is set.")
 
+	// UPLOAD ROUTING
+	// ==============
+	var uploadRoutesFile string
+
+	flag.StringVar(&uploadRoutesFile, "upload_routes", "", "JSON file mapping uploaded tables to upload handlers. Leave empty for the default routing.")
+
+	var tableSchemasFile string
+
+	flag.StringVar(&tableSchemasFile, "table_schemas", "", "JSON file with the expected columns of the uploaded tables. Leave empty to skip checking the uploads.")
+
+	var tableOutputsFile string
+
+	flag.StringVar(&tableOutputsFile, "table_outputs", "", "JSON file with the output codecs of the tables. Leave empty to gzip all outputs.")
+
+	var parquetPath string
+
+	flag.StringVar(&parquetPath, "parquet_path", "", "The directory where the tables with parquet output are written.")
+
+	// UPLOAD LIMITS
+	// =============
+	var uploadLimits UploadLimits
+
+	flag.IntVar(&uploadLimits.MaxConcurrent, "upload_max_concurrent", 0, "The maximum number of uploads handled at the same time. 0 means unlimited.")
+	flag.IntVar(&uploadLimits.MaxConcurrentPerHost, "upload_max_concurrent_per_host", 0, "The maximum number of uploads handled at the same time from one host. 0 means unlimited.")
+	flag.Int64Var(&uploadLimits.MaxBandwidth, "upload_max_bandwidth", 0, "The maximum bytes per second read from all uploads. 0 means unlimited.")
+	flag.Int64Var(&uploadLimits.MaxBandwidthPerHost, "upload_max_bandwidth_per_host", 0, "The maximum bytes per second read from the uploads of one host. 0 means unlimited.")
+	flag.DurationVar(&uploadLimits.RetryAfter, "upload_retry_after", 30*time.Second, "The delay the agents are asked to wait before retrying a rejected upload.")
+
+	// SERVERLOG PARSING
+	// =================
+	var parserWorkers, parserQueueSize int
+
+	flag.IntVar(&parserWorkers, "parser_workers", 4, "The number of workers parsing the serverlogs.")
+	flag.IntVar(&parserQueueSize, "parser_queue_size", 256, "The number of files waiting for each serverlog parser worker before the uploads are rejected.")
+
+	var parseQueuePath string
+	var parseQueueMaxAge time.Duration
+
+	flag.StringVar(&parseQueuePath, "parse_queue_path", "", "The directory where the serverlog parse requests are stored.")
+	flag.DurationVar(&parseQueueMaxAge, "parse_queue_max_age", 7*24*time.Hour, "How long are the finished serverlog parse requests kept.")
+
+	var logFormatsFile string
+
+	flag.StringVar(&logFormatsFile, "log_formats", "", "JSON file with the regex formats of the logs not in the Tableau serverlog formats. Leave empty to parse the serverlogs only.")
+
+	var correlateRequests bool
+
+	flag.BoolVar(&correlateRequests, "serverlog_correlation", false, "Write the start, end and duration of the requests and sessions of the JSON serverlogs to the serverlogs_requests table.")
+
+	var maskingRulesFile, maskingKey string
+
+	flag.StringVar(&maskingRulesFile, "masking_rules", "", "JSON file with the masking rules applied to the parsed serverlogs. Leave empty to keep the serverlogs as they are.")
+	flag.StringVar(&maskingKey, "masking_key", "", "The secret key of the hmac masking rules.")
+
+	var outputRotation OutputRotation
+
+	flag.IntVar(&outputRotation.MaxRows, "output_max_rows", 0, "The number of rows after the CSV outputs of the parsed serverlogs continue in a new file. 0 means unlimited.")
+	flag.Int64Var(&outputRotation.MaxBytes, "output_max_bytes", 0, "The uncompressed size in bytes after the CSV outputs of the parsed serverlogs continue in a new file. 0 means unlimited.")
+	flag.DurationVar(&outputRotation.MaxAge, "output_max_age", 0, "The time after the CSV outputs of the parsed serverlogs continue in a new file. 0 means unlimited.")
+
+	var ndjsonPath string
+	var liveRows int
+
+	flag.StringVar(&ndjsonPath, "ndjson_path", "", "The directory where the parsed serverlogs are copied as NDJSON files. Leave empty to skip the copies.")
+	flag.IntVar(&liveRows, "serverlog_live_rows", 0, "The number of the latest parsed serverlog rows kept for the live view. 0 disables the live view.")
+
+	// DIRECT COPY
+	// ===========
+	var pgCopy PgCopyConfig
+
+	flag.StringVar(&pgCopy.ConnString, "copy_database", "", "The connection string of the PostgreSQL / Greenplum database the outputs are copied into. Leave empty to leave the outputs for the loader.")
+	flag.StringVar(&pgCopy.Schema, "copy_schema", "public", "The schema of the tables the outputs are copied into.")
+	flag.IntVar(&pgCopy.Retries, "copy_retries", 3, "The number of retries of a COPY after a connection error.")
+	flag.DurationVar(&pgCopy.RetryDelay, "copy_retry_delay", 5*time.Second, "The delay between the retries of a COPY.")
+
 	// MISC
 	// ====
 	var useOldFormatFilename bool
@@ -110,6 +242,26 @@ func ParseOptions() InsightWebServiceConfig {
 		archivePath = filepath.Join(uploadBasePath, "..", "serverlogs-archives")
 	}
 
+	// Set the upload index path if its unset
+	if uploadIndexPath == "" {
+		uploadIndexPath = filepath.Join(uploadBasePath, "_index")
+	}
+
+	// Set the parquet path if its unset
+	if parquetPath == "" {
+		parquetPath = filepath.Join(uploadBasePath, "..", "parquet")
+	}
+
+	// Set the parse queue path if its unset
+	if parseQueuePath == "" {
+		parseQueuePath = filepath.Join(uploadBasePath, "_parse_queue")
+	}
+
+	// Set the quarantine path if its unset
+	if quarantinePath == "" {
+		quarantinePath = filepath.Join(uploadBasePath, "_quarantine")
+	}
+
 	// after parse, return the results
 	return InsightWebServiceConfig{
 		LicenseKey:        licenseKey,
@@ -126,6 +278,27 @@ func ParseOptions() InsightWebServiceConfig {
 		TlsKey:  tlsKey,
 
 		ServerlogsArchivePath: archivePath,
+		UploadIndexPath:       uploadIndexPath,
+		UploadIndexMaxAge:     uploadIndexMaxAge,
+		UploadRoutesFile:      uploadRoutesFile,
+		QuarantinePath:        quarantinePath,
+		TableSchemasFile:      tableSchemasFile,
+		TableOutputsFile:      tableOutputsFile,
+		ParquetPath:           parquetPath,
+		UploadLimits:          uploadLimits,
+		ParserWorkers:         parserWorkers,
+		ParserQueueSize:       parserQueueSize,
+		ParseQueuePath:        parseQueuePath,
+		ParseQueueMaxAge:      parseQueueMaxAge,
+		LogFormatsFile:        logFormatsFile,
+		CorrelateRequests:     correlateRequests,
+		MaskingRulesFile:      maskingRulesFile,
+		MaskingKey:            maskingKey,
+		OutputRotation:        outputRotation,
+		NdjsonPath:            ndjsonPath,
+		LiveRows:              liveRows,
+		PgCopy:                pgCopy,
 		UseOldFormatFilename:  useOldFormatFilename,
+		Args:                  flag.Args(),
 	}
 }
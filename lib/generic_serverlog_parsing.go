@@ -1,9 +1,13 @@
 package insight_server
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/palette-software/go-log-targets"
@@ -25,16 +29,25 @@ type ServerlogsSource struct {
 type ServerlogParserState interface {
 	Get(key string) ([]byte, bool)
 	Set(key string, value []byte)
+	// Returns the keys with a value starting with the prefix (sorted)
+	Keys(prefix string) []string
+
+	// The values kept as they are (for the parsers updating them on every
+	// line, so they are not encoded each time)
+	Value(key string) (interface{}, bool)
+	SetValue(key string, value interface{})
 }
 
 type baseServerlogParserState struct {
-	data map[string][]byte
+	data   map[string][]byte
+	values map[string]interface{}
 }
 
 // Creates a new state for the parser
 func MakeServerlogParserState() ServerlogParserState {
 	return &baseServerlogParserState{
-		data: map[string][]byte{},
+		data:   map[string][]byte{},
+		values: map[string]interface{}{},
 	}
 }
 
@@ -45,6 +58,45 @@ func (p *baseServerlogParserState) Get(key string) ([]byte, bool) {
 
 func (p *baseServerlogParserState) Set(key string, value []byte) { p.data[key] = value }
 
+func (p *baseServerlogParserState) Value(key string) (interface{}, bool) {
+	v, hasValue := p.values[key]
+	return v, hasValue
+}
+
+func (p *baseServerlogParserState) SetValue(key string, value interface{}) { p.values[key] = value }
+
+func (p *baseServerlogParserState) Keys(prefix string) []string {
+	o := []string{}
+	for key, value := range p.data {
+		if len(value) > 0 && strings.HasPrefix(key, prefix) {
+			o = append(o, key)
+		}
+	}
+	sort.Strings(o)
+	return o
+}
+
+// Loads a JSON value from the state. Returns false if there is none.
+func getParserStateJson(state ServerlogParserState, key string, value interface{}) (bool, error) {
+	data, hasValue := state.Get(key)
+	if !hasValue || len(data) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("Error loading parser state '%s': %v", key, err)
+	}
+	return true, nil
+}
+
+func setParserStateJson(state ServerlogParserState, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Error saving parser state '%s': %v", key, err)
+	}
+	state.Set(key, data)
+	return nil
+}
+
 // ==================== Serverlog Parser ====================
 
 // Reads serverlogs (the implementation determines the format)
@@ -55,6 +107,13 @@ type ServerlogsParser interface {
 	Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error
 }
 
+// Parsers keeping entries in the state until more lines arrive (like
+// multi-line log entries) implement this to write out what is left at the
+// end of the file
+type ServerlogsFinisher interface {
+	Finish(state ServerlogParserState, w ServerlogWriter) error
+}
+
 // A generic log parser that takes a reader and a timezone
 func ParseServerlogsWith(r io.Reader, parser ServerlogsParser, w ServerlogWriter, tz *time.Location) error {
 
@@ -68,6 +127,9 @@ func ParseServerlogsWith(r io.Reader, parser ServerlogsParser, w ServerlogWriter
 		record, err := csvReader.Read()
 		// in case of EOF we have finished
 		if err == io.EOF {
+			if finisher, ok := parser.(ServerlogsFinisher); ok {
+				return finisher.Finish(parserState, w)
+			}
 			return nil
 		}
 
@@ -148,46 +210,327 @@ type LogFormat int
 const (
 	LogFormatJson  = LogFormat(0)
 	LogFormatPlain = LogFormat(1)
+	// One of the regex log formats from the configuration
+	LogFormatRegex = LogFormat(2)
 )
 
+func (f LogFormat) String() string {
+	switch f {
+	case LogFormatJson:
+		return "json"
+	case LogFormatPlain:
+		return "plain"
+	case LogFormatRegex:
+		return "regex"
+	}
+	return fmt.Sprintf("LogFormat(%d)", int(f))
+}
+
 type ServerlogInput struct {
 	// the upload metadata
-	Meta *UploadMeta
+	Meta *UploadMeta `json:"meta"`
 
 	// The actual path in the archives
-	ArchivedFile string
+	ArchivedFile string `json:"archived_file"`
 
 	// The format of these logs
-	Format LogFormat
+	Format LogFormat `json:"format"`
+	// The name of the regex log format (for LogFormatRegex)
+	FormatName string `json:"format_name,omitempty"`
+}
+
+// The name of the format for the status
+func (s *ServerlogInput) formatName() string {
+	if s.Format == LogFormatRegex {
+		return s.FormatName
+	}
+	return s.Format.String()
+}
+
+// Returns the format of the serverlogs uploaded as a table. The regex log
+// formats come first, so they can match tables like 'plainlogs-apache'.
+// Returns false if the table is not a serverlog.
+func serverlogFormatOf(env *UploadHandlerEnv, table string) (LogFormat, string, bool) {
+	if format := env.LogFormats.ForTable(table); format != nil {
+		return LogFormatRegex, format.Name, true
+	}
+	if isPlainLog(table) {
+		return LogFormatPlain, "", true
+	}
+	if isJsonLog(table) {
+		return LogFormatJson, "", true
+	}
+	return LogFormatJson, "", false
+}
+
+// Returns the parser of an input, nil if its format is unknown
+func serverlogParserFor(env *UploadHandlerEnv, parserMap map[LogFormat]ServerlogsParser, input ServerlogInput) ServerlogsParser {
+	if input.Format != LogFormatRegex {
+		return parserMap[input.Format]
+	}
+	if format := env.LogFormats.Get(input.FormatName); format != nil {
+		return format
+	}
+	return nil
 }
 
-func MakeServerlogsParser(tmpDir, baseDir, archivesDir string, bufferSize int) (chan ServerlogInput, error) {
-	plainlogParser, err := MakePlainlogParser(tmpDir)
+// The defaults of the parser pool
+const (
+	defaultServerlogsParserWorkers   = 4
+	defaultServerlogsParserQueueSize = 256
+)
+
+// Parses the archived serverlogs on a pool of workers.
+//
+// The files are assigned to the workers by their host and table, so files
+// from the same host and log file are parsed in the order they arrived.
+// Each worker has a queue of a fixed size, and Reserve() fails instead of
+// blocking when the queue of the worker is full. The requests are also
+// written to the durable parse queue of the env (if there is one), and the
+// pending ones are queued again on startup. Reserve() fails until all of
+// them are queued, so new files are not parsed before the older ones.
+type ServerlogsParserPool struct {
+	env       *UploadHandlerEnv
+	parserMap map[LogFormat]ServerlogsParser
+
+	// the inputs of the workers
+	queues []chan *ServerlogsParseItem
+	// one token per queued input, so Enqueue() knows if a queue is full
+	// without racing other producers
+	slots []chan struct{}
+	// closed when the requests of the previous run are all queued
+	replayed chan struct{}
+}
+
+// Creates the parsers of the log formats
+func makeServerlogsParserMap(env *UploadHandlerEnv) (map[LogFormat]ServerlogsParser, error) {
+	plainlogParser, err := MakePlainlogParser(env.TmpDir)
 
 	if err != nil {
 		return nil, fmt.Errorf("Error creating plainlog parser: %v", err)
 	}
+	plainlogParser.masking = env.Masking
+
+	var jsonlogParser ServerlogsParser = &JsonLogParser{masking: env.Masking}
+	if env.CorrelateRequests {
+		if jsonlogParser, err = makeCorrelatingParser(jsonlogParser); err != nil {
+			return nil, fmt.Errorf("Error creating jsonlog parser: %v", err)
+		}
+	}
 
-	parserMap := map[LogFormat]ServerlogsParser{
-		LogFormatJson:  &JsonLogParser{},
+	return map[LogFormat]ServerlogsParser{
+		LogFormatJson:  jsonlogParser,
 		LogFormatPlain: plainlogParser,
+	}, nil
+}
+
+func MakeServerlogsParser(env *UploadHandlerEnv, workers, queueSize int) (*ServerlogsParserPool, error) {
+	parserMap, err := makeServerlogsParserMap(env)
+	if err != nil {
+		return nil, err
 	}
 
-	inputChan := make(chan ServerlogInput, bufferSize)
-	go func() {
-		for serverLog := range inputChan {
-			meta := serverLog.Meta
-			log.Infof("Received parse request. host=%s file=%s", meta.Host, meta.OriginalFilename)
-			if err := processServerlogRequest(tmpDir, baseDir, archivesDir, serverLog, parserMap[serverLog.Format]); err != nil {
-				log.Errorf("Error during parsing of serverlog. host=%s file=%s err=%s", meta.Host, meta.OriginalFilename, err)
-			}
+	if workers <= 0 {
+		workers = defaultServerlogsParserWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultServerlogsParserQueueSize
+	}
+
+	p := &ServerlogsParserPool{
+		env:       env,
+		parserMap: parserMap,
+		queues:    make([]chan *ServerlogsParseItem, workers),
+		slots:     make([]chan struct{}, workers),
+		replayed:  make(chan struct{}),
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan *ServerlogsParseItem, queueSize)
+		p.slots[i] = make(chan struct{}, queueSize)
+		go p.runWorker(i)
+	}
+
+	log.Infof("Started serverlog parsers. workers=%d queueSize=%d", workers, queueSize)
+
+	// the unfinished requests are loaded here, but queued in the background
+	// so the server does not wait for a long backlog to start
+	items, err := env.ParseQueue.Unfinished()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading unfinished parse requests: %v", err)
+	}
+	if len(items) == 0 {
+		close(p.replayed)
+	} else {
+		go p.replay(items)
+	}
+	return p, nil
+}
+
+// The error of the requests interrupted while parsing
+var errParseInterrupted = fmt.Errorf("Parsing was interrupted by a restart, some of the outputs may already be published. Re-parse the file by hand if needed")
+
+// Queues the requests left pending by the previous run. Waits for room in
+// the queues, so a long backlog is queued as the workers get through it.
+//
+// The requests interrupted while in progress are marked as failed instead
+// of parsing them again, as rotated or copied outputs of the interrupted
+// run may already be published, and parsing again would duplicate them.
+func (p *ServerlogsParserPool) replay(items []*ServerlogsParseItem) {
+	defer close(p.replayed)
+
+	for _, item := range items {
+		if item.Status == ParseStatusInProgress {
+			log.Errorf("Parse request was interrupted. id=%s host=%s file=%s", item.Id, item.Meta.Host, item.Meta.OriginalFilename)
+			p.env.ParseQueue.Finish(item, errParseInterrupted)
+			continue
 		}
-	}()
 
-	return inputChan, nil
+		idx := p.workerFor(item.Meta)
+		p.slots[idx] <- struct{}{}
+		p.queues[idx] <- item
+	}
+
+	log.Infof("Replayed unfinished parse requests. count=%d", len(items))
+}
+
+func (p *ServerlogsParserPool) runWorker(idx int) {
+	for item := range p.queues[idx] {
+		// free the slot so a new file can be queued
+		<-p.slots[idx]
+
+		meta := item.Meta
+		log.Infof("Received parse request. worker=%d id=%s host=%s file=%s", idx, item.Id, meta.Host, meta.OriginalFilename)
+
+		p.env.ParseQueue.Start(item)
+		_, err := processServerlogRequest(p.env, item.ServerlogInput, serverlogParserFor(p.env, p.parserMap, item.ServerlogInput))
+		if err != nil {
+			log.Errorf("Error during parsing of serverlog. id=%s host=%s file=%s err=%s", item.Id, meta.Host, meta.OriginalFilename, err)
+		}
+		p.env.ParseQueue.Finish(item, err)
+	}
+}
+
+// Returns the index of the worker parsing the files of an upload
+func (p *ServerlogsParserPool) workerFor(meta *UploadMeta) int {
+	h := fnv.New32a()
+	io.WriteString(h, meta.Host)
+	io.WriteString(h, "\x00")
+	io.WriteString(h, meta.TableName)
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// Reserves a place in the queue of the worker of an upload. Returns false if
+// the queue is full or the requests of the previous run are still being
+// queued. The reservation has to be used by Enqueue() or given back by
+// Cancel().
+func (p *ServerlogsParserPool) Reserve(meta *UploadMeta) bool {
+	select {
+	case <-p.replayed:
+	default:
+		return false
+	}
+
+	select {
+	case p.slots[p.workerFor(meta)] <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gives back a reservation without queueing anything
+func (p *ServerlogsParserPool) Cancel(meta *UploadMeta) {
+	<-p.slots[p.workerFor(meta)]
+}
+
+// Queues a file for parsing. Reserve() must have been called for its upload
+// before, so this never blocks. The reservation is given back if the request
+// cannot be stored.
+func (p *ServerlogsParserPool) Enqueue(input ServerlogInput) error {
+	item, err := p.env.ParseQueue.Add(input)
+	if err != nil {
+		p.Cancel(input.Meta)
+		return fmt.Errorf("Error storing parse request for '%s': %v", input.ArchivedFile, err)
+	}
+
+	p.queues[p.workerFor(input.Meta)] <- item
+	return nil
+}
+
+// The number of rows written by parsing a serverlog file
+type ServerlogsParseResult struct {
+	ParsedRows int `json:"parsed_rows"`
+	ErrorRows  int `json:"error_rows"`
+}
+
+// Counts the rows written by log key (the log file the rows come from)
+type countingServerlogWriter struct {
+	ServerlogWriter
+	logs map[string]*ServerlogsParseResult
+}
+
+func (w *countingServerlogWriter) logResult(source *ServerlogsSource) *ServerlogsParseResult {
+	result, ok := w.logs[source.Filename]
+	if !ok {
+		result = &ServerlogsParseResult{}
+		w.logs[source.Filename] = result
+	}
+	return result
+}
+
+func (w *countingServerlogWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	err := w.ServerlogWriter.WriteParsed(source, fields)
+	if err == nil {
+		w.logResult(source).ParsedRows++
+	}
+	return err
+}
+
+func (w *countingServerlogWriter) WriteError(source *ServerlogsSource, parseErr error, line string) error {
+	err := w.ServerlogWriter.WriteError(source, parseErr, line)
+	if err == nil {
+		w.logResult(source).ErrorRows++
+	}
+	return err
+}
+
+// Passes the side rows to the writer if it can write them
+func (w *countingServerlogWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	if sideWriter, ok := w.ServerlogWriter.(SideTableWriter); ok {
+		return sideWriter.WriteSide(source, table, headers, fields)
+	}
+	return nil
+}
+
+// Parses an archived serverlog file and records the outcome in the
+// serverlogs stats of the env
+func processServerlogRequest(env *UploadHandlerEnv, serverLog ServerlogInput, parser ServerlogsParser) (ServerlogsParseResult, error) {
+	meta := serverLog.Meta
+	fileResult := &ServerlogsFileResult{
+		Host:         meta.Host,
+		File:         meta.OriginalFilename,
+		Table:        meta.TableName,
+		Format:       serverLog.formatName(),
+		ArchivedFile: serverLog.ArchivedFile,
+		Logs:         map[string]*ServerlogsParseResult{},
+		Outputs:      []string{},
+		Started:      time.Now().UTC(),
+	}
+
+	err := parseServerlogFile(env, serverLog, parser, fileResult)
+
+	fileResult.Finished = time.Now().UTC()
+	fileResult.DurationMs = int64(fileResult.Finished.Sub(fileResult.Started) / time.Millisecond)
+	if err != nil {
+		fileResult.Error = fmt.Sprint(err)
+	}
+	env.ParseStats.Record(fileResult)
+
+	return fileResult.ServerlogsParseResult, err
 }
 
-func processServerlogRequest(tmpDir, baseDir, archivesDir string, serverLog ServerlogInput, parser ServerlogsParser) error {
+func parseServerlogFile(env *UploadHandlerEnv, serverLog ServerlogInput, parser ServerlogsParser, fileResult *ServerlogsFileResult) error {
 	meta := serverLog.Meta
 
 	// The input file is in the archives folder
@@ -197,32 +540,136 @@ func processServerlogRequest(tmpDir, baseDir, archivesDir string, serverLog Serv
 		return fmt.Errorf("Unknown input format for '%s'", inputFn)
 	}
 
-	// open the file we have been sent as a gzipped file
-	inputF, err := NewGzippedFileReader(inputFn)
+	// open the file we have been sent (compressed with any codec)
+	inputF, err := NewCompressedFileReader(inputFn)
 	if err != nil {
 		return fmt.Errorf("Error opening serverlog file '%s' for parsing: %v", inputFn, err)
 	}
 	defer inputF.Close()
 
-	// find out where we are planning to output the parsed data
-	targetFile := meta.GetOutputFilename(baseDir)
+	// the regex log formats write to their own tables
+	writerMeta := meta
+	if format, ok := parser.(*RegexLogFormat); ok {
+		writerMeta = format.outputMeta(meta, env.Outputs)
+	}
+
+	logWriter := newServerlogWriter(env, writerMeta, parser.Header())
+	writers := []ServerlogWriter{logWriter}
+	defer func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
+
+	// the log files matched by a regex format by their name go to the
+	// tables of the format
+	if serverLog.Format == LogFormatPlain && env.LogFormats.HasFilenameMatches() {
+		parser = &regexLogRouter{
+			ServerlogsParser: parser,
+			formats:          env.LogFormats,
+			newWriter: func(format *RegexLogFormat) ServerlogWriter {
+				formatWriter := newServerlogWriter(env, format.outputMeta(meta, env.Outputs), format.Header())
+				writers = append(writers, formatWriter)
+				return &countingServerlogWriter{ServerlogWriter: maskErrorRows(formatWriter, env.Masking), logs: fileResult.Logs}
+			},
+			writers: map[string]ServerlogWriter{},
+		}
+	}
 
-	// create the log writer
-	logWriter := NewServerlogsWriter(
-		filepath.Dir(targetFile),
-		tmpDir,
-		filepath.Base(targetFile),
-		parser.Header(),
-	)
-	defer logWriter.Close()
+	countingWriter := &countingServerlogWriter{ServerlogWriter: maskErrorRows(logWriter, env.Masking), logs: fileResult.Logs}
 
 	// try to parse the logs using this parser
-	if err := ParseServerlogsWith(inputF, parser, logWriter, meta.Timezone); err != nil {
+	err = ParseServerlogsWith(inputF, parser, countingWriter, meta.Timezone)
+	for _, w := range writers {
+		fileResult.ParsedRows += w.ParsedRowCount()
+		fileResult.ErrorRows += w.ErrorRowCount()
+	}
+	if err != nil {
 		return fmt.Errorf("Error during parsing serverlog file '%s': %v", inputFn, err)
 	}
 
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("Error writing outputs of serverlog file '%s': %v", inputFn, err)
+		}
+		if withOutputs, ok := w.(interface {
+			OutputFileNames() []string
+		}); ok {
+			fileResult.Outputs = append(fileResult.Outputs, withOutputs.OutputFileNames()...)
+		}
+		if fanout, ok := w.(*fanoutServerlogWriter); ok {
+			fileResult.Sinks = append(fileResult.Sinks, fanout.SinkResults()...)
+		}
+	}
+
 	log.Infof("Done parsing. host=%s file=%s count=%d errorCount=%d", meta.Host,
-		meta.OriginalFilename, logWriter.ParsedRowCount(), logWriter.ErrorRowCount())
+		meta.OriginalFilename, fileResult.ParsedRows, fileResult.ErrorRows)
 
 	return nil
 }
+
+// Creates the writer of the parsed serverlogs of an upload: the output of the
+// table and the sinks enabled in the env
+func newServerlogWriter(env *UploadHandlerEnv, meta *UploadMeta, header []string) ServerlogWriter {
+	outputSink := "csv"
+	if meta.GetOutputCodec().IsParquet() {
+		outputSink = OutputFormatParquet
+	}
+	w := newFanoutServerlogWriter(meta.TableName, outputSink, newServerlogOutputWriter(env, meta, header))
+
+	for _, sink := range getServerlogSinkFactories() {
+		if sinkWriter := sink.factory(env, meta, header); sinkWriter != nil {
+			w.addSink(sink.name, sinkWriter)
+		}
+	}
+	return w
+}
+
+// Creates the writer of the output files of the table
+func newServerlogOutputWriter(env *UploadHandlerEnv, meta *UploadMeta, header []string) ServerlogWriter {
+	metadata := serverlogsMetadataColumns(env.LogFormats)
+
+	var w ServerlogWriter
+	if meta.GetOutputCodec().IsParquet() {
+		w = NewServerlogsParquetWriter(env.ParquetDir, env.TmpDir, meta, header, metadata)
+	} else {
+		// find out where we are planning to output the parsed data
+		targetFile := meta.GetOutputFilename(env.BaseDir)
+
+		w = NewServerlogsWriter(
+			filepath.Dir(targetFile),
+			env.TmpDir,
+			filepath.Base(targetFile),
+			header,
+			meta.GetOutputCodec(),
+			env.OutputRotation,
+		)
+	}
+
+	if logWriter, ok := w.(*serverlogsWriter); ok {
+		logWriter.newSideWriter = makeSideTableWriterFactory(env, meta, metadata)
+		logWriter.copyTo(env.PgCopy, meta.TableName)
+	}
+	return w
+}
+
+// Creates the writers of the side tables of an upload. The side tables have
+// their own output codecs.
+func makeSideTableWriterFactory(env *UploadHandlerEnv, meta *UploadMeta, metadata [][]metaColumn) func(table string, headers []string) rowFileWriter {
+	return func(table string, headers []string) rowFileWriter {
+		sideMeta := *meta
+		sideMeta.TableName = table
+		sideMeta.OutputCodec = env.Outputs.Get(table)
+
+		if sideMeta.GetOutputCodec().IsParquet() {
+			columns := parquetColumnsFromMetadata(table, metadata)
+			if len(columns) != len(headers) {
+				columns = parquetColumnsFromHeader(headers)
+			}
+			return NewParquetFileWriter(sideMeta.GetParquetOutputFilename(env.ParquetDir, table), env.TmpDir, columns, sideMeta.GetOutputCodec())
+		}
+		w := NewCsvFileWriter(env.TmpDir, sideMeta.GetOutputFilename(env.BaseDir), headers, sideMeta.GetOutputCodec(), env.OutputRotation)
+		w.copyTo(env.PgCopy, table)
+		return w
+	}
+}
@@ -0,0 +1,51 @@
+package insight_server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestServerlogsParserPool_Reserve(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	pool, err := MakeServerlogsParser(env, 4, 1)
+	tassert.Nil(t, err)
+
+	meta := makeTestUploadMeta("")
+	meta.TableName = "serverlogs"
+
+	// the same host and table always go to the same worker
+	other := makeTestUploadMeta("")
+	other.TableName = "serverlogs"
+	tassert.Equal(t, pool.workerFor(meta), pool.workerFor(other))
+
+	tassert.True(t, pool.Reserve(meta))
+	tassert.False(t, pool.Reserve(other))
+
+	pool.Cancel(meta)
+	tassert.True(t, pool.Reserve(other))
+}
+
+func TestServerlogsUploadHandler_QueueFull(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	env.ParserWorkers = 1
+	env.ParserQueueSize = 1
+
+	handler, err := NewServerlogsUploadHandler(env)
+	tassert.Nil(t, err)
+
+	meta := makeTestUploadMeta("")
+	meta.TableName = "serverlogs"
+
+	// fill the queue
+	tassert.True(t, handler.(*ServerlogsUploadHandler).parsers.Reserve(meta))
+
+	err = handler.HandleUpload(meta, strings.NewReader("a\vb\n"))
+	tassert.NotNil(t, err)
+	tassert.Equal(t, http.StatusServiceUnavailable, getUploadErrorStatus(err))
+}
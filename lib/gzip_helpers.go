@@ -1,9 +1,7 @@
 package insight_server
 
 import (
-	"compress/gzip"
 	"crypto/md5"
-	"crypto/rand"
 	"fmt"
 	"hash"
 	"io"
@@ -15,52 +13,58 @@ import (
 	log "github.com/palette-software/go-log-targets"
 )
 
-type gzippedFileReader struct {
-	baseFile   *os.File
-	gzipReader *gzip.Reader
+type compressedFileReader struct {
+	baseFile *os.File
+	reader   io.ReadCloser
 }
 
-// Creates a new gzipped file reader
-func NewGzippedFileReader(fileName string) (io.ReadCloser, error) {
+// Creates a new reader for an output file. The compression of the file
+// (gzip, zstd or none) is detected from its contents.
+func NewCompressedFileReader(fileName string) (io.ReadCloser, error) {
 	baseFile, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 
-	gzipReader, err := gzip.NewReader(baseFile)
+	reader, err := makeUploadDecompressor("", baseFile)
 	if err != nil {
+		baseFile.Close()
 		return nil, err
 	}
 
-	return &gzippedFileReader{
-		baseFile:   baseFile,
-		gzipReader: gzipReader,
+	return &compressedFileReader{
+		baseFile: baseFile,
+		reader:   reader,
 	}, nil
 }
 
-// Closes the underlying file
-func (g *gzippedFileReader) Close() error {
-	return g.baseFile.Close()
+// Closes the decompressor and the underlying file
+func (c *compressedFileReader) Close() error {
+	c.reader.Close()
+	return c.baseFile.Close()
 }
 
-// Forwards reading to the underlying gzipped stream
-func (g *gzippedFileReader) Read(p []byte) (n int, err error) {
-	return g.gzipReader.Read(p)
+// Forwards reading to the underlying decompressed stream
+func (c *compressedFileReader) Read(p []byte) (n int, err error) {
+	return c.reader.Read(p)
 }
 
 // Writer
 // ------
 
-// Encapsulates a writer that writes to a gzipped temp file
+// Encapsulates a writer that writes to a compressed temp file
 // that is moved to its final destination after Close() is called
-type GzippedFileWriterWithTemp struct {
+type FileWriterWithTemp struct {
 	filePath string
 
 	// The directory where the tempfile will be located
 	tmpDir string
 
-	tmpFile    *os.File
-	gzipWriter *gzip.Writer
+	tmpFile *os.File
+
+	// The codec of the output and the writer compressing into tmpFile
+	codec      *OutputCodec
+	compressor io.WriteCloser
 
 	hasher hash.Hash
 
@@ -69,17 +73,25 @@ type GzippedFileWriterWithTemp struct {
 	BytesWritten int
 }
 
-func NewGzippedFileWriterWithTemp(file string, tmpDir string) (*GzippedFileWriterWithTemp, error) {
-	tmpFile, err := ioutil.TempFile(tmpDir, fmt.Sprintf("gzipped-preprocess-%s", SanitizeName(filepath.Base(file))))
+// Creates a writer writing the output with the given codec
+func NewFileWriterWithTemp(file string, tmpDir string, codec *OutputCodec) (*FileWriterWithTemp, error) {
+	tmpFile, err := ioutil.TempFile(tmpDir, fmt.Sprintf("preprocess-%s", SanitizeName(filepath.Base(file))))
 	if err != nil {
 		return nil, fmt.Errorf("Cannot open temp file: %v", err)
 	}
 
-	gzipWriter := gzip.NewWriter(tmpFile)
-	return &GzippedFileWriterWithTemp{
+	compressor, err := codec.newWriter(tmpFile)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, fmt.Errorf("Cannot create %s output: %v", codec.Codec, err)
+	}
+
+	return &FileWriterWithTemp{
 		filePath:     file,
 		tmpFile:      tmpFile,
-		gzipWriter:   gzipWriter,
+		codec:        codec,
+		compressor:   compressor,
 		hasher:       md5.New(),
 		isClosed:     false,
 		BytesWritten: 0,
@@ -87,38 +99,34 @@ func NewGzippedFileWriterWithTemp(file string, tmpDir string) (*GzippedFileWrite
 }
 
 // Deletes the temporary file
-func (g *GzippedFileWriterWithTemp) Drop() error {
+func (g *FileWriterWithTemp) Drop() error {
 	defer func() { g.isClosed = true }()
+	// stop the compressor, the output is thrown away anyway
+	g.compressor.Close()
 	g.tmpFile.Close()
 	os.Remove(g.tmpFile.Name())
 	return nil
 }
 
 // Returns the md5 of the already written data
-func (g *GzippedFileWriterWithTemp) Md5() []byte {
+func (g *FileWriterWithTemp) Md5() []byte {
 	return g.hasher.Sum(nil)
 }
 
 // Returns the output filename by using the hash and the original output filename
-func (g *GzippedFileWriterWithTemp) GetFileName() string {
+func (g *FileWriterWithTemp) GetFileName() string {
 	// get the file hash
 	return g.GetFileNameForMd5(fmt.Sprintf("%032x", g.Md5()))
 }
 
 // Returns the output filename by using random bytes instead of a hash
-func (g *GzippedFileWriterWithTemp) GetRandomFileName() string {
-	buf := make([]byte, 16)
-	// Read some random bytes
-	if _, err := rand.Read(buf); err != nil {
-		// if there is an error, revert back to the less safe stuff
-		buf = RandStringBytes(16)
-	}
+func (g *FileWriterWithTemp) GetRandomFileName() string {
 	// generate a random 32 char string
-	return g.GetFileNameForMd5(fmt.Sprintf("%032x", buf))
+	return g.GetFileNameForMd5(makeRandomId())
 }
 
 // Returns the output filename by using the supplied md5 string and the original output filename
-func (g *GzippedFileWriterWithTemp) GetFileNameForMd5(fileMd5 string) string {
+func (g *FileWriterWithTemp) GetFileNameForMd5(fileMd5 string) string {
 	// replace the {{md5}} token with the actual md5
 	baseFilename := strings.Replace(filepath.Base(g.filePath), "{{md5}}", fileMd5, -1)
 	baseFileExt := filepath.Ext(baseFilename)
@@ -127,14 +135,15 @@ func (g *GzippedFileWriterWithTemp) GetFileNameForMd5(fileMd5 string) string {
 	// but with our new filename containing the hash of the file
 	return filepath.ToSlash(filepath.Join(
 		filepath.Dir(g.filePath),
-		fmt.Sprintf("%s.%s.gz",
+		fmt.Sprintf("%s.%s%s",
 			SanitizeName(strings.TrimSuffix(baseFilename, baseFileExt)),
 			SanitizeName(baseFileExt[1:]),
+			g.codec.Extension(),
 		),
 	))
 }
 
-func (g *GzippedFileWriterWithTemp) Close() error {
+func (g *FileWriterWithTemp) Close() error {
 	// if we are already closed
 	if g.isClosed {
 		return nil
@@ -143,47 +152,74 @@ func (g *GzippedFileWriterWithTemp) Close() error {
 	return g.CloseWithFileName(g.GetFileName())
 }
 
-func (g *GzippedFileWriterWithTemp) CloseWithFileName(outFileName string) error {
+func (g *FileWriterWithTemp) CloseWithFileName(outFileName string) error {
 	// if we are already closed
 	if g.isClosed {
 		return nil
 	}
 
-	// Create the files directory
-	if err := CreateDirectoryIfNotExists(filepath.Dir(outFileName)); err != nil {
+	defer func() { g.isClosed = true }()
+	if err := g.closeTemp(); err != nil {
 		return err
 	}
 
-	defer func() { g.isClosed = true }()
+	// now we can move it to its final destination
+	return moveOutputFile(g.tmpFile.Name(), outFileName)
+}
+
+// Closes the compressed stream and the temp file under it
+func (g *FileWriterWithTemp) closeTemp() error {
 	// make sure we close the temp file even in case of error
 	defer g.tmpFile.Close()
 
-	// flush the stream
-	if err := g.gzipWriter.Flush(); err != nil {
-		return fmt.Errorf("Error while flushing gzip writer: %v", err)
-	}
-
-	// close the gzip stream
-	if err := g.gzipWriter.Close(); err != nil {
-		return fmt.Errorf("Error while closing gzip writer: %v", err)
+	// close the compressed stream
+	if err := g.compressor.Close(); err != nil {
+		return fmt.Errorf("Error while closing %s writer: %v", g.codec.Codec, err)
 	}
 
 	// close the underlying file
 	if err := g.tmpFile.Close(); err != nil {
 		return fmt.Errorf("Error closing temporary file '%s': %v", g.tmpFile.Name(), err)
 	}
+	return nil
+}
+
+// Moves a closed output to its place, creating its directory
+func moveOutputFile(fileName, outFileName string) error {
+	if err := CreateDirectoryIfNotExists(filepath.Dir(outFileName)); err != nil {
+		return err
+	}
 
-	// Add the MD5 to the filename
-	log.Debugf("Moving output source=%s destination=%s", g.tmpFile.Name(), outFileName)
-	// now we can move it to its final destination
-	return os.Rename(g.tmpFile.Name(), outFileName)
+	log.Debugf("Moving output source=%s destination=%s", fileName, outFileName)
+	return os.Rename(fileName, outFileName)
+}
+
+// Closes the output and queues it for copying into the table with the
+// copier. The file is moved to outFileName for the loader right away if there
+// is no copier or it cannot take the output, otherwise by the copier if the
+// copy fails. Returns true if the output was queued.
+func (g *FileWriterWithTemp) CloseWithCopy(outFileName string, copier *PgCopier, table string) (bool, error) {
+	if copier == nil || g.isClosed || !copier.isAvailable() {
+		return false, g.CloseWithFileName(outFileName)
+	}
+
+	defer func() { g.isClosed = true }()
+	if err := g.closeTemp(); err != nil {
+		os.Remove(g.tmpFile.Name())
+		return false, err
+	}
+
+	if copier.Enqueue(table, g.tmpFile.Name(), outFileName) {
+		return true, nil
+	}
+	return false, moveOutputFile(g.tmpFile.Name(), outFileName)
 }
 
-// Forward writes to the gzip stream
-func (g *GzippedFileWriterWithTemp) Write(p []byte) (n int, err error) {
+// Forward writes to the compressed stream
+func (g *FileWriterWithTemp) Write(p []byte) (n int, err error) {
 	// append the bytes to the hasher
 	g.hasher.Write(p)
 	g.BytesWritten += len(p)
 	// write the output
-	return g.gzipWriter.Write(p)
+	return g.compressor.Write(p)
 }
@@ -5,12 +5,12 @@ package insight_server
 import (
 	"bytes"
 	"crypto/md5"
+	cryptorand "crypto/rand"
 	"encoding/csv"
 	"fmt"
 	"hash"
 	"io"
 	"math/rand"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -90,31 +90,6 @@ func CreateDirectoryIfNotExists(path string) error {
 // HTTP PACKAGE HELPERS
 // ====================
 
-// Helper to get a part from a multipart message
-func getMultipartFile(form *multipart.Form, fieldName string) (file multipart.File, fileName string, err error) {
-
-	// get the file from the form
-	fn := form.File[fieldName]
-	if len(fn) != 1 {
-		err = fmt.Errorf("The request must have exactly 1 '%v' field (has %v).", fieldName, len(fn))
-		return
-	}
-
-	// take the first one
-	uploadedFile := fn[0]
-
-	// set the filename
-	fileName = uploadedFile.Filename
-
-	// get the file reader
-	file, err = uploadedFile.Open()
-	if err != nil {
-		return
-	}
-
-	return
-}
-
 // Returns an url param, or an error if no such param is available
 func getUrlParam(reqUrl *url.URL, paramName string) (string, error) {
 
@@ -254,6 +229,17 @@ func RandStringBytes(n int) []byte {
 	return b
 }
 
+// Returns a random 32 character hex string
+func makeRandomId() string {
+	buf := make([]byte, 16)
+	// Read some random bytes
+	if _, err := cryptorand.Read(buf); err != nil {
+		// if there is an error, revert back to the less safe stuff
+		buf = RandStringBytes(16)
+	}
+	return fmt.Sprintf("%032x", buf)
+}
+
 // CSV Reading/writing for GP
 // ==========================
 
@@ -20,6 +20,45 @@ type ServerlogWriter interface {
 	ErrorRowCount() int
 }
 
+// Writers that can write the rows of the side tables (the tables extracted
+// from the parsed rows, like the queries of the serverlogs) implement this
+type SideTableWriter interface {
+	// The headers are only used when the first row of the table is written
+	WriteSide(source *ServerlogsSource, table string, headers, fields []string) error
+}
+
+// Writes the rows of an output table
+type rowFileWriter interface {
+	io.Closer
+
+	WriteRow(row []string) error
+	// The names of the output files (empty if no rows were written)
+	OutputFileNames() []string
+}
+
+// Output rotation
+// ---------------
+
+// When does a writer close its output file and continue in a new one. The
+// zero values mean no limit.
+type OutputRotation struct {
+	// The number of rows in a file
+	MaxRows int
+	// The number of bytes in a file (before compression, counted as the
+	// buffered rows are flushed)
+	MaxBytes int64
+	// The time since the file was created
+	MaxAge time.Duration
+}
+
+// Returns true if a file with this many rows and bytes, created at the
+// given time has to be rotated
+func (r OutputRotation) isDue(rows int, bytes int64, createdAt time.Time) bool {
+	return (r.MaxRows > 0 && rows >= r.MaxRows) ||
+		(r.MaxBytes > 0 && bytes >= r.MaxBytes) ||
+		(r.MaxAge > 0 && time.Since(createdAt) >= r.MaxAge)
+}
+
 // Log Writer
 // ----------
 
@@ -32,25 +71,40 @@ type csvFileWriter struct {
 
 	headers []string
 
-	file   *GzippedFileWriterWithTemp
+	codec  *OutputCodec
+	file   *FileWriterWithTemp
 	writer *GpCsvWriter
 
 	isClosed bool
 
 	tsColumn    string
 	outFileName string
+
+	// When to continue in a new output file
+	rotation OutputRotation
+	// The rows in the current file and the time it was created
+	rowCount  int
+	createdAt time.Time
+	// The output files already closed by the rotation
+	closedFileNames []string
+
+	// Copies the outputs into the table of the writer (can be nil)
+	copier *PgCopier
+	table  string
 }
 
-func NewCsvFileWriter(tmpDir, baseFileName string, headers []string) *csvFileWriter {
+func NewCsvFileWriter(tmpDir, baseFileName string, headers []string, codec *OutputCodec, rotation OutputRotation) *csvFileWriter {
 	return &csvFileWriter{
 		tmpDir:       tmpDir,
 		baseFileName: baseFileName,
 		hasFile:      false,
 		headers:      headers,
+		codec:        codec,
 		isClosed:     false,
 		// the timestamp we'll be using
 		tsColumn:    time.Now().Format(GpfdistPostfixTsFormat),
 		outFileName: "",
+		rotation:    rotation,
 	}
 }
 
@@ -69,14 +123,17 @@ func (w *csvFileWriter) CreateFile() error {
 		return nil
 	}
 
-	f, err := NewGzippedFileWriterWithTemp(w.baseFileName, w.tmpDir)
+	f, err := NewFileWriterWithTemp(w.baseFileName, w.tmpDir, w.codec)
 	if err != nil {
 		return fmt.Errorf("Error while creating parse error output file for '%s': %v", w.baseFileName, err)
 	}
 
 	w.file = f
+	// each piece has its own random name (and p_filepath)
 	w.outFileName = f.GetRandomFileName()
 	w.writer = MakeCsvWriter(f)
+	w.rowCount = 0
+	w.createdAt = time.Now()
 
 	// write the headers
 	if err := w.writeInternal(w.extendHeaders(w.headers)); err != nil {
@@ -90,12 +147,24 @@ func (w *csvFileWriter) CreateFile() error {
 
 // Writes a row to the csv writer
 func (w *csvFileWriter) WriteRow(row []string) error {
-	if !w.hasFile {
-		w.CreateFile()
+	// continue in a new file if the current one is full
+	if w.hasFile && w.rotation.isDue(w.rowCount, int64(w.file.BytesWritten), w.createdAt) {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
 	}
 
-	return w.writeInternal(w.extendRow(row))
+	if !w.hasFile {
+		if err := w.CreateFile(); err != nil {
+			return err
+		}
+	}
 
+	if err := w.writeInternal(w.extendRow(row)); err != nil {
+		return err
+	}
+	w.rowCount++
+	return nil
 }
 
 // code shared between CreateFile() and WriteRow()
@@ -114,6 +183,15 @@ func (w *csvFileWriter) writeInternal(row []string) error {
 	return nil
 }
 
+// Returns the names of the output files in the order they were written
+func (w *csvFileWriter) OutputFileNames() []string {
+	o := append([]string{}, w.closedFileNames...)
+	if w.hasFile {
+		o = append(o, w.outFileName)
+	}
+	return o
+}
+
 // Closes the file if it is open
 func (w *csvFileWriter) Close() error {
 	// if we are already closed, return
@@ -125,6 +203,12 @@ func (w *csvFileWriter) Close() error {
 	if !w.hasFile {
 		return nil
 	}
+	return w.closeFile()
+}
+
+// Closes the current output file, the next row goes to a new one
+func (w *csvFileWriter) closeFile() error {
+	w.hasFile = false
 
 	// make sure we close (and move) the error file even if we have errors
 	defer w.file.CloseWithFileName(w.outFileName)
@@ -132,28 +216,47 @@ func (w *csvFileWriter) Close() error {
 	// flush the output
 	w.writer.Flush()
 	if err := w.writer.Error(); err != nil {
+		w.closedFileNames = append(w.closedFileNames, w.outFileName)
 		return fmt.Errorf("Error flushing CSV output: %v", err)
 	}
 
-	// try to close the output
-	if err := w.file.CloseWithFileName(w.outFileName); err != nil {
+	// try to close the output (the copied outputs are not left for the
+	// loader)
+	copied, err := w.file.CloseWithCopy(w.outFileName, w.copier, w.table)
+	if !copied {
+		w.closedFileNames = append(w.closedFileNames, w.outFileName)
+	}
+	if err != nil {
 		return fmt.Errorf("Error closing CSV output: %v", err)
 	}
 
 	return nil
 }
 
+// Copies the outputs into the table with the copier when they are closed
+func (w *csvFileWriter) copyTo(copier *PgCopier, table string) {
+	w.copier = copier
+	w.table = table
+}
+
 // The combined writer for errors and parsed
 // -----------------------------------------
 
 type serverlogsWriter struct {
-	parsedWriter, errorsWriter *csvFileWriter
+	parsedWriter, errorsWriter rowFileWriter
+
+	// Creates the writer of a side table when its first row arrives (the
+	// side rows are dropped if this is nil)
+	newSideWriter func(table string, headers []string) rowFileWriter
+	sideWriters   map[string]rowFileWriter
+	// the side tables in the order of their first rows
+	sideTables []string
 
 	parsedCount, errorCount int
 	isClosed                bool
 }
 
-func NewServerlogsWriter(outputDir, tmpDir, fileBaseName string, parsedHeaders []string) ServerlogWriter {
+func NewServerlogsWriter(outputDir, tmpDir, fileBaseName string, parsedHeaders []string, codec *OutputCodec, rotation OutputRotation) ServerlogWriter {
 	// the output path for the logs
 	parsedOutputPath := filepath.Join(outputDir, fileBaseName)
 	// error files are in the same directory but have a prefix
@@ -164,16 +267,51 @@ func NewServerlogsWriter(outputDir, tmpDir, fileBaseName string, parsedHeaders [
 			tmpDir,
 			parsedOutputPath,
 			append([]string{"filename", "host_name"}, parsedHeaders...),
+			codec,
+			rotation,
 		),
 		errorsWriter: NewCsvFileWriter(
 			tmpDir,
 			errorsOutputPath,
-			[]string{"error", "hostname", "filename", "line"},
+			[]string{"error", "host_name", "filename", "line"},
+			codec,
+			rotation,
 		),
 		isClosed: false,
 	}
 }
 
+// Creates a serverlogs writer writing parquet files. The column types come
+// from the metadata of the serverlogs tables.
+func NewServerlogsParquetWriter(parquetDir, tmpDir string, meta *UploadMeta, parsedHeaders []string, metadata [][]metaColumn) ServerlogWriter {
+	parsedHeaders = append([]string{"filename", "host_name"}, parsedHeaders...)
+	errorHeaders := []string{"error", "host_name", "filename", "line"}
+
+	makeWriter := func(table string, headers []string) rowFileWriter {
+		columns := parquetColumnsFromMetadata(table, metadata)
+		if len(columns) != len(headers) {
+			columns = parquetColumnsFromHeader(headers)
+		}
+		return NewParquetFileWriter(meta.GetParquetOutputFilename(parquetDir, table), tmpDir, columns, meta.GetOutputCodec())
+	}
+
+	return &serverlogsWriter{
+		parsedWriter: makeWriter(meta.TableName, parsedHeaders),
+		errorsWriter: makeWriter(fmt.Sprintf("error_%s", meta.TableName), errorHeaders),
+		isClosed:     false,
+	}
+}
+
+// Copies the CSV outputs into the tables of the upload with the copier
+func (w *serverlogsWriter) copyTo(copier *PgCopier, table string) {
+	if parsedWriter, ok := w.parsedWriter.(*csvFileWriter); ok {
+		parsedWriter.copyTo(copier, table)
+	}
+	if errorsWriter, ok := w.errorsWriter.(*csvFileWriter); ok {
+		errorsWriter.copyTo(copier, fmt.Sprintf("error_%s", table))
+	}
+}
+
 func (w *serverlogsWriter) WriteError(source *ServerlogsSource, parseErr error, line string) error {
 	// log errors so splunk can pick them up
 	log.Errorf("Error during serverlog parsing. host=%s file=%s line=%s err=%s", source.Host, source.Filename, line, parseErr)
@@ -194,12 +332,35 @@ func (w *serverlogsWriter) WriteParsed(source *ServerlogsSource, fields []string
 	return err
 }
 
+func (w *serverlogsWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	if w.newSideWriter == nil {
+		return nil
+	}
+
+	writer, ok := w.sideWriters[table]
+	if !ok {
+		if w.sideWriters == nil {
+			w.sideWriters = map[string]rowFileWriter{}
+		}
+		writer = w.newSideWriter(table, append([]string{"filename", "host_name"}, headers...))
+		w.sideWriters[table] = writer
+		w.sideTables = append(w.sideTables, table)
+	}
+	return writer.WriteRow(append([]string{source.Filename, source.Host}, fields...))
+}
+
 func (w *serverlogsWriter) Close() error {
 	if w.isClosed {
 		return nil
 	}
 	// update the isClosed flag
 	defer func() { w.isClosed = true }()
+	// close the side tables
+	for _, table := range w.sideTables {
+		if err := w.sideWriters[table].Close(); err != nil {
+			log.Errorf("Error closing side table output. table=%s err=%s", table, err)
+		}
+	}
 	// close the errors file
 	// TODO: merge the possible error from here with the possible error from parsedwriter's close()
 	defer w.errorsWriter.Close()
@@ -207,6 +368,19 @@ func (w *serverlogsWriter) Close() error {
 	return w.parsedWriter.Close()
 }
 
+// Returns the names of the output files written
+func (w *serverlogsWriter) OutputFileNames() []string {
+	o := []string{}
+	writers := []rowFileWriter{w.parsedWriter, w.errorsWriter}
+	for _, table := range w.sideTables {
+		writers = append(writers, w.sideWriters[table])
+	}
+	for _, writer := range writers {
+		o = append(o, writer.OutputFileNames()...)
+	}
+	return o
+}
+
 func (w *serverlogsWriter) ParsedRowCount() int {
 	return w.parsedCount
 }
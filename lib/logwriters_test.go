@@ -0,0 +1,54 @@
+package insight_server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func readTestCsvOutput(t *testing.T, fileName string) []string {
+	r, err := NewCompressedFileReader(fileName)
+	tassert.Nil(t, err)
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	tassert.Nil(t, err)
+	return strings.Split(strings.TrimSuffix(string(contents), "\r\n"), "\r\n")
+}
+
+func TestCsvFileWriter_Rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv-rotation")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	w := NewCsvFileWriter(dir, filepath.Join(dir, "threadinfo-{{md5}}.csv"), []string{"a"}, DefaultOutputCodec, OutputRotation{MaxRows: 2})
+	for _, row := range []string{"1", "2", "3", "4", "5"} {
+		tassert.Nil(t, w.WriteRow([]string{row}))
+	}
+	tassert.Nil(t, w.Close())
+
+	outputs := w.OutputFileNames()
+	tassert.Len(t, outputs, 3)
+	for i, rows := range [][]string{{"1", "2"}, {"3", "4"}, {"5"}} {
+		lines := readTestCsvOutput(t, outputs[i])
+		tassert.Equal(t, "p_filepath\va\vp_cre_date", lines[0])
+		tassert.Len(t, lines, len(rows)+1)
+		for j, row := range rows {
+			// each piece has its own p_filepath
+			tassert.True(t, strings.HasPrefix(lines[j+1], outputs[i]+"\v"+row+"\v"), lines[j+1])
+		}
+	}
+}
+
+func TestOutputRotation_IsDue(t *testing.T) {
+	tassert.False(t, OutputRotation{}.isDue(1000000, 1<<30, time.Now().Add(-time.Hour)))
+	tassert.True(t, OutputRotation{MaxRows: 10}.isDue(10, 0, time.Now()))
+	tassert.False(t, OutputRotation{MaxRows: 10}.isDue(9, 0, time.Now()))
+	tassert.True(t, OutputRotation{MaxBytes: 100}.isDue(1, 100, time.Now()))
+	tassert.True(t, OutputRotation{MaxAge: time.Minute}.isDue(1, 0, time.Now().Add(-2*time.Minute)))
+	tassert.False(t, OutputRotation{MaxAge: time.Minute}.isDue(1, 0, time.Now()))
+}
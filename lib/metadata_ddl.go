@@ -0,0 +1,301 @@
+package insight_server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/namsral/flag"
+)
+
+// DDL generation
+// ==============
+//
+// Generates the CREATE TABLE statements of all known tables from the
+// metadata: the tables sent by the agents in their metadata uploads and the
+// serverlogs tables defined by the server (the same merge the metadata
+// upload handler does for the loader). Every table gets the p_filepath and
+// p_cre_date columns of the loader.
+
+// The columns added to all tables for the loader
+var (
+	ddlPrefixColumn  = metaColumn{column: "p_filepath", formatType: "text"}
+	ddlPostfixColumn = metaColumn{column: "p_cre_date", formatType: "timestamp without time zone"}
+)
+
+// Returns the CREATE TABLE statements of the tables. The greenplum
+// statements are distributed randomly.
+func generateDdl(metadata [][]metaColumn, greenplum bool) string {
+	o := []string{}
+	for _, columns := range metadata {
+		if len(columns) == 0 {
+			continue
+		}
+		table := columns[0].table
+
+		lines := []string{}
+		for _, column := range append(append([]metaColumn{ddlPrefixColumn}, columns...), ddlPostfixColumn) {
+			lines = append(lines, fmt.Sprintf("    %s %s", pgQuoteIdentifier(column.column), column.formatType))
+		}
+
+		end := ");"
+		if greenplum {
+			end = ") DISTRIBUTED RANDOMLY;"
+		}
+		o = append(o, fmt.Sprintf("CREATE TABLE %s.%s (\n%s\n%s\n",
+			pgQuoteIdentifier(table.schema), pgQuoteIdentifier(table.name), strings.Join(lines, ",\n"), end))
+	}
+	return strings.Join(o, "\n")
+}
+
+// Finds the latest metadata upload in the archives (of the host if it is
+// not empty). Returns an empty name if there is none.
+func findLatestArchivedMetadata(archivesDir, host string) (string, error) {
+	latest, latestMeta := "", (*UploadMeta)(nil)
+	err := filepath.Walk(archivesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == archivesDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		meta, isArchived := makeArchivedServerlogMeta(path)
+		if !isArchived || !isMetadataRegexp.MatchString(meta.TableName) || (host != "" && meta.Host != host) {
+			return nil
+		}
+		if latestMeta == nil || meta.Date.After(latestMeta.Date) ||
+			(meta.Date.Equal(latestMeta.Date) && (meta.SeqIdx > latestMeta.SeqIdx || (meta.SeqIdx == latestMeta.SeqIdx && meta.PartIdx > latestMeta.PartIdx))) {
+			latest, latestMeta = path, meta
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error looking for archived metadata in '%s': %v", archivesDir, err)
+	}
+	return latest, nil
+}
+
+// Generates the DDL of the tables in the metadata file merged with the
+// tables of the server. The latest archived metadata (of the host) is used if
+// no file is given.
+func makeDdl(env *UploadHandlerEnv, metadataFile, host string, greenplum bool) (string, error) {
+	if metadataFile == "" {
+		var err error
+		if metadataFile, err = findLatestArchivedMetadata(env.ArchivesDir, host); err != nil {
+			return "", err
+		}
+	}
+
+	metadata, source := &metadataTables{}, "no agent metadata"
+	if metadataFile != "" {
+		f, err := NewCompressedFileReader(metadataFile)
+		if err != nil {
+			return "", fmt.Errorf("Error opening metadata '%s': %v", metadataFile, err)
+		}
+		defer f.Close()
+
+		if metadata, err = parseMetadata(f); err != nil {
+			return "", fmt.Errorf("Invalid metadata in '%s': %v", metadataFile, err)
+		}
+		source = filepath.Base(metadataFile)
+
+		// the tables of the agent by name, the tables of the server after them
+		sort.Slice(metadata.tables, func(i, j int) bool {
+			a, b := metadata.tables[i].table, metadata.tables[j].table
+			if a.schema != b.schema {
+				return a.schema < b.schema
+			}
+			return a.name < b.name
+		})
+	}
+
+	metadata.merge(makeMetadataTables(serverlogsMetadataColumns(env.LogFormats)))
+	if err := metadata.validate(); err != nil {
+		return "", fmt.Errorf("Invalid metadata in '%s': %v", source, err)
+	}
+	return fmt.Sprintf("-- Tables of %s and of the server\n\n%s", source, generateDdl(metadata.columns(), greenplum)), nil
+}
+
+// Diff
+// ----
+
+// The tables of a DDL generated by generateDdl() with their columns
+type ddlTable struct {
+	name    string
+	columns []string
+}
+
+// Parses the CREATE TABLE statements of a generated DDL
+func parseDdlTables(ddl string) []ddlTable {
+	o := []ddlTable{}
+	var table *ddlTable
+	for _, line := range strings.Split(ddl, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "CREATE TABLE "):
+			o = append(o, ddlTable{name: strings.TrimSuffix(strings.TrimPrefix(line, "CREATE TABLE "), " (")})
+			table = &o[len(o)-1]
+		case strings.HasPrefix(line, ")"):
+			table = nil
+		case table != nil && line != "":
+			table.columns = append(table.columns, strings.TrimSuffix(line, ","))
+		}
+	}
+	return o
+}
+
+// Returns the changes of the tables and their columns between two DDLs as
+// a diff: the added lines start with '+', the removed ones with '-'. Returns
+// an empty string if the tables are the same.
+func diffDdl(previous, current string) string {
+	previousTables := map[string][]string{}
+	for _, table := range parseDdlTables(previous) {
+		previousTables[table.name] = table.columns
+	}
+
+	o := []string{}
+	currentNames := map[string]bool{}
+	for _, table := range parseDdlTables(current) {
+		currentNames[table.name] = true
+		previousColumns, existed := previousTables[table.name]
+		if !existed {
+			o = append(o, "+CREATE TABLE "+table.name)
+			for _, column := range table.columns {
+				o = append(o, "+    "+column)
+			}
+			continue
+		}
+		if changes := diffLines(previousColumns, table.columns); changes != nil {
+			o = append(o, " CREATE TABLE "+table.name)
+			o = append(o, changes...)
+		}
+	}
+
+	for _, table := range parseDdlTables(previous) {
+		if !currentNames[table.name] {
+			o = append(o, "-CREATE TABLE "+table.name)
+			for _, column := range table.columns {
+				o = append(o, "-    "+column)
+			}
+		}
+	}
+
+	if len(o) == 0 {
+		return ""
+	}
+	return strings.Join(o, "\n") + "\n"
+}
+
+// Diffs the columns of a table by their longest common subsequence. Returns
+// nil if they are the same.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	o := []string{}
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			o = append(o, "     "+a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			o = append(o, "+    "+b[j])
+			j++
+			changed = true
+		default:
+			o = append(o, "-    "+a[i])
+			i++
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return o
+}
+
+// HTTP HANDLERS
+// =============
+
+// Handler for GET /api/v1/ddl (the DDL) and POST /api/v1/ddl/diff (the diff
+// against the DDL in the body)
+func MakeDdlHandler(env *UploadHandlerEnv, isDiff bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		ddl, err := makeDdl(env, "", params.Get("host"), params.Get("greenplum") == "true")
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+
+		if isDiff {
+			previous, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("Error reading previous DDL: %v", err), r)
+				return
+			}
+			ddl = diffDdl(string(previous), ddl)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, ddl)
+	}
+}
+
+// COMMAND LINE
+// ============
+
+// Runs the ddl subcommand: prints the DDL (or its diff against a previous
+// DDL)
+func RunDdlCommand(env *UploadHandlerEnv, args []string) error {
+	flags := flag.NewFlagSet("ddl", flag.ExitOnError)
+	metadataFile := flags.String("metadata", "", "The metadata file sent by an agent (the latest archived metadata by default).")
+	host := flags.String("host", "", "Use the latest archived metadata of this host.")
+	previousFile := flags.String("diff", "", "Print the differences from this previously generated DDL file instead of the DDL.")
+	greenplum := flags.Bool("greenplum", false, "Distribute the Greenplum tables randomly.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ddl, err := makeDdl(env, *metadataFile, *host, *greenplum)
+	if err != nil {
+		return err
+	}
+
+	if *previousFile != "" {
+		previous, err := ioutil.ReadFile(*previousFile)
+		if err != nil {
+			return fmt.Errorf("Error reading previous DDL '%s': %v", *previousFile, err)
+		}
+		ddl = diffDdl(string(previous), ddl)
+	}
+
+	fmt.Print(ddl)
+	return nil
+}
@@ -0,0 +1,96 @@
+package insight_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+const testAgentMetadata = "schema\vtablename\vcolumnname\vformat_type\vattnum\r\n" +
+	"public\vusers\vname\vtext\v2\r\n" +
+	"public\vhttp_requests\vcontroller\vcharacter varying(255)\v2\r\n" +
+	"public\vusers\vid\vinteger\v1\r\n" +
+	"public\vserverlogs\vline\vtext\v1\r\n"
+
+func TestMakeDdl(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	metadataFile := writeTestArchivedServerlog(t, env, "host1", "metadata-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testAgentMetadata)
+	ddl, err := makeDdl(env, metadataFile, "", true)
+	tassert.Nil(t, err)
+
+	// the tables of the agent by name, the columns by ordinal
+	tassert.True(t, strings.Index(ddl, `"public"."http_requests"`) < strings.Index(ddl, `"public"."users"`))
+	tassert.Contains(t, ddl, `CREATE TABLE "public"."users" (
+    "p_filepath" text,
+    "id" integer,
+    "name" text,
+    "p_cre_date" timestamp without time zone
+) DISTRIBUTED RANDOMLY;
+`)
+	// the serverlogs of the agent are replaced by the ones of the server
+	tassert.Equal(t, 1, strings.Count(ddl, `CREATE TABLE "public"."serverlogs" (`))
+	tassert.Contains(t, ddl, `CREATE TABLE "public"."serverlogs" (
+    "p_filepath" text,
+    "filename" text,`)
+
+	// broken metadata is rejected
+	metadataFile = writeTestArchivedServerlog(t, env, "host1", "metadata-2016-10-08--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz",
+		testAgentMetadata+"public\vhttp_requests\vid\tinteger\v1\r\n")
+	_, err = makeDdl(env, metadataFile, "", true)
+	tassert.NotNil(t, err)
+}
+
+func TestDiffDdl(t *testing.T) {
+	users := []metaColumn{{metaTable{"public", "users"}, "id", "integer"}, {metaTable{"public", "users"}, "name", "text"}}
+	sites := []metaColumn{{metaTable{"public", "sites"}, "id", "integer"}}
+	previous := generateDdl([][]metaColumn{users, sites}, false)
+
+	tassert.Equal(t, "", diffDdl(previous, previous))
+
+	users = append(users[:1], metaColumn{metaTable{"public", "users"}, "email", "text"}, users[1])
+	projects := []metaColumn{{metaTable{"public", "projects"}, "id", "integer"}}
+	current := generateDdl([][]metaColumn{users, projects}, false)
+
+	tassert.Equal(t, ` CREATE TABLE "public"."users"
+     "p_filepath" text
+     "id" integer
++    "email" text
+     "name" text
+     "p_cre_date" timestamp without time zone
++CREATE TABLE "public"."projects"
++    "p_filepath" text
++    "id" integer
++    "p_cre_date" timestamp without time zone
+-CREATE TABLE "public"."sites"
+-    "p_filepath" text
+-    "id" integer
+-    "p_cre_date" timestamp without time zone
+`, diffDdl(previous, current))
+}
+
+func TestDdlHandler(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	writeTestArchivedServerlog(t, env, "host1", "metadata-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", "public\vold\vid\vinteger\v1\r\n")
+	writeTestArchivedServerlog(t, env, "host1", "metadata-2016-10-08--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testAgentMetadata)
+
+	w := httptest.NewRecorder()
+	MakeDdlHandler(env, false)(w, httptest.NewRequest("GET", "/api/v1/ddl", nil))
+	tassert.Equal(t, http.StatusOK, w.Code)
+	ddl := w.Body.String()
+	tassert.Contains(t, ddl, `CREATE TABLE "public"."users" (`)
+	tassert.Contains(t, ddl, `CREATE TABLE "public"."serverlogs" (`)
+	tassert.NotContains(t, ddl, `"public"."old"`)
+
+	// no changes against itself
+	w = httptest.NewRecorder()
+	MakeDdlHandler(env, true)(w, httptest.NewRequest("POST", "/api/v1/ddl/diff", strings.NewReader(ddl)))
+	tassert.Equal(t, http.StatusOK, w.Code)
+	tassert.Equal(t, "", w.Body.String())
+}
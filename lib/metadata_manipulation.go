@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	log "github.com/palette-software/go-log-targets"
@@ -43,6 +46,9 @@ var preparsedServerlogsColumns = [][]metaColumn{
 		metaColumn{serverlogsTable, "v", "text"},
 		metaColumn{serverlogsTable, "elapsed_ms", "integer"},
 		metaColumn{serverlogsTable, "start_ts", "timestamp without time zone"},
+		metaColumn{serverlogsTable, "a", "text"},
+		metaColumn{serverlogsTable, "e", "text"},
+		metaColumn{serverlogsTable, "extras", "text"},
 	},
 	{
 		metaColumn{serverlogsTableAlt, "filename", "text"},
@@ -59,6 +65,9 @@ var preparsedServerlogsColumns = [][]metaColumn{
 		metaColumn{serverlogsTableAlt, "v", "text"},
 		metaColumn{serverlogsTableAlt, "elapsed_ms", "integer"},
 		metaColumn{serverlogsTableAlt, "start_ts", "timestamp without time zone"},
+		metaColumn{serverlogsTableAlt, "a", "text"},
+		metaColumn{serverlogsTableAlt, "e", "text"},
+		metaColumn{serverlogsTableAlt, "extras", "text"},
 	},
 	{
 		metaColumn{plainServerlogsTable, "filename", "text"},
@@ -89,78 +98,255 @@ var preparsedServerlogsColumns = [][]metaColumn{
 	},
 }
 
-func makeMetaString(cols []metaColumn) string {
-	o := make([]string, len(cols))
-	for i, col := range cols {
-		o[i] = fmt.Sprintf("%s\v%s\v%s\v%s\v%d",
-			col.table.schema,
-			col.table.name,
-			col.column,
-			col.formatType,
-			i+1)
+// The metadata of the preparsed serverlogs tables (with their side tables)
+// and of the tables of the regex log formats
+func serverlogsMetadataColumns(formats *RegexLogFormats) [][]metaColumn {
+	o := append([][]metaColumn{}, preparsedServerlogsColumns...)
+	o = append(o, jsonLogSideTablesMetadata()...)
+	o = append(o, serverlogsRequestsColumns)
+	return append(o, formats.metadataColumns()...)
+}
+
+// Metadata model
+// --------------
+//
+// The metadata uploads of the agents list the columns of the tables (schema,
+// table, column, type and ordinal separated by \v, with a header line). They
+// are parsed into tables, checked, merged with the tables defined by the
+// server and written back in the same format.
+
+// A column of the metadata
+type metadataColumn struct {
+	column, formatType string
+	ordinal            int
+}
+
+// A table of the metadata with its columns in the order of the upload
+type metadataTable struct {
+	table   metaTable
+	columns []metadataColumn
+}
+
+type metadataTables struct {
+	// the header line of the upload (empty if it had none)
+	header string
+	tables []*metadataTable
+}
+
+// Parses a metadata upload. The first line is the header if its ordinal is
+// not a number.
+func parseMetadata(r io.Reader) (*metadataTables, error) {
+	o := &metadataTables{}
+	byTable := map[metaTable]*metadataTable{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\v")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("Line %d has %d fields instead of schema, table, column, type and ordinal", lineNumber, len(fields))
+		}
+		ordinal, err := strconv.Atoi(fields[4])
+		if err != nil {
+			if lineNumber == 1 {
+				o.header = line
+				continue
+			}
+			return nil, fmt.Errorf("Invalid ordinal '%s' in line %d", fields[4], lineNumber)
+		}
+
+		table := metaTable{fields[0], fields[1]}
+		t, ok := byTable[table]
+		if !ok {
+			t = &metadataTable{table: table}
+			byTable[table] = t
+			o.tables = append(o.tables, t)
+		}
+		t.columns = append(t.columns, metadataColumn{fields[2], fields[3], ordinal})
 	}
-	return strings.Join(o, "\r\n")
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading metadata: %v", err)
+	}
+	return o, nil
 }
 
-// The regexp we use to filter out the serverlogs rows
-var serverlogsRegexp *regexp.Regexp = regexp.MustCompile("serverlogs")
-var plainlogsRegexp *regexp.Regexp = regexp.MustCompile("plainlogs")
+// Creates the metadata of tables defined by the server. The ordinals follow
+// the order of the columns.
+func makeMetadataTables(tables [][]metaColumn) *metadataTables {
+	o := &metadataTables{}
+	for _, columns := range tables {
+		if len(columns) == 0 {
+			continue
+		}
+		t := &metadataTable{table: columns[0].table}
+		for i, column := range columns {
+			t.columns = append(t.columns, metadataColumn{column.column, column.formatType, i + 1})
+		}
+		o.tables = append(o.tables, t)
+	}
+	return o
+}
 
-// The EOL characters used in the output csv file
-var eolChars []byte = []byte{'\r', '\n'}
+// Replaces the tables with the tables of the same schema and name in the
+// other metadata. The other tables are added to the end.
+func (m *metadataTables) merge(other *metadataTables) {
+	replaced := map[metaTable]bool{}
+	for _, t := range other.tables {
+		replaced[t.table] = true
+	}
 
-// Handler updating metadata
-func MetadataUploadHandler(meta *UploadMeta, tmpDir, baseDir, archivedFile string) error {
+	tables := []*metadataTable{}
+	for _, t := range m.tables {
+		if !replaced[t.table] {
+			tables = append(tables, t)
+		}
+	}
+	m.tables = append(tables, other.tables...)
+}
 
-	outFileWriter, err := meta.GetOutputGzippedWriter(baseDir, tmpDir)
-	if err != nil {
-		return fmt.Errorf("Error opening metadata output: %v", err)
+// The base types of the columns (the modifiers like the length and the
+// array brackets are not part of the base type)
+var knownMetadataTypes = []string{
+	"smallint", "integer", "bigint", "real", "double precision", "numeric", "money",
+	"boolean", "text", "character varying", "character", `"char"`, "name",
+	"bytea", "json", "jsonb", "xml", "uuid", "date", "interval",
+	"timestamp without time zone", "timestamp with time zone",
+	"time without time zone", "time with time zone",
+	"inet", "cidr", "macaddr", "bit", "bit varying", "tsvector", "tsquery",
+	"oid", "regproc", "regclass", "regtype", "xid", "cid", "tid",
+	"oidvector", "int2vector", "aclitem", "anyarray", "pg_node_tree", "abstime", "reltime",
+}
+
+var metadataTypeModifierRegexp = regexp.MustCompile(`\([^)]*\)|\[\d*\]`)
+
+func isKnownMetadataType(formatType string) bool {
+	baseType := metadataTypeModifierRegexp.ReplaceAllString(strings.ToLower(formatType), "")
+	baseType = strings.Join(strings.Fields(baseType), " ")
+	for _, knownType := range knownMetadataTypes {
+		if baseType == knownType {
+			return true
+		}
 	}
+	return false
+}
 
-	defer outFileWriter.Close()
+// Checks the tables: the names are not empty, the columns and the ordinals
+// of a table are unique and the types are known
+func (m *metadataTables) validate() error {
+	for _, t := range m.tables {
+		if t.table.schema == "" || t.table.name == "" {
+			return fmt.Errorf("Table without a schema or a name: '%s.%s'", t.table.schema, t.table.name)
+		}
 
-	inFileReader, err := NewGzippedFileReader(archivedFile)
-	defer inFileReader.Close()
+		columns := map[string]bool{}
+		ordinals := map[int]string{}
+		for _, column := range t.columns {
+			if column.column == "" {
+				return fmt.Errorf("Column without a name in table '%s.%s'", t.table.schema, t.table.name)
+			}
+			if columns[column.column] {
+				return fmt.Errorf("Duplicate column '%s' in table '%s.%s'", column.column, t.table.schema, t.table.name)
+			}
+			columns[column.column] = true
 
-	// Create a pair of buffered readers on top of the
-	// gzip stream.
-	inReader := bufio.NewReader(inFileReader)
-	outWriter := bufio.NewWriter(outFileWriter)
-
-	// Filter out
-	for {
-		line, _, err := inReader.ReadLine()
-		// if eof, we are done
-		if err == io.EOF {
-			break
+			if column.ordinal <= 0 {
+				return fmt.Errorf("Invalid ordinal %d of column '%s' in table '%s.%s'", column.ordinal, column.column, t.table.schema, t.table.name)
+			}
+			if other, isTaken := ordinals[column.ordinal]; isTaken {
+				return fmt.Errorf("Duplicate ordinal %d of columns '%s' and '%s' in table '%s.%s'", column.ordinal, other, column.column, t.table.schema, t.table.name)
+			}
+			ordinals[column.ordinal] = column.column
+
+			if !isKnownMetadataType(column.formatType) {
+				return fmt.Errorf("Unknown type '%s' of column '%s' in table '%s.%s'", column.formatType, column.column, t.table.schema, t.table.name)
+			}
 		}
-		// otherwise we arent ok
-		if err != nil {
-			return err
+	}
+	return nil
+}
+
+// Returns the columns of the tables ordered by their ordinals
+func (m *metadataTables) columns() [][]metaColumn {
+	o := make([][]metaColumn, len(m.tables))
+	for i, t := range m.tables {
+		columns := append([]metadataColumn{}, t.columns...)
+		sort.SliceStable(columns, func(a, b int) bool { return columns[a].ordinal < columns[b].ordinal })
+
+		o[i] = make([]metaColumn, len(columns))
+		for j, column := range columns {
+			o[i][j] = metaColumn{t.table, column.column, column.formatType}
 		}
+	}
+	return o
+}
 
-		// skip any lines from the serverlogs or plainlogs table
-		if !serverlogsRegexp.Match(line) && !plainlogsRegexp.Match(line) {
-			outWriter.Write(line)
-			outWriter.Write(eolChars)
+// Writes the metadata in the format of the uploads
+func (m *metadataTables) write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	if m.header != "" {
+		out.WriteString(m.header)
+		out.Write(eolChars)
+	}
+	for _, t := range m.tables {
+		for _, column := range t.columns {
+			fmt.Fprintf(out, "%s\v%s\v%s\v%s\v%d", t.table.schema, t.table.name, column.column, column.formatType, column.ordinal)
+			out.Write(eolChars)
 		}
 	}
+	return out.Flush()
+}
 
-	log.Infof("Adding metadata. file=%s", meta.OriginalFilename)
+// Parses and checks the metadata of an upload and merges the tables of the
+// server into it
+func readMergedMetadata(r io.Reader, formats *RegexLogFormats) (*metadataTables, error) {
+	metadata, err := parseMetadata(r)
+	if err != nil {
+		return nil, err
+	}
+	metadata.merge(makeMetadataTables(serverlogsMetadataColumns(formats)))
+	if err := metadata.validate(); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
 
-	metadata := make([]string, len(preparsedServerlogsColumns))
-	for i, table := range preparsedServerlogsColumns {
-		metadata[i] = makeMetaString(table)
+// The EOL characters used in the output csv file
+var eolChars []byte = []byte{'\r', '\n'}
+
+// Handler updating metadata. Metadata that does not check out is rejected
+// without an output.
+func MetadataUploadHandler(meta *UploadMeta, tmpDir, baseDir, archivedFile string, formats *RegexLogFormats) error {
+	inFileReader, err := NewCompressedFileReader(archivedFile)
+	if err != nil {
+		return fmt.Errorf("Error opening archived metadata '%s': %v", archivedFile, err)
 	}
+	defer inFileReader.Close()
 
-	metadataString := strings.Join(metadata, "\r\n")
+	// the agent would send the same file again on a server error, so bad
+	// metadata is rejected with 422
+	metadata, err := readMergedMetadata(inFileReader, formats)
+	if err != nil {
+		return &UploadError{
+			Status: http.StatusUnprocessableEntity,
+			Err:    fmt.Errorf("Invalid metadata in '%s': %v", meta.OriginalFilename, err),
+		}
+	}
 
-	// Append the prepared serverlogs data
-	_, err = outWriter.WriteString(metadataString)
+	outFileWriter, err := meta.GetOutputWriter(baseDir, tmpDir)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error opening metadata output: %v", err)
 	}
 
-	// Flush the outputs buffer
-	return outWriter.Flush()
+	log.Infof("Adding metadata. file=%s tables=%d", meta.OriginalFilename, len(metadata.tables))
+
+	if err := metadata.write(outFileWriter); err != nil {
+		outFileWriter.Drop()
+		return fmt.Errorf("Error writing metadata output: %v", err)
+	}
+	return outFileWriter.Close()
 }
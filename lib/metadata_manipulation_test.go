@@ -0,0 +1,94 @@
+package insight_server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"net/http"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestParseMetadata(t *testing.T) {
+	metadata, err := parseMetadata(strings.NewReader("schema\vtablename\vcolumnname\vformat_type\vattnum\r\n" +
+		"public\vusers\vid\vinteger\v1\r\n" +
+		"public\vusers\vserverlogs_seen\vboolean\v3\r\n" +
+		"\r\n" +
+		"public\vplainlogs_export\vline\vtext\v1\r\n"))
+	tassert.Nil(t, err)
+	tassert.Nil(t, metadata.validate())
+
+	// the columns named like the serverlogs are kept, the gaps of the ordinals too
+	tassert.Equal(t, "schema\vtablename\vcolumnname\vformat_type\vattnum", metadata.header)
+	tassert.Len(t, metadata.tables, 2)
+	tassert.Equal(t, []metadataColumn{{"id", "integer", 1}, {"serverlogs_seen", "boolean", 3}}, metadata.tables[0].columns)
+	tassert.Equal(t, metaTable{"public", "plainlogs_export"}, metadata.tables[1].table)
+
+	var out bytes.Buffer
+	tassert.Nil(t, metadata.write(&out))
+	tassert.Equal(t, "schema\vtablename\vcolumnname\vformat_type\vattnum\r\n"+
+		"public\vusers\vid\vinteger\v1\r\n"+
+		"public\vusers\vserverlogs_seen\vboolean\v3\r\n"+
+		"public\vplainlogs_export\vline\vtext\v1\r\n", out.String())
+
+	_, err = parseMetadata(strings.NewReader("public\vusers\vid\tinteger\v1\r\n"))
+	tassert.NotNil(t, err)
+	_, err = parseMetadata(strings.NewReader("public\vusers\vid\vinteger\v1\r\npublic\vusers\vname\vtext\vsecond\r\n"))
+	tassert.NotNil(t, err)
+}
+
+func TestMetadataTables_Validate(t *testing.T) {
+	for metadata, isValid := range map[string]bool{
+		"public\vusers\vid\vinteger\v1\npublic\vusers\vname\vcharacter varying(255)\v2\n": true,
+		"public\vusers\vtags\vtext[]\v1\npublic\vusers\vprice\vnumeric(10, 2)\v2\n":       true,
+		"public\vusers\vid\vinteger\v1\npublic\vusers\vname\vtext\v1\n":                   false,
+		"public\vusers\vid\vinteger\v1\npublic\vusers\vid\vtext\v2\n":                     false,
+		"public\vusers\vid\vinteger\v0\n":                                                 false,
+		"public\vusers\vid\vnot_a_type\v1\n":                                              false,
+		"public\v\vid\vinteger\v1\n":                                                      false,
+	} {
+		m, err := parseMetadata(strings.NewReader(metadata))
+		tassert.Nil(t, err)
+		tassert.Equal(t, isValid, m.validate() == nil, metadata)
+	}
+}
+
+func TestReadMergedMetadata(t *testing.T) {
+	metadata, err := readMergedMetadata(strings.NewReader("schema\vtablename\vcolumnname\vformat_type\vattnum\r\n"+
+		"public\vserverlogs\vline\vtext\v1\r\n"+
+		"public\vusers\vid\vinteger\v1\r\n"), nil)
+	tassert.Nil(t, err)
+
+	// the serverlogs of the agent are replaced by the ones of the server
+	tassert.Equal(t, metaTable{"public", "users"}, metadata.tables[0].table)
+	tables := metadata.columns()
+	tassert.Len(t, tables, 1+len(serverlogsMetadataColumns(nil)))
+	tassert.Equal(t, serverlogsMetadataColumns(nil)[0], tables[1])
+	for _, table := range tables[1:] {
+		tassert.NotEqual(t, metaTable{"public", "users"}, table[0].table)
+	}
+}
+
+func TestMetadataUploadHandler_Invalid(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	handler := NewMetadataUploadHandler(env)
+
+	upload := func(contents string) error {
+		fileMd5 := md5.Sum([]byte(contents))
+		meta := makeTestUploadMeta(string(fileMd5[:]))
+		meta.TableName = "metadata"
+		return handler.HandleUpload(meta, strings.NewReader(contents))
+	}
+
+	tassert.Nil(t, upload("schema\vtablename\vcolumnname\vformat_type\vattnum\npublic\vusers\vid\vinteger\v1\n"))
+
+	// the agent should not retry these
+	err := upload("schema\vtablename\vcolumnname\vformat_type\vattnum\npublic\vusers\vid\vinteger\v1\npublic\vusers\vname\vtext\v1\n")
+	tassert.NotNil(t, err)
+	tassert.Equal(t, http.StatusUnprocessableEntity, getUploadErrorStatus(err))
+
+	err = upload("schema\vtablename\vcolumnname\vformat_type\vattnum\npublic\vusers\vid\vnot_a_type\v1\n")
+	tassert.Equal(t, http.StatusUnprocessableEntity, getUploadErrorStatus(err))
+}
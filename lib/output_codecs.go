@@ -0,0 +1,154 @@
+package insight_server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Output codecs
+// =============
+//
+// The files written for the loader are gzipped by default, but the codec
+// (and the container format, see parquet_output.go) can be configured per
+// table.
+
+type OutputCodec struct {
+	// gzip, zstd or none
+	Codec string `json:"codec"`
+	// The compression level (0 means the default level of the codec)
+	Level int `json:"level,omitempty"`
+	// The container format: csv (the default) or parquet. Parquet pages are
+	// compressed with the codec.
+	Format string `json:"format,omitempty"`
+}
+
+// Returns true if the outputs are written as parquet files
+func (c *OutputCodec) IsParquet() bool {
+	return c.Format == OutputFormatParquet
+}
+
+// The codec used for the tables without configuration
+var DefaultOutputCodec = &OutputCodec{Codec: CompressionGzip}
+
+// The extension added to the output file names
+func (c *OutputCodec) Extension() string {
+	switch c.Codec {
+	case CompressionZstd:
+		return ".zst"
+	case CompressionNone:
+		return ""
+	default:
+		return ".gz"
+	}
+}
+
+// Creates the writer compressing into w
+func (c *OutputCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		options := []zstd.EOption{}
+		if c.Level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+		}
+		return zstd.NewWriter(w, options...)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("Unknown output codec '%s'", c.Codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Table outputs
+// -------------
+
+// Selects the codec for the tables matching a pattern
+type TableOutput struct {
+	// Regexp matching the table name of the upload
+	Table string `json:"table"`
+	OutputCodec
+}
+
+// The codecs of the tables, the first matching pattern wins
+type TableOutputs struct {
+	patterns []*regexp.Regexp
+	codecs   []*OutputCodec
+}
+
+// Loads the table outputs from a JSON file
+func LoadTableOutputs(fileName string) (*TableOutputs, error) {
+	outputsFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening table outputs file '%s': %v", fileName, err)
+	}
+	defer outputsFile.Close()
+
+	outputs := []TableOutput{}
+	if err := json.NewDecoder(outputsFile).Decode(&outputs); err != nil {
+		return nil, fmt.Errorf("Error parsing table outputs file '%s': %v", fileName, err)
+	}
+	return MakeTableOutputs(outputs)
+}
+
+// Compiles the patterns and checks the codecs of the table outputs
+func MakeTableOutputs(outputs []TableOutput) (*TableOutputs, error) {
+	o := &TableOutputs{}
+	for _, output := range outputs {
+		pattern, err := regexp.Compile(output.Table)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid table pattern in table output '%s': %v", output.Table, err)
+		}
+
+		codec := &OutputCodec{Codec: output.Codec, Level: output.Level, Format: output.Format}
+		// try the codec, so bad levels are found on startup
+		w, err := codec.newWriter(ioutil.Discard)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid codec for table output '%s': %v", output.Table, err)
+		}
+		w.Close()
+
+		switch codec.Format {
+		case "", OutputFormatCsv:
+		case OutputFormatParquet:
+			if _, err := getParquetCodec(codec); err != nil {
+				return nil, fmt.Errorf("Invalid codec for table output '%s': %v", output.Table, err)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown output format '%s' for table output '%s'", codec.Format, output.Table)
+		}
+
+		o.patterns = append(o.patterns, pattern)
+		o.codecs = append(o.codecs, codec)
+	}
+	return o, nil
+}
+
+// Returns the codec for a table
+func (t *TableOutputs) Get(table string) *OutputCodec {
+	if t == nil {
+		return DefaultOutputCodec
+	}
+	for i, pattern := range t.patterns {
+		if pattern.MatchString(table) {
+			return t.codecs[i]
+		}
+	}
+	return DefaultOutputCodec
+}
@@ -0,0 +1,60 @@
+package insight_server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestFileWriterWithTemp_Codecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output-codecs")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, codec := range []*OutputCodec{
+		{Codec: CompressionGzip},
+		{Codec: CompressionGzip, Level: 9},
+		{Codec: CompressionZstd, Level: 3},
+		{Codec: CompressionNone},
+	} {
+		w, err := NewFileWriterWithTemp(filepath.Join(dir, "threadinfo-{{md5}}.csv"), dir, codec)
+		tassert.Nil(t, err)
+
+		outFileName := w.GetRandomFileName()
+		tassert.True(t, strings.HasSuffix(outFileName, ".csv"+codec.Extension()))
+
+		w.Write([]byte("a\vb\n"))
+		tassert.Nil(t, w.CloseWithFileName(outFileName))
+
+		// the reader finds out the codec itself
+		r, err := NewCompressedFileReader(outFileName)
+		tassert.Nil(t, err)
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		tassert.Nil(t, err)
+		tassert.Equal(t, "a\vb\n", string(contents))
+	}
+}
+
+func TestTableOutputs(t *testing.T) {
+	outputs, err := MakeTableOutputs([]TableOutput{
+		{Table: "^serverlogs$", OutputCodec: OutputCodec{Codec: CompressionZstd}},
+		{Table: "", OutputCodec: OutputCodec{Codec: CompressionNone}},
+	})
+	tassert.Nil(t, err)
+	tassert.Equal(t, CompressionZstd, outputs.Get("serverlogs").Codec)
+	tassert.Equal(t, CompressionNone, outputs.Get("threadinfo").Codec)
+
+	// no configuration means gzip
+	var noOutputs *TableOutputs
+	tassert.Equal(t, DefaultOutputCodec, noOutputs.Get("threadinfo"))
+
+	_, err = MakeTableOutputs([]TableOutput{{Table: "", OutputCodec: OutputCodec{Codec: CompressionGzip, Level: 42}}})
+	tassert.NotNil(t, err)
+	_, err = MakeTableOutputs([]TableOutput{{Table: "", OutputCodec: OutputCodec{Codec: CompressionLz4}}})
+	tassert.NotNil(t, err)
+}
@@ -0,0 +1,356 @@
+package insight_server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Parquet output
+// ==============
+//
+// Tables with the parquet output format are written as parquet files to
+// a date- and host-partitioned directory layout instead of the CSV files
+// for the loader:
+//
+//     <parquet_path>/<table>/date=2016-10-07/host=<host>/<table>-...-<random>.parquet
+//
+// The files are written with parquet-go, we only map our columns and
+// values to its schema.
+
+// The container formats of the outputs
+const (
+	OutputFormatCsv     = "csv"
+	OutputFormatParquet = "parquet"
+)
+
+// Returns the path of a parquet output file of an upload
+func (u *UploadMeta) GetParquetOutputFilename(parquetDir, table string) string {
+	dateUtc := u.Date.UTC()
+	return filepath.Join(
+		parquetDir,
+		SanitizeName(table),
+		fmt.Sprintf("date=%s", dateUtc.Format("2006-01-02")),
+		fmt.Sprintf("host=%s", SanitizeName(u.Host)),
+		fmt.Sprintf("%s-%s--seq%03d--part%04d-%s.parquet",
+			SanitizeName(table),
+			dateUtc.Format("2006-01-02--15-04-05"),
+			u.SeqIdx,
+			u.PartIdx,
+			makeRandomId(),
+		),
+	)
+}
+
+// Schemas
+// -------
+
+// The types of the parquet columns we can write
+type ParquetColumnType int
+
+const (
+	ParquetText = ParquetColumnType(iota)
+	ParquetInt64
+	ParquetTimestamp
+)
+
+// A column of a parquet file. All columns are optional, empty values are
+// written as NULLs.
+type ParquetColumn struct {
+	Name string
+	Type ParquetColumnType
+}
+
+// Returns the parquet-go schema of the columns. The internal names are
+// generated, so any column name can be used.
+func parquetSchemaMetadata(columns []ParquetColumn) []string {
+	o := make([]string, len(columns))
+	for i, column := range columns {
+		var columnType string
+		switch column.Type {
+		case ParquetInt64:
+			columnType = "type=INT64"
+		case ParquetTimestamp:
+			columnType = "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+		default:
+			columnType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		}
+		o[i] = fmt.Sprintf("inname=Column%d, name=%s, %s, repetitiontype=OPTIONAL", i, column.Name, columnType)
+	}
+	return o
+}
+
+// Returns the parquet codec of an output codec
+func getParquetCodec(codec *OutputCodec) (parquet.CompressionCodec, error) {
+	switch codec.Codec {
+	case CompressionNone:
+		return parquet.CompressionCodec_UNCOMPRESSED, nil
+	case CompressionGzip:
+		return parquet.CompressionCodec_GZIP, nil
+	case CompressionZstd:
+		return parquet.CompressionCodec_ZSTD, nil
+	}
+	return 0, fmt.Errorf("Codec '%s' is not supported for parquet output", codec.Codec)
+}
+
+// Converts a value to the type of its column. Returns nil for NULLs.
+func parquetValue(column ParquetColumn, value string) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	switch column.Type {
+	case ParquetInt64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for integer column '%s': %v", column.Name, err)
+		}
+		return v, nil
+	case ParquetTimestamp:
+		ts, err := parseTimestampValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for timestamp column '%s': %v", column.Name, err)
+		}
+		return ts.UnixNano() / int64(time.Millisecond), nil
+	}
+	return value, nil
+}
+
+// Returns the parquet columns for a table schema
+func parquetColumnsFromSchema(schema *TableSchema) []ParquetColumn {
+	o := make([]ParquetColumn, len(schema.Columns))
+	for i, column := range schema.Columns {
+		o[i] = ParquetColumn{Name: column.Name}
+		switch column.Type {
+		case TableColumnInt:
+			o[i].Type = ParquetInt64
+		case TableColumnTimestamp:
+			o[i].Type = ParquetTimestamp
+		default:
+			o[i].Type = ParquetText
+		}
+	}
+	return o
+}
+
+// Returns text parquet columns for a header (for the tables without type information)
+func parquetColumnsFromHeader(header []string) []ParquetColumn {
+	o := make([]ParquetColumn, len(header))
+	for i, name := range header {
+		o[i] = ParquetColumn{Name: name, Type: ParquetText}
+	}
+	return o
+}
+
+// Returns the parquet columns of a preparsed serverlogs table from the
+// metadata we send to the loader. Returns nil if the table is unknown.
+func parquetColumnsFromMetadata(table string, metadata [][]metaColumn) []ParquetColumn {
+	for _, columns := range metadata {
+		if len(columns) == 0 || columns[0].table.name != table {
+			continue
+		}
+
+		o := make([]ParquetColumn, len(columns))
+		for i, column := range columns {
+			o[i] = ParquetColumn{Name: column.column, Type: ParquetText}
+			switch {
+			case column.formatType == "integer":
+				o[i].Type = ParquetInt64
+			case strings.HasPrefix(column.formatType, "timestamp"):
+				o[i].Type = ParquetTimestamp
+			}
+		}
+		return o
+	}
+	return nil
+}
+
+// Writer
+// ------
+
+// Writes a parquet file to a temp file that is moved to its final place on
+// Close(). Like the csvFileWriter, the file is only created when the first
+// row is written.
+type parquetFileWriter struct {
+	fileName string
+	tmpDir   string
+
+	columns []ParquetColumn
+	codec   *OutputCodec
+
+	tmpFile        *os.File
+	bufferedWriter *bufio.Writer
+	writer         *writer.CSVWriter
+
+	rowCount int
+	isClosed bool
+}
+
+func NewParquetFileWriter(fileName, tmpDir string, columns []ParquetColumn, codec *OutputCodec) *parquetFileWriter {
+	return &parquetFileWriter{
+		fileName: fileName,
+		tmpDir:   tmpDir,
+		columns:  columns,
+		codec:    codec,
+	}
+}
+
+func (w *parquetFileWriter) createFile() error {
+	tmpFile, err := ioutil.TempFile(w.tmpDir, fmt.Sprintf("parquet-%s", filepath.Base(w.fileName)))
+	if err != nil {
+		return fmt.Errorf("Cannot open temp file: %v", err)
+	}
+
+	bufferedWriter := bufio.NewWriter(tmpFile)
+	parquetWriter, err := writer.NewCSVWriterFromWriter(parquetSchemaMetadata(w.columns), bufferedWriter, 1)
+	if err == nil {
+		parquetWriter.CompressionType, err = getParquetCodec(w.codec)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Error creating parquet writer: %v", err)
+	}
+
+	w.tmpFile = tmpFile
+	w.bufferedWriter = bufferedWriter
+	w.writer = parquetWriter
+	return nil
+}
+
+// Writes a row to the parquet file. The row has to have a value for each
+// column.
+func (w *parquetFileWriter) WriteRow(row []string) error {
+	if len(row) != len(w.columns) {
+		return fmt.Errorf("Expected %d columns for parquet output got %d", len(w.columns), len(row))
+	}
+
+	// convert all values first, so a bad value does not leave a partial row behind
+	values := make([]interface{}, len(row))
+	for i, column := range w.columns {
+		value, err := parquetValue(column, row[i])
+		if err != nil {
+			return err
+		}
+		values[i] = value
+	}
+
+	if w.writer == nil {
+		if err := w.createFile(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writer.Write(values); err != nil {
+		return err
+	}
+	w.rowCount++
+	return nil
+}
+
+// Returns the name of the output file (the parquet outputs are not rotated)
+func (w *parquetFileWriter) OutputFileNames() []string {
+	if w.writer == nil {
+		return []string{}
+	}
+	return []string{w.fileName}
+}
+
+// Deletes the temporary file
+func (w *parquetFileWriter) Drop() {
+	w.isClosed = true
+	if w.tmpFile != nil {
+		w.tmpFile.Close()
+		os.Remove(w.tmpFile.Name())
+	}
+}
+
+// Finishes the file and moves it to its final place
+func (w *parquetFileWriter) Close() error {
+	if w.isClosed {
+		return nil
+	}
+	defer func() { w.isClosed = true }()
+
+	if w.writer == nil {
+		return nil
+	}
+	defer w.tmpFile.Close()
+
+	if err := w.writer.WriteStop(); err != nil {
+		return fmt.Errorf("Error writing parquet output: %v", err)
+	}
+	if err := w.bufferedWriter.Flush(); err != nil {
+		return fmt.Errorf("Error flushing parquet output: %v", err)
+	}
+	if err := w.tmpFile.Close(); err != nil {
+		return fmt.Errorf("Error closing temporary file '%s': %v", w.tmpFile.Name(), err)
+	}
+
+	if err := CreateDirectoryIfNotExists(filepath.Dir(w.fileName)); err != nil {
+		return err
+	}
+
+	log.Debugf("Moving output source=%s destination=%s", w.tmpFile.Name(), w.fileName)
+	return os.Rename(w.tmpFile.Name(), w.fileName)
+}
+
+// Converts an archived CSV upload to a parquet file. The types of the
+// columns come from the schema of the table (if there is one).
+func writeParquetFromArchive(env *UploadHandlerEnv, meta *UploadMeta, schema *TableSchema, archivedFile string) error {
+	inputFile, err := NewCompressedFileReader(archivedFile)
+	if err != nil {
+		return fmt.Errorf("Error opening archived file '%s': %v", archivedFile, err)
+	}
+	defer inputFile.Close()
+
+	csvReader := MakeCsvReader(inputFile)
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		// nothing to convert
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading header of '%s': %v", archivedFile, err)
+	}
+
+	columns := parquetColumnsFromHeader(header)
+	if schema != nil {
+		columns = parquetColumnsFromSchema(schema)
+	}
+
+	outputFileName := meta.GetParquetOutputFilename(env.ParquetDir, meta.TableName)
+	writer := NewParquetFileWriter(outputFileName, env.TmpDir, columns, meta.GetOutputCodec())
+
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = writer.WriteRow(row)
+		}
+		if err != nil {
+			writer.Drop()
+			return fmt.Errorf("Error converting '%s' to parquet: %v", archivedFile, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Wrote parquet output: host=%s filename=%s table=%s rows=%d destination=%s",
+		meta.Host, meta.OriginalFilename, meta.TableName, writer.rowCount, outputFileName)
+	return nil
+}
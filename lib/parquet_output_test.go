@@ -0,0 +1,154 @@
+package insight_server
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var testParquetColumns = []ParquetColumn{
+	{Name: "name", Type: ParquetText},
+	{Name: "pid", Type: ParquetInt64},
+	{Name: "ts", Type: ParquetTimestamp},
+}
+
+// Writes the rows to a parquet file and returns its contents
+func writeTestParquetFile(t *testing.T, codec string, rows [][]string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "parquet")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "out", "test.parquet")
+	w := NewParquetFileWriter(fileName, dir, testParquetColumns, &OutputCodec{Codec: codec})
+	for _, row := range rows {
+		if err := w.WriteRow(row); err != nil {
+			w.Drop()
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fileName)
+}
+
+func TestParquetFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parquet")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "out", "test.parquet")
+	w := NewParquetFileWriter(fileName, dir, testParquetColumns, &OutputCodec{Codec: CompressionGzip})
+
+	tassert.Nil(t, w.WriteRow([]string{"foo", "42", "2016-10-07T15:48:25.123"}))
+	tassert.Nil(t, w.WriteRow([]string{"", "", ""}))
+	// bad values do not leave a partial row behind
+	tassert.NotNil(t, w.WriteRow([]string{"bar", "not-a-number", ""}))
+	tassert.NotNil(t, w.WriteRow([]string{"bar"}))
+	tassert.Nil(t, w.WriteRow([]string{"bar", "1", "2016-10-07 15:48:25"}))
+	tassert.Nil(t, w.Close())
+	tassert.Equal(t, 3, w.rowCount)
+
+	data, err := ioutil.ReadFile(fileName)
+	tassert.Nil(t, err)
+	tassert.Equal(t, [][]interface{}{
+		{"foo", nil, "bar"},
+		{int64(42), nil, int64(1)},
+		{int64(1475855305123), nil, int64(1475855305000)},
+	}, readTestParquetColumns(t, data, len(testParquetColumns)))
+
+	// nothing is left in the temp dir
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, "parquet-*"))
+	tassert.Len(t, tmpFiles, 0)
+}
+
+// Reads back the columns of a parquet file with an independent reader
+func readTestParquetColumns(t *testing.T, data []byte, columnCount int) [][]interface{} {
+	file, err := buffer.NewBufferFile(data)
+	if !tassert.Nil(t, err) {
+		return nil
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if !tassert.Nil(t, err) {
+		return nil
+	}
+	defer pr.ReadStop()
+
+	columns := make([][]interface{}, columnCount)
+	for i := range columns {
+		values, _, _, err := pr.ReadColumnByIndex(int64(i), pr.GetNumRows())
+		tassert.Nil(t, err)
+		columns[i] = values
+	}
+	return columns
+}
+
+func TestParquetFileWriter_Codecs(t *testing.T) {
+	for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		rows := [][]string{}
+		expected := make([][]interface{}, len(testParquetColumns))
+		for i := 0; i < 10; i++ {
+			if i%4 == 0 {
+				rows = append(rows, []string{"", "", ""})
+				for c := range expected {
+					expected[c] = append(expected[c], nil)
+				}
+				continue
+			}
+			rows = append(rows, []string{fmt.Sprintf("row%d", i), fmt.Sprint(i), "2016-10-07 15:48:25"})
+			expected[0] = append(expected[0], fmt.Sprintf("row%d", i))
+			expected[1] = append(expected[1], int64(i))
+			expected[2] = append(expected[2], int64(1475855305000))
+		}
+
+		data, err := writeTestParquetFile(t, codec, rows)
+		tassert.Nil(t, err, codec)
+		tassert.Equal(t, expected, readTestParquetColumns(t, data, len(testParquetColumns)), codec)
+	}
+}
+
+func TestParquetFileWriter_UnsupportedCodec(t *testing.T) {
+	_, err := writeTestParquetFile(t, CompressionLz4, [][]string{{"foo", "1", ""}})
+	tassert.NotNil(t, err)
+}
+
+func TestFallbackUploadHandler_Parquet(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	env.ParquetDir = filepath.Join(env.TmpDir, "parquet")
+
+	contents := "name\vpid\vts\nfoo\v42\v2016-10-07 15:48:25\n"
+	fileMd5 := md5.Sum([]byte(contents))
+	meta := makeTestUploadMeta(string(fileMd5[:]))
+	meta.Timezone = time.UTC
+	meta.OutputCodec = &OutputCodec{Codec: CompressionZstd, Format: OutputFormatParquet}
+
+	handler := &FallbackUploadHandler{env: env}
+	tassert.Nil(t, handler.HandleUpload(meta, strings.NewReader(contents)))
+
+	files, err := filepath.Glob(filepath.Join(env.ParquetDir, "threadinfo", "date=2016-10-07", "host=local", "*.parquet"))
+	tassert.Nil(t, err)
+	if tassert.Len(t, files, 1) {
+		data, err := ioutil.ReadFile(files[0])
+		tassert.Nil(t, err)
+		tassert.Equal(t, [][]interface{}{
+			{"foo"},
+			{"42"},
+			{"2016-10-07 15:48:25"},
+		}, readTestParquetColumns(t, data, 3))
+	}
+
+	// nothing goes to the loader
+	loaderFiles, err := filepath.Glob(filepath.Join(env.BaseDir, "*", "*", "*", "*", "*"))
+	tassert.Nil(t, err)
+	tassert.Len(t, loaderFiles, 0)
+}
@@ -0,0 +1,354 @@
+package insight_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Direct COPY
+// ===========
+//
+// The outputs going to the loader can be loaded into PostgreSQL (or
+// Greenplum) directly with COPY ... FROM STDIN, so the installations without
+// gpfdist can skip the loader. The closed outputs wait in the pending
+// directory and are copied in the background (so a slow or unreachable
+// database does not hold up the uploads and the parsers), in the same \v
+// delimited text format the loader reads. If the copy fails the output is
+// moved to its place for the loader like without the copier.
+
+type PgCopyConfig struct {
+	// The connection string of the database (a URL or key=value pairs)
+	ConnString string
+	// The schema of the tables
+	Schema string
+	// The number of retries after a connection error and the delay between
+	// them
+	Retries    int
+	RetryDelay time.Duration
+	// The directory the outputs wait in for their copy (the outputs left
+	// there by the previous run are copied on startup)
+	PendingDir string
+}
+
+const (
+	// The time the copies are skipped after the database was unavailable
+	pgCopyUnavailableBackoff = time.Minute
+	// The number of outputs waiting for their copy, the outputs over it go
+	// to the loader
+	pgCopyQueueSize = 1000
+)
+
+// The connection the copies are sent through
+type pgCopyConn interface {
+	CopyFrom(ctx context.Context, r io.Reader, sql string) (int64, error)
+	Close(ctx context.Context) error
+}
+
+type PgCopier struct {
+	config PgCopyConfig
+	// opens the connections, one for each copy
+	connect func(ctx context.Context, connString string) (pgCopyConn, error)
+
+	// the outputs waiting for their copy
+	queue   chan *pgCopyJob
+	pending sync.WaitGroup
+
+	// the copies are skipped until this time after all retries failed
+	unavailableUntil time.Time
+	lock             sync.Mutex
+}
+
+func NewPgCopier(config PgCopyConfig) (*PgCopier, error) {
+	if _, err := pgconn.ParseConfig(config.ConnString); err != nil {
+		return nil, fmt.Errorf("Error parsing COPY connection string: %v", err)
+	}
+	if config.Schema == "" {
+		config.Schema = "public"
+	}
+	return startPgCopier(config, connectPgCopy)
+}
+
+// Starts copying the queued outputs (and the ones left pending by the
+// previous run)
+func startPgCopier(config PgCopyConfig, connect func(ctx context.Context, connString string) (pgCopyConn, error)) (*PgCopier, error) {
+	if err := CreateDirectoryIfNotExists(config.PendingDir); err != nil {
+		return nil, fmt.Errorf("Error creating COPY pending directory '%s': %v", config.PendingDir, err)
+	}
+
+	c := &PgCopier{
+		config:  config,
+		connect: connect,
+		queue:   make(chan *pgCopyJob, pgCopyQueueSize),
+	}
+
+	jobs, err := c.loadPendingJobs()
+	if err != nil {
+		return nil, err
+	}
+	c.pending.Add(len(jobs))
+	go func() {
+		for _, job := range jobs {
+			c.queue <- job
+		}
+	}()
+
+	go c.run()
+	return c, nil
+}
+
+func connectPgCopy(ctx context.Context, connString string) (pgCopyConn, error) {
+	conn, err := pgconn.Connect(ctx, connString)
+	if err != nil {
+		return nil, err
+	}
+	return &pgconnCopyConn{conn}, nil
+}
+
+type pgconnCopyConn struct {
+	conn *pgconn.PgConn
+}
+
+func (c *pgconnCopyConn) CopyFrom(ctx context.Context, r io.Reader, sql string) (int64, error) {
+	tag, err := c.conn.CopyFrom(ctx, r, sql)
+	return tag.RowsAffected(), err
+}
+
+func (c *pgconnCopyConn) Close(ctx context.Context) error {
+	return c.conn.Close(ctx)
+}
+
+func (c *PgCopier) isAvailable() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Now().After(c.unavailableUntil)
+}
+
+func (c *PgCopier) setUnavailable() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unavailableUntil = time.Now().Add(pgCopyUnavailableBackoff)
+}
+
+// An output waiting for its copy
+type pgCopyJob struct {
+	Table string `json:"table"`
+	// The output in the pending directory
+	FileName string `json:"file"`
+	// The output of the loader the file is moved to if the copy fails
+	OutFileName string `json:"output"`
+}
+
+// The file next to the output keeping the job over restarts
+func (j *pgCopyJob) jobFileName() string {
+	return j.FileName + ".json"
+}
+
+// Loads the jobs left in the pending directory by the previous run
+func (c *PgCopier) loadPendingJobs() ([]*pgCopyJob, error) {
+	jobFiles, err := filepath.Glob(filepath.Join(c.config.PendingDir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing pending COPY jobs: %v", err)
+	}
+
+	jobs := []*pgCopyJob{}
+	for _, jobFile := range jobFiles {
+		contents, err := ioutil.ReadFile(jobFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading pending COPY job '%s': %v", jobFile, err)
+		}
+		job := &pgCopyJob{}
+		if err := json.Unmarshal(contents, job); err != nil {
+			log.Errorf("Skipping invalid pending COPY job. file=%s err=%s", jobFile, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) > 0 {
+		log.Infof("Found pending COPY jobs. count=%d", len(jobs))
+	}
+	return jobs, nil
+}
+
+// Queues a closed output for copying into the table. The output is moved
+// to the pending directory, so its temporary file is not used anymore.
+// Returns false (and leaves the output where it is) if the database is
+// unavailable or too many outputs are waiting already.
+func (c *PgCopier) Enqueue(table, fileName, outFileName string) bool {
+	if !c.isAvailable() {
+		return false
+	}
+
+	job := &pgCopyJob{
+		Table:       table,
+		FileName:    filepath.Join(c.config.PendingDir, filepath.Base(fileName)),
+		OutFileName: outFileName,
+	}
+	jobJson, err := json.Marshal(job)
+	if err != nil {
+		log.Errorf("Error serializing COPY job. file=%s err=%s", fileName, err)
+		return false
+	}
+	if err := ioutil.WriteFile(job.jobFileName(), jobJson, 0644); err != nil {
+		log.Errorf("Error saving COPY job. file=%s err=%s", fileName, err)
+		return false
+	}
+	if err := os.Rename(fileName, job.FileName); err != nil {
+		log.Errorf("Error moving output to the COPY pending directory. file=%s err=%s", fileName, err)
+		os.Remove(job.jobFileName())
+		return false
+	}
+
+	c.pending.Add(1)
+	select {
+	case c.queue <- job:
+		return true
+	default:
+		c.pending.Done()
+		log.Warningf("Too many outputs waiting for COPY, leaving output for the loader. table=%s file=%s", table, outFileName)
+		os.Rename(job.FileName, fileName)
+		os.Remove(job.jobFileName())
+		return false
+	}
+}
+
+// Waits until the queued outputs are copied (or left for the loader)
+func (c *PgCopier) Wait() {
+	c.pending.Wait()
+}
+
+// Copies the queued outputs one by one
+func (c *PgCopier) run() {
+	for job := range c.queue {
+		c.finish(job, c.CopyFile(job.Table, job.FileName))
+		c.pending.Done()
+	}
+}
+
+// Removes the copied output, or moves it to its place for the loader if the
+// copy failed
+func (c *PgCopier) finish(job *pgCopyJob, copyErr error) {
+	if copyErr == nil {
+		os.Remove(job.FileName)
+	} else {
+		log.Errorf("Error copying output to database, leaving it for the loader. table=%s file=%s err=%s", job.Table, job.OutFileName, copyErr)
+		if err := moveOutputFile(job.FileName, job.OutFileName); err != nil {
+			log.Errorf("Error moving output for the loader. file=%s err=%s", job.OutFileName, err)
+			return
+		}
+	}
+	os.Remove(job.jobFileName())
+}
+
+// The errors of connecting to the database (or losing the connection), the
+// only errors retried
+type pgCopyConnError struct {
+	err error
+}
+
+func (e *pgCopyConnError) Error() string {
+	return e.err.Error()
+}
+
+// Copies an output file (with the column names in its first line) into the
+// table. The connection errors are retried, the others (like a missing table
+// or a broken output) are not. Fails without trying while the database is
+// unavailable.
+func (c *PgCopier) CopyFile(table, fileName string) error {
+	if !c.isAvailable() {
+		return fmt.Errorf("Database unavailable, skipping COPY of '%s'", fileName)
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			log.Warningf("Retrying COPY. table=%s file=%s attempt=%d err=%s", table, fileName, attempt, err)
+			time.Sleep(c.config.RetryDelay)
+		}
+
+		var rows int64
+		rows, err = c.copyFileOnce(table, fileName)
+		if err == nil {
+			log.Infof("Copied output to database. table=%s file=%s rows=%d", table, fileName, rows)
+			return nil
+		}
+		if _, isConnError := err.(*pgCopyConnError); !isConnError {
+			return fmt.Errorf("Error copying '%s' to table '%s': %v", fileName, table, err)
+		}
+	}
+
+	c.setUnavailable()
+	return fmt.Errorf("Error copying '%s' to table '%s' after %d retries: %v", fileName, table, c.config.Retries, err)
+}
+
+// Remembers the error of reading the output, so it is not mistaken for a
+// connection error
+type pgCopyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *pgCopyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (c *PgCopier) copyFileOnce(table, fileName string) (int64, error) {
+	f, err := NewCompressedFileReader(fileName)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening output '%s': %v", fileName, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("Error reading header of '%s': %v", fileName, err)
+	}
+	columns := strings.Split(strings.TrimRight(header, "\r\n"), "\v")
+
+	ctx := context.Background()
+	conn, err := c.connect(ctx, c.config.ConnString)
+	if err != nil {
+		return 0, &pgCopyConnError{err}
+	}
+	defer conn.Close(ctx)
+
+	body := &pgCopyReader{Reader: r}
+	rows, err := conn.CopyFrom(ctx, body, pgCopySql(c.config.Schema, table, columns))
+	if err != nil {
+		if _, isDbError := err.(*pgconn.PgError); !isDbError && body.err == nil {
+			return rows, &pgCopyConnError{err}
+		}
+	}
+	return rows, err
+}
+
+// The COPY statement reading the text format of the loader
+func pgCopySql(schema, table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgQuoteIdentifier(column)
+	}
+	return fmt.Sprintf(`COPY %s.%s (%s) FROM STDIN WITH (FORMAT text, DELIMITER E'\x0B', NULL '')`,
+		pgQuoteIdentifier(schema), pgQuoteIdentifier(table), strings.Join(quoted, ", "))
+}
+
+func pgQuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,225 @@
+package insight_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	tassert "github.com/stretchr/testify/assert"
+)
+
+// Records the copies, the first failures connections fail
+type fakePgCopyDb struct {
+	failures int
+	dbErr    error
+
+	connects int
+	sql      []string
+	bodies   []string
+}
+
+func (db *fakePgCopyDb) connect(ctx context.Context, connString string) (pgCopyConn, error) {
+	db.connects++
+	if db.connects <= db.failures {
+		return nil, errors.New("connection refused")
+	}
+	return db, nil
+}
+
+func (db *fakePgCopyDb) CopyFrom(ctx context.Context, r io.Reader, sql string) (int64, error) {
+	if db.dbErr != nil {
+		return 0, db.dbErr
+	}
+	body, err := ioutil.ReadAll(r)
+	db.sql = append(db.sql, sql)
+	db.bodies = append(db.bodies, string(body))
+	return 1, err
+}
+
+func (db *fakePgCopyDb) Close(ctx context.Context) error { return nil }
+
+func makeTestPgCopier(t *testing.T, dir string, db *fakePgCopyDb) *PgCopier {
+	copier, err := startPgCopier(PgCopyConfig{Schema: "public", Retries: 2, PendingDir: filepath.Join(dir, "pending")}, db.connect)
+	tassert.Nil(t, err)
+	return copier
+}
+
+// Writes an output of the table and waits for its copy
+func writeTestCsvOutput(t *testing.T, dir, table string, copier *PgCopier) *csvFileWriter {
+	w := NewCsvFileWriter(dir, filepath.Join(dir, "out", table+"-{{md5}}.csv"), []string{"a", "b"}, DefaultOutputCodec, OutputRotation{})
+	w.copyTo(copier, table)
+	tassert.Nil(t, w.WriteRow([]string{"1", "x\ty"}))
+	tassert.Nil(t, w.Close())
+	copier.Wait()
+	return w
+}
+
+func TestPgCopier_CopiesOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db := &fakePgCopyDb{failures: 1}
+	w := writeTestCsvOutput(t, dir, "threadinfo", makeTestPgCopier(t, dir, db))
+
+	// copied after a retry, nothing is left for the loader
+	tassert.Equal(t, 2, db.connects)
+	tassert.Equal(t, []string{`COPY "public"."threadinfo" ("p_filepath", "a", "b", "p_cre_date") FROM STDIN WITH (FORMAT text, DELIMITER E'\x0B', NULL '')`}, db.sql)
+	tassert.Len(t, db.bodies, 1)
+	tassert.Contains(t, db.bodies[0], "\v1\vx\ty\v")
+	tassert.Len(t, w.OutputFileNames(), 0)
+
+	outputs, _ := filepath.Glob(filepath.Join(dir, "out", "*"))
+	tassert.Len(t, outputs, 0)
+	pending, _ := filepath.Glob(filepath.Join(dir, "pending", "*"))
+	tassert.Len(t, pending, 0)
+}
+
+func TestPgCopier_CopiesErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	db := &fakePgCopyDb{}
+	copier := makeTestPgCopier(t, dir, db)
+	w := NewServerlogsWriter(filepath.Join(dir, "out"), dir, "serverlogs-{{md5}}.csv", []string{"a"}, DefaultOutputCodec, OutputRotation{})
+	w.(*serverlogsWriter).copyTo(copier, "serverlogs")
+
+	src := &ServerlogsSource{Host: "host1", Filename: "vizql.log"}
+	tassert.Nil(t, w.WriteParsed(src, []string{"1"}))
+	tassert.Nil(t, w.WriteError(src, errors.New("bad line"), "x"))
+	tassert.Nil(t, w.Close())
+	copier.Wait()
+
+	// the columns of the errors match the error table
+	tassert.Equal(t, []string{
+		`COPY "public"."serverlogs" ("p_filepath", "filename", "host_name", "a", "p_cre_date") FROM STDIN WITH (FORMAT text, DELIMITER E'\x0B', NULL '')`,
+		`COPY "public"."error_serverlogs" ("p_filepath", "error", "host_name", "filename", "line", "p_cre_date") FROM STDIN WITH (FORMAT text, DELIMITER E'\x0B', NULL '')`,
+	}, db.sql)
+	outputs, _ := filepath.Glob(filepath.Join(dir, "out", "*"))
+	tassert.Len(t, outputs, 0)
+}
+
+func TestPgCopier_FallsBackToFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the database is down, the output is moved for the loader by the copier
+	db := &fakePgCopyDb{failures: 100}
+	copier := makeTestPgCopier(t, dir, db)
+	writeTestCsvOutput(t, dir, "threadinfo", copier)
+	tassert.Equal(t, 3, db.connects)
+	outputs, _ := filepath.Glob(filepath.Join(dir, "out", "*"))
+	tassert.Len(t, outputs, 1)
+	lines := readTestCsvOutput(t, outputs[0])
+	tassert.Equal(t, "p_filepath\va\vb\vp_cre_date", lines[0])
+
+	// the next outputs dont wait for the database
+	w := writeTestCsvOutput(t, dir, "threadinfo", copier)
+	tassert.Equal(t, 3, db.connects)
+	tassert.Len(t, w.OutputFileNames(), 1)
+
+	// the errors of the database are not retried
+	db = &fakePgCopyDb{dbErr: &pgconn.PgError{Code: "42P01", Message: "relation does not exist"}}
+	writeTestCsvOutput(t, dir, "threadinfo", makeTestPgCopier(t, dir, db))
+	tassert.Equal(t, 1, db.connects)
+
+	outputs, _ = filepath.Glob(filepath.Join(dir, "out", "*"))
+	tassert.Len(t, outputs, 3)
+	pending, _ := filepath.Glob(filepath.Join(dir, "pending", "*"))
+	tassert.Len(t, pending, 0)
+}
+
+func TestPgCopier_LocalErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a missing output is not retried and the database stays available
+	db := &fakePgCopyDb{}
+	copier := makeTestPgCopier(t, dir, db)
+	tassert.NotNil(t, copier.CopyFile("threadinfo", filepath.Join(dir, "missing.csv.gz")))
+	tassert.Equal(t, 0, db.connects)
+	tassert.True(t, copier.isAvailable())
+}
+
+func TestPgCopier_CopiesPendingOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// an output left pending by the previous run
+	pendingDir := filepath.Join(dir, "pending")
+	output, err := NewFileWriterWithTemp(filepath.Join(pendingDir, "threadinfo.csv"), dir, DefaultOutputCodec)
+	tassert.Nil(t, err)
+	io.WriteString(output, "a\vb\n1\v2\n")
+	tassert.Nil(t, output.CloseWithFileName(filepath.Join(pendingDir, "threadinfo.csv.gz")))
+	tassert.Nil(t, ioutil.WriteFile(filepath.Join(pendingDir, "threadinfo.csv.gz.json"),
+		[]byte(`{"table":"threadinfo","file":"`+filepath.Join(pendingDir, "threadinfo.csv.gz")+`","output":"`+filepath.Join(dir, "out", "threadinfo.csv.gz")+`"}`), 0644))
+
+	db := &fakePgCopyDb{}
+	makeTestPgCopier(t, dir, db).Wait()
+	tassert.Equal(t, []string{"1\v2\n"}, db.bodies)
+	pending, _ := filepath.Glob(filepath.Join(pendingDir, "*"))
+	tassert.Len(t, pending, 0)
+}
+
+// The database of the tests, they are skipped if it is unavailable
+func testPgCopyDatabase() string {
+	if connString := os.Getenv("INSIGHT_TEST_DATABASE"); connString != "" {
+		return connString
+	}
+	return "postgres://postgres@localhost:5432/postgres?connect_timeout=2"
+}
+
+func TestPgCopier_Postgres(t *testing.T) {
+	ctx := context.Background()
+	conn, err := pgconn.Connect(ctx, testPgCopyDatabase())
+	if err != nil {
+		t.Skipf("PostgreSQL is unavailable: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	table := fmt.Sprintf("insight_copy_test_%d", os.Getpid())
+	_, err = conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE "public"."%s" (p_filepath text, a text, b text, p_cre_date timestamp without time zone)`, table)).ReadAll()
+	tassert.Nil(t, err)
+	defer conn.Exec(ctx, fmt.Sprintf(`DROP TABLE "public"."%s"`, table)).ReadAll()
+
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	copier, err := NewPgCopier(PgCopyConfig{ConnString: testPgCopyDatabase(), PendingDir: filepath.Join(dir, "pending")})
+	tassert.Nil(t, err)
+
+	w := writeTestCsvOutput(t, dir, table, copier)
+	tassert.Len(t, w.OutputFileNames(), 0)
+	results, err := conn.Exec(ctx, fmt.Sprintf(`SELECT a, b FROM "public"."%s"`, table)).ReadAll()
+	tassert.Nil(t, err)
+	tassert.Len(t, results[0].Rows, 1)
+	tassert.Equal(t, "x\ty", string(results[0].Rows[0][1]))
+
+	// a missing table is left for the loader
+	writeTestCsvOutput(t, dir, table+"_missing", copier)
+	outputs, _ := filepath.Glob(filepath.Join(dir, "out", table+"_missing-*"))
+	tassert.Len(t, outputs, 1)
+	tassert.True(t, copier.isAvailable())
+}
+
+func TestNewPgCopier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pg-copy")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewPgCopier(PgCopyConfig{ConnString: "postgres://insight@localhost:5432/palette", PendingDir: dir})
+	tassert.Nil(t, err)
+	_, err = NewPgCopier(PgCopyConfig{ConnString: "postgres://insight@localhost:notaport/palette", PendingDir: dir})
+	tassert.NotNil(t, err)
+}
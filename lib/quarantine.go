@@ -0,0 +1,328 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Upload quarantine
+// =================
+//
+// Uploads that failed (or whose md5 did not match) are kept in the
+// quarantine directory instead of the live uploads folder, so the loader
+// never picks them up. Each quarantined file has a JSON sidecar describing
+// why it got there.
+
+// The sidecar of a quarantined file
+type QuarantinedUpload struct {
+	Id string `json:"id"`
+
+	// The metadata of the original upload
+	Meta *UploadMeta `json:"meta"`
+
+	// The md5 sent by the agent and the md5 of what we actually received
+	ExpectedMd5 string `json:"expected_md5"`
+	ActualMd5   string `json:"actual_md5"`
+
+	// Why was the upload quarantined
+	Error string `json:"error"`
+
+	// Where the file would have been written to (this is where releasing
+	// the file moves it)
+	Destination string `json:"destination"`
+	// The destination is in the archives. The handlers working on the
+	// archived file did not run, so these files cannot be released.
+	Archived bool `json:"archived,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+type Quarantine struct {
+	directory string
+	lock      sync.Mutex
+}
+
+const (
+	quarantineDataExt = ".data"
+	quarantineMetaExt = ".json"
+)
+
+func NewQuarantine(directory string) (*Quarantine, error) {
+	if err := CreateDirectoryIfNotExists(directory); err != nil {
+		return nil, fmt.Errorf("Error creating quarantine directory '%s': %v", directory, err)
+	}
+	return &Quarantine{directory: directory}, nil
+}
+
+func (q *Quarantine) dataFile(id string) string {
+	return filepath.Join(q.directory, SanitizeName(id)+quarantineDataExt)
+}
+
+func (q *Quarantine) metaFile(id string) string {
+	return filepath.Join(q.directory, SanitizeName(id)+quarantineMetaExt)
+}
+
+// The error of releasing an upload whose destination is the archives
+var errQuarantineArchived = fmt.Errorf("The upload was going to the archives, releasing it would not parse or merge it. Upload the file again instead")
+
+// Moves the output of a failed upload to the quarantine. If the quarantine
+// is nil, the output is simply dropped.
+func (q *Quarantine) Add(output *FileWriterWithTemp, meta *UploadMeta, destination string, archived bool, actualMd5 []byte, uploadErr error) error {
+	if q == nil {
+		return output.Drop()
+	}
+
+	entry := &QuarantinedUpload{
+		Id:          makeRandomId(),
+		Meta:        meta,
+		ExpectedMd5: fmt.Sprintf("%032x", meta.OriginalMd5),
+		ActualMd5:   fmt.Sprintf("%032x", actualMd5),
+		Error:       fmt.Sprint(uploadErr),
+		Destination: destination,
+		Archived:    archived,
+		Created:     time.Now().UTC(),
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := output.CloseWithFileName(q.dataFile(entry.Id)); err != nil {
+		output.Drop()
+		return fmt.Errorf("Error moving upload to the quarantine: %v", err)
+	}
+
+	if err := q.writeMeta(entry); err != nil {
+		os.Remove(q.dataFile(entry.Id))
+		return err
+	}
+
+	log.Warningf("Quarantined upload. id=%s host=%s file=%s table=%s err=%s",
+		entry.Id, meta.Host, meta.OriginalFilename, meta.TableName, entry.Error)
+	return nil
+}
+
+// Writes the sidecar through a temp file, so the sidecar is either
+// complete or missing
+func (q *Quarantine) writeMeta(entry *QuarantinedUpload) error {
+	tmpFile, err := ioutil.TempFile(q.directory, "quarantine-meta")
+	if err != nil {
+		return fmt.Errorf("Error opening temp file: %v", err)
+	}
+	defer tmpFile.Close()
+
+	if err := json.NewEncoder(tmpFile).Encode(entry); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Error serializing quarantine entry: %v", err)
+	}
+
+	// close the temp file so we flush
+	tmpFile.Close()
+
+	if err := os.Rename(tmpFile.Name(), q.metaFile(entry.Id)); err != nil {
+		return fmt.Errorf("Error while moving quarantine entry '%s' to '%s': %v", tmpFile.Name(), q.metaFile(entry.Id), err)
+	}
+	return nil
+}
+
+// Returns all quarantined uploads, the oldest first
+func (q *Quarantine) List() ([]*QuarantinedUpload, error) {
+	files, err := ioutil.ReadDir(q.directory)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing quarantine directory '%s': %v", q.directory, err)
+	}
+
+	o := []*QuarantinedUpload{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != quarantineMetaExt {
+			continue
+		}
+		entry, err := q.Get(strings.TrimSuffix(file.Name(), quarantineMetaExt))
+		if err != nil {
+			log.Errorf("Skipping invalid quarantine entry. file=%s err=%s", file.Name(), err)
+			continue
+		}
+		o = append(o, entry)
+	}
+
+	sort.Slice(o, func(i, j int) bool { return o[i].Created.Before(o[j].Created) })
+	return o, nil
+}
+
+// Loads the sidecar of a quarantined upload
+func (q *Quarantine) Get(id string) (*QuarantinedUpload, error) {
+	metaFile, err := os.Open(q.metaFile(id))
+	if err != nil {
+		return nil, err
+	}
+	defer metaFile.Close()
+
+	entry := &QuarantinedUpload{}
+	if err := json.NewDecoder(metaFile).Decode(entry); err != nil {
+		return nil, fmt.Errorf("Error loading quarantine entry '%s': %v", id, err)
+	}
+	return entry, nil
+}
+
+// Opens the (compressed) file of a quarantined upload
+func (q *Quarantine) Open(id string) (*os.File, error) {
+	return os.Open(q.dataFile(id))
+}
+
+// Moves a quarantined file to its original destination. Returns
+// errQuarantineArchived for the uploads going to the archives.
+func (q *Quarantine) Release(id string) (*QuarantinedUpload, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entry, err := q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Archived {
+		return nil, errQuarantineArchived
+	}
+
+	if err := CreateDirectoryIfNotExists(filepath.Dir(entry.Destination)); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(q.dataFile(id), entry.Destination); err != nil {
+		return nil, fmt.Errorf("Error while moving quarantined file '%s' to '%s': %v", q.dataFile(id), entry.Destination, err)
+	}
+
+	if err := os.Remove(q.metaFile(id)); err != nil {
+		return nil, fmt.Errorf("Error removing quarantine entry '%s': %v", id, err)
+	}
+
+	log.Infof("Released quarantined upload. id=%s destination=%s", id, entry.Destination)
+	return entry, nil
+}
+
+// Deletes a quarantined file and its sidecar
+func (q *Quarantine) Remove(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := os.Remove(q.dataFile(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing quarantined file '%s': %v", id, err)
+	}
+	if err := os.Remove(q.metaFile(id)); err != nil {
+		return fmt.Errorf("Error removing quarantine entry '%s': %v", id, err)
+	}
+
+	log.Infof("Deleted quarantined upload. id=%s", id)
+	return nil
+}
+
+// HTTP HANDLERS
+// =============
+
+func writeQuarantineJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Error("Error encoding quarantine json for http.", err)
+	}
+}
+
+// Handler for GET /api/v1/quarantine
+func MakeListQuarantineHandler(quarantine *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := quarantine.List()
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+		writeQuarantineJson(w, entries)
+	}
+}
+
+// Handler for GET /api/v1/quarantine/{id}
+func MakeGetQuarantineHandler(quarantine *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, err := quarantine.Get(mux.Vars(r)["id"])
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such quarantined upload", r)
+			return
+		}
+		writeQuarantineJson(w, entry)
+	}
+}
+
+// Handler for GET /api/v1/quarantine/{id}/file
+// Sends the quarantined file as it was stored (compressed with the output codec)
+func MakeGetQuarantineFileHandler(quarantine *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		entry, err := quarantine.Get(id)
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such quarantined upload", r)
+			return
+		}
+
+		file, err := quarantine.Open(id)
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such quarantined upload", r)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(entry.Destination)))
+		if _, err := io.Copy(w, file); err != nil {
+			log.Errorf("Error sending quarantined file. id=%s err=%s", id, err)
+		}
+	}
+}
+
+// Handler for POST /api/v1/quarantine/{id}/release
+func MakeReleaseQuarantineHandler(quarantine *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := quarantine.Get(id); err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such quarantined upload", r)
+			return
+		}
+
+		entry, err := quarantine.Release(id)
+		if err == errQuarantineArchived {
+			WriteResponse(w, http.StatusConflict, fmt.Sprint(err), r)
+			return
+		}
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+		writeQuarantineJson(w, entry)
+	}
+}
+
+// Handler for DELETE /api/v1/quarantine/{id}
+func MakeDeleteQuarantineHandler(quarantine *Quarantine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := quarantine.Get(id); err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such quarantined upload", r)
+			return
+		}
+
+		if err := quarantine.Remove(id); err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+		WriteResponse(w, http.StatusNoContent, "", r)
+	}
+}
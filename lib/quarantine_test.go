@@ -0,0 +1,116 @@
+package insight_server
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func makeTestQuarantineEnv(t *testing.T) (*UploadHandlerEnv, func()) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	tassert.Nil(t, err)
+
+	quarantine, err := NewQuarantine(filepath.Join(dir, "quarantine"))
+	tassert.Nil(t, err)
+
+	env := &UploadHandlerEnv{
+		TmpDir:      dir,
+		BaseDir:     filepath.Join(dir, "uploads"),
+		ArchivesDir: filepath.Join(dir, "archives"),
+		Quarantine:  quarantine,
+	}
+	return env, func() { os.RemoveAll(dir) }
+}
+
+func TestQuarantine_Md5Mismatch(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	meta := makeTestUploadMeta("not-the-md5")
+	meta.Timezone = time.UTC
+
+	outFileName, err := copyUploadedFileAndCheckMd5(env, meta, strings.NewReader("a\vb\n"), nil, env.BaseDir, true)
+	tassert.NotNil(t, err)
+
+	// the loader must not see the corrupt file
+	_, err = os.Stat(outFileName)
+	tassert.True(t, os.IsNotExist(err))
+
+	entries, err := env.Quarantine.List()
+	tassert.Nil(t, err)
+	tassert.Len(t, entries, 1)
+
+	entry := entries[0]
+	tassert.Equal(t, outFileName, entry.Destination)
+	tassert.Equal(t, "threadinfo", entry.Meta.TableName)
+	tassert.Equal(t, time.UTC, entry.Meta.Timezone)
+	tassert.Contains(t, entry.Error, "Invalid md5")
+
+	// releasing moves the file to where it was supposed to go
+	_, err = env.Quarantine.Release(entry.Id)
+	tassert.Nil(t, err)
+
+	_, err = os.Stat(outFileName)
+	tassert.Nil(t, err)
+
+	entries, err = env.Quarantine.List()
+	tassert.Nil(t, err)
+	tassert.Len(t, entries, 0)
+}
+
+func TestQuarantine_Md5Match(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	contents := "a\vb\n"
+	fileMd5 := md5.Sum([]byte(contents))
+	meta := makeTestUploadMeta(string(fileMd5[:]))
+	meta.Timezone = time.UTC
+
+	outFileName, err := copyUploadedFileAndCheckMd5(env, meta, strings.NewReader(contents), nil, env.BaseDir, true)
+	tassert.Nil(t, err)
+
+	_, err = os.Stat(outFileName)
+	tassert.Nil(t, err)
+
+	entries, err := env.Quarantine.List()
+	tassert.Nil(t, err)
+	tassert.Len(t, entries, 0)
+}
+
+func TestQuarantine_ReleaseArchived(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	meta := makeTestUploadMeta("not-the-md5")
+	meta.TableName = "serverlogs"
+
+	archivedFile, err := copyUploadedFileAndCheckMd5(env, meta, strings.NewReader("a\vb\n"), nil, env.ArchivesDir, false)
+	tassert.NotNil(t, err)
+
+	entries, err := env.Quarantine.List()
+	tassert.Nil(t, err)
+	tassert.Len(t, entries, 1)
+	tassert.True(t, entries[0].Archived)
+
+	// the archived file would never be parsed, so it is not released
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/quarantine/"+entries[0].Id+"/release", nil), map[string]string{"id": entries[0].Id})
+	w := httptest.NewRecorder()
+	MakeReleaseQuarantineHandler(env.Quarantine)(w, req)
+	tassert.Equal(t, http.StatusConflict, w.Code)
+
+	_, err = os.Stat(archivedFile)
+	tassert.True(t, os.IsNotExist(err))
+	entries, err = env.Quarantine.List()
+	tassert.Nil(t, err)
+	tassert.Len(t, entries, 1)
+}
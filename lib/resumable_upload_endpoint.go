@@ -0,0 +1,451 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Resumable uploads
+// =================
+//
+// Large files can be uploaded in pieces:
+//
+//   1. POST   /upload/sessions?pkg=...&host=...&tz=...&compression=...&filename=...
+//      creates a new session and returns its id
+//   2. PUT    /upload/sessions/{id}?offset=N
+//      appends (or overwrites) the bytes of the request body starting at offset N
+//   3. GET    /upload/sessions/{id}
+//      returns the number of bytes received so far, so a broken upload can
+//      continue from there
+//   4. POST   /upload/sessions/{id}/commit?_md5=...
+//      runs the assembled file through the regular upload handlers
+//
+// Sessions can be dropped by DELETE /upload/sessions/{id}.
+
+// The file names inside a session directory
+const (
+	uploadSessionMetaFile = "session.json"
+	uploadSessionDataFile = "data"
+)
+
+// Sessions not touched for this long are removed
+const uploadSessionMaxAge = 7 * 24 * time.Hour
+
+// The persisted parameters of an upload session
+type UploadSession struct {
+	Id string `json:"id"`
+
+	// The URL parameters of the upload (pkg, host, tz, compression)
+	Params map[string]string `json:"params"`
+
+	// The agent file name (same as the file name of the '_file' field
+	// for regular uploads)
+	Filename string `json:"filename"`
+
+	Created time.Time `json:"created"`
+}
+
+// The state of an upload session as reported to the agents
+type UploadSessionStatus struct {
+	Id string `json:"id"`
+	// The number of bytes received so far
+	Offset int64 `json:"offset"`
+}
+
+// Stores the upload sessions on disk, so they survive restarts
+type UploadSessionStore struct {
+	baseDir string
+
+	// a lock for each session, so writes to the same session are serialized
+	locks     map[string]*uploadSessionLock
+	locksLock sync.Mutex
+}
+
+// The lock of a session. It is kept in the store while anyone holds or waits
+// for it, so all of them use the same lock.
+type uploadSessionLock struct {
+	mutex sync.Mutex
+	refs  int
+
+	store *UploadSessionStore
+	id    string
+}
+
+func NewUploadSessionStore(baseDir string) (*UploadSessionStore, error) {
+	if err := CreateDirectoryIfNotExists(baseDir); err != nil {
+		return nil, fmt.Errorf("Error creating upload sessions directory '%s': %v", baseDir, err)
+	}
+	return &UploadSessionStore{
+		baseDir: baseDir,
+		locks:   map[string]*uploadSessionLock{},
+	}, nil
+}
+
+// Returns the (locked) lock of a session. The caller must unlock it.
+func (s *UploadSessionStore) lock(id string) *uploadSessionLock {
+	s.locksLock.Lock()
+	l, hasLock := s.locks[id]
+	if !hasLock {
+		l = &uploadSessionLock{store: s, id: id}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.locksLock.Unlock()
+
+	l.mutex.Lock()
+	return l
+}
+
+// Unlocks the session and drops the lock when no one else uses it
+func (l *uploadSessionLock) Unlock() {
+	l.mutex.Unlock()
+
+	l.store.locksLock.Lock()
+	defer l.store.locksLock.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(l.store.locks, l.id)
+	}
+}
+
+func (s *UploadSessionStore) sessionDir(id string) string {
+	return filepath.Join(s.baseDir, SanitizeName(id))
+}
+
+func (s *UploadSessionStore) dataFile(id string) string {
+	return filepath.Join(s.sessionDir(id), uploadSessionDataFile)
+}
+
+// Creates a new session
+func (s *UploadSessionStore) Create(params map[string]string, fileName string) (*UploadSession, error) {
+	s.removeExpired()
+
+	session := &UploadSession{
+		Id:       makeRandomId(),
+		Params:   params,
+		Filename: fileName,
+		Created:  time.Now().UTC(),
+	}
+
+	// hold the lock until the data file exists, so the half-created session
+	// is not taken for an expired one
+	defer s.lock(session.Id).Unlock()
+
+	dir := s.sessionDir(session.Id)
+	if err := os.MkdirAll(dir, OUTPUT_DEFAULT_DIRMODE); err != nil {
+		return nil, fmt.Errorf("Error creating session directory '%s': %v", dir, err)
+	}
+
+	metaJson, err := json.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("Error serializing upload session: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, uploadSessionMetaFile), metaJson, 0644); err != nil {
+		return nil, fmt.Errorf("Error saving upload session: %v", err)
+	}
+
+	// create the empty data file, so the size of the session is always available
+	if err := ioutil.WriteFile(s.dataFile(session.Id), []byte{}, 0644); err != nil {
+		return nil, fmt.Errorf("Error creating upload session data file: %v", err)
+	}
+
+	return session, nil
+}
+
+// Loads a session
+func (s *UploadSessionStore) Get(id string) (*UploadSession, error) {
+	metaFile, err := os.Open(filepath.Join(s.sessionDir(id), uploadSessionMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	defer metaFile.Close()
+
+	session := &UploadSession{}
+	if err := json.NewDecoder(metaFile).Decode(session); err != nil {
+		return nil, fmt.Errorf("Error loading upload session '%s': %v", id, err)
+	}
+	return session, nil
+}
+
+// Returns the number of bytes received for a session
+func (s *UploadSessionStore) Status(id string) (*UploadSessionStatus, error) {
+	stat, err := os.Stat(s.dataFile(id))
+	if err != nil {
+		return nil, err
+	}
+	return &UploadSessionStatus{Id: id, Offset: stat.Size()}, nil
+}
+
+// Writes the contents of the reader into the session starting at offset.
+// The offset cannot be past the bytes already received, so sessions never
+// have holes in them.
+func (s *UploadSessionStore) WriteAt(id string, offset int64, r io.Reader) (*UploadSessionStatus, error) {
+	defer s.lock(id).Unlock()
+
+	status, err := s.Status(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 || offset > status.Offset {
+		return status, fmt.Errorf("Invalid offset %d for session '%s': %d bytes received so far", offset, id, status.Offset)
+	}
+
+	dataFile, err := os.OpenFile(s.dataFile(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	if _, err := dataFile.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("Error seeking to %d in session '%s': %v", offset, id, err)
+	}
+
+	// even if the copy fails midway, the bytes written so far are kept, so
+	// the agent can continue from there
+	written, err := io.Copy(dataFile, r)
+	if err != nil {
+		log.Errorf("Error writing upload session data. session=%s offset=%d written=%d err=%s", id, offset, written, err)
+	}
+
+	if closeErr := dataFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	status, statusErr := s.Status(id)
+	if statusErr != nil {
+		return nil, statusErr
+	}
+	return status, err
+}
+
+// Opens the assembled file of the session for reading
+func (s *UploadSessionStore) Open(id string) (*os.File, error) {
+	return os.Open(s.dataFile(id))
+}
+
+// Removes a session and all its data
+func (s *UploadSessionStore) Remove(id string) error {
+	defer s.lock(id).Unlock()
+	return s.removeLocked(id)
+}
+
+// Removes a session whose lock is held by the caller
+func (s *UploadSessionStore) removeLocked(id string) error {
+	return os.RemoveAll(s.sessionDir(id))
+}
+
+// Returns true if the session directory and the files in it were not
+// touched for uploadSessionMaxAge. The caller must hold the session lock.
+func (s *UploadSessionStore) isExpiredLocked(id string) bool {
+	for _, path := range []string{s.sessionDir(id), filepath.Join(s.sessionDir(id), uploadSessionMetaFile), s.dataFile(id)} {
+		stat, err := os.Stat(path)
+		if err == nil && time.Since(stat.ModTime()) < uploadSessionMaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the session if it is expired
+func (s *UploadSessionStore) removeIfExpired(id string) {
+	defer s.lock(id).Unlock()
+
+	if !s.isExpiredLocked(id) {
+		return
+	}
+
+	log.Infof("Removing expired upload session. session=%s", id)
+	if err := s.removeLocked(id); err != nil {
+		log.Errorf("Error removing expired upload session. session=%s err=%s", id, err)
+	}
+}
+
+// Removes the sessions that were not touched for a long time
+func (s *UploadSessionStore) removeExpired() {
+	entries, err := ioutil.ReadDir(s.baseDir)
+	if err != nil {
+		log.Errorf("Error listing upload sessions. dir=%s err=%s", s.baseDir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			s.removeIfExpired(entry.Name())
+		}
+	}
+}
+
+// HTTP HANDLERS
+// =============
+
+// Writes the status of a session as JSON
+func writeUploadSessionStatus(w http.ResponseWriter, httpStatus int, status *UploadSessionStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error("Error encoding upload session status json for http.", err)
+	}
+}
+
+// Handler for POST /upload/sessions
+func MakeCreateUploadSessionHandler(store *UploadSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urlParams, err := getUploadUrlParams(r.URL)
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		fileName, err := getUrlParam(r.URL, "filename")
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		// check if we will be able to handle the upload when its done
+		if _, err := makeUploadMeta(urlParams, fileName, nil); err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		session, err := store.Create(urlParams, fileName)
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+
+		log.Infof("Created upload session. session=%s host=%s filename=%s", session.Id, urlParams[hostUrlParam], fileName)
+		writeUploadSessionStatus(w, http.StatusCreated, &UploadSessionStatus{Id: session.Id, Offset: 0})
+	}
+}
+
+// Handler for GET /upload/sessions/{id}
+func MakeGetUploadSessionHandler(store *UploadSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := store.Status(mux.Vars(r)["id"])
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such upload session", r)
+			return
+		}
+
+		writeUploadSessionStatus(w, http.StatusOK, status)
+	}
+}
+
+// Handler for PUT /upload/sessions/{id}
+func MakeWriteUploadSessionHandler(store *UploadSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := store.Get(id); err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such upload session", r)
+			return
+		}
+
+		offsetStr, err := getUrlParam(r.URL, "offset")
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid offset '%s': %v", offsetStr, err), r)
+			return
+		}
+
+		status, err := store.WriteAt(id, offset, r.Body)
+		if err != nil {
+			// if we know how much data we have, tell the agent
+			if status != nil {
+				log.Errorf("Error writing upload session. session=%s err=%s", id, err)
+				writeUploadSessionStatus(w, http.StatusConflict, status)
+				return
+			}
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+
+		writeUploadSessionStatus(w, http.StatusOK, status)
+	}
+}
+
+// Handler for POST /upload/sessions/{id}/commit
+func MakeCommitUploadSessionHandler(store *UploadSessionStore, maxidBackend MaxIdBackend, uploader *Uploader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		// no chunks are written and no other commit runs until this one is done
+		defer store.lock(id).Unlock()
+
+		session, err := store.Get(id)
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such upload session", r)
+			return
+		}
+
+		fileMd5, err := decodeMd5Field([]string{r.FormValue("_md5")})
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		meta, err := makeUploadMeta(session.Params, session.Filename, fileMd5)
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		dataFile, err := store.Open(id)
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+		defer dataFile.Close()
+
+		// the session is kept on failure, so the agent can fix it up
+		if err := uploader.HandleUpload(meta, dataFile); err != nil {
+			WriteResponse(w, getUploadErrorStatus(err), fmt.Sprint(err), r)
+			return
+		}
+
+		saveMaxIdFromRequest(maxidBackend, meta, r)
+
+		dataFile.Close()
+		if err := store.removeLocked(id); err != nil {
+			log.Errorf("Error removing committed upload session. session=%s err=%s", id, err)
+		}
+
+		WriteResponse(w, http.StatusOK, "OK", r)
+	}
+}
+
+// Handler for DELETE /upload/sessions/{id}
+func MakeDeleteUploadSessionHandler(store *UploadSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, err := store.Get(id); err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such upload session", r)
+			return
+		}
+
+		if err := store.Remove(id); err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+
+		WriteResponse(w, http.StatusNoContent, "", r)
+	}
+}
@@ -0,0 +1,153 @@
+package insight_server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestUploadSessionStore_WriteAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-sessions")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewUploadSessionStore(dir)
+	tassert.Nil(t, err)
+
+	session, err := store.Create(map[string]string{"pkg": "public", "host": "local", "tz": "UTC"}, "threadinfo-2016-10-07--15-48-25--seq0000--part0000.csv")
+	tassert.Nil(t, err)
+
+	status, err := store.WriteAt(session.Id, 0, strings.NewReader("hello "))
+	tassert.Nil(t, err)
+	tassert.Equal(t, int64(6), status.Offset)
+
+	// resending an already received range overwrites it
+	status, err = store.WriteAt(session.Id, 4, strings.NewReader("o world"))
+	tassert.Nil(t, err)
+	tassert.Equal(t, int64(11), status.Offset)
+
+	// holes are not allowed
+	status, err = store.WriteAt(session.Id, 20, strings.NewReader("!"))
+	tassert.NotNil(t, err)
+	tassert.Equal(t, int64(11), status.Offset)
+
+	f, err := store.Open(session.Id)
+	tassert.Nil(t, err)
+	contents, _ := ioutil.ReadAll(f)
+	f.Close()
+	tassert.Equal(t, "hello world", string(contents))
+
+	loaded, err := store.Get(session.Id)
+	tassert.Nil(t, err)
+	tassert.Equal(t, "local", loaded.Params["host"])
+
+	tassert.Nil(t, store.Remove(session.Id))
+	_, err = store.Status(session.Id)
+	tassert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadSessionStore_Expiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-sessions")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewUploadSessionStore(dir)
+	tassert.Nil(t, err)
+
+	old, err := store.Create(map[string]string{"host": "local"}, "old.csv")
+	tassert.Nil(t, err)
+	touched := time.Now().Add(-uploadSessionMaxAge - time.Hour)
+	for _, path := range []string{store.dataFile(old.Id), filepath.Join(store.sessionDir(old.Id), uploadSessionMetaFile), store.sessionDir(old.Id)} {
+		tassert.Nil(t, os.Chtimes(path, touched, touched))
+	}
+
+	// a new session without its data file yet is not expired
+	tassert.Nil(t, os.Mkdir(store.sessionDir("new"), OUTPUT_DEFAULT_DIRMODE))
+
+	// sessions created at the same time dont remove each other
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := store.Create(map[string]string{"host": "local"}, "new.csv")
+			if tassert.Nil(t, err) {
+				_, err = store.Get(session.Id)
+				tassert.Nil(t, err)
+				_, err = store.Status(session.Id)
+				tassert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err = store.Status(old.Id)
+	tassert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(store.sessionDir("new"))
+	tassert.Nil(t, err)
+
+	// the locks are dropped when no one uses them
+	tassert.Len(t, store.locks, 0)
+}
+
+// Upload handler taking its time, so the requests overlap
+type slowUploadHandler struct {
+	count int
+	lock  sync.Mutex
+}
+
+func (h *slowUploadHandler) CanHandle(meta *UploadMeta) bool { return true }
+func (h *slowUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	time.Sleep(50 * time.Millisecond)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.count++
+	return nil
+}
+
+func TestCommitUploadSession_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-sessions")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewUploadSessionStore(dir)
+	tassert.Nil(t, err)
+
+	session, err := store.Create(map[string]string{"pkg": "public", "host": "local", "tz": "UTC"}, "threadinfo-2016-10-07--15-48-25--seq0000--part0000.csv")
+	tassert.Nil(t, err)
+	_, err = store.WriteAt(session.Id, 0, strings.NewReader("hello world"))
+	tassert.Nil(t, err)
+
+	handler := &slowUploadHandler{}
+	commit := MakeCommitUploadSessionHandler(store, nil, &Uploader{fallback: handler})
+
+	// the same commit sent twice at once is handled once
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/upload/sessions/"+session.Id+"/commit", nil)
+			commit(w, mux.SetURLVars(r, map[string]string{"id": session.Id}))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	tassert.Equal(t, 1, handler.count)
+	tassert.ElementsMatch(t, []int{http.StatusOK, http.StatusNotFound}, codes)
+	_, err = store.Get(session.Id)
+	tassert.True(t, os.IsNotExist(err))
+}
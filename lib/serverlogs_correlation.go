@@ -0,0 +1,249 @@
+package insight_server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request correlation
+// ===================
+//
+// Follows the requests and sessions of the JSON serverlogs through the
+// 'begin-*' / 'end-*' key pairs (by the req of the rows) and the
+// 'lock-session' / 'release-session' events (by the sess of the rows), and
+// writes a row with the start, the end and the duration of each of them to
+// the serverlogs_requests side table.
+//
+// The spans without an end at the end of the file end at the last row of
+// their request (or session), and the ends without a start start at the
+// start_ts of the end row. These rows are flagged as inferred.
+
+var serverlogsRequestsTable = metaTable{"public", "serverlogs_requests"}
+
+var serverlogsRequestsColumns = []metaColumn{
+	{serverlogsRequestsTable, "filename", "text"},
+	{serverlogsRequestsTable, "host_name", "text"},
+	{serverlogsRequestsTable, "req", "text"},
+	{serverlogsRequestsTable, "sess", "text"},
+	{serverlogsRequestsTable, "pid", "integer"},
+	{serverlogsRequestsTable, "kind", "text"},
+	{serverlogsRequestsTable, "start_ts", "timestamp without time zone"},
+	{serverlogsRequestsTable, "end_ts", "timestamp without time zone"},
+	{serverlogsRequestsTable, "duration_ms", "integer"},
+	{serverlogsRequestsTable, "inferred", "boolean"},
+}
+
+// The kind of the session lock spans
+const sessionLockKind = "session-lock"
+
+// A span waiting for its end
+type correlationSpan struct {
+	Host     string `json:"host"`
+	Filename string `json:"filename"`
+	Req      string `json:"req"`
+	Sess     string `json:"sess"`
+	Pid      string `json:"pid"`
+	Kind     string `json:"kind"`
+	Start    string `json:"start"`
+}
+
+// Returns the kind of the span a key starts or ends. Returns false for the
+// keys not starting or ending spans.
+func correlationKind(k string) (kind string, isBegin, isSpan bool) {
+	switch {
+	case k == "lock-session":
+		return sessionLockKind, true, true
+	case k == "release-session":
+		return sessionLockKind, false, true
+	case strings.HasPrefix(k, "begin-"):
+		return k[len("begin-"):], true, true
+	case strings.HasPrefix(k, "end-"):
+		return k[len("end-"):], false, true
+	}
+	return "", false, false
+}
+
+// The spans are kept by their request (or their session for the session
+// locks). Returns false if the row has no request (or session).
+func correlationId(kind, req, sess string) (string, bool) {
+	if kind == sessionLockKind {
+		return "sess|" + sess, sess != "" && sess != "-"
+	}
+	return "req|" + req, req != "" && req != "-"
+}
+
+const (
+	correlationOpenPrefix = "correlation.open:"
+	correlationLastPrefix = "correlation.last:"
+)
+
+func correlationOpenKey(src *ServerlogsSource, kind, id string) string {
+	return fmt.Sprintf("%s%s|%s|%s|%s", correlationOpenPrefix, src.Host, src.Filename, kind, id)
+}
+
+func correlationLastKey(host, filename, id string) string {
+	return fmt.Sprintf("%s%s|%s|%s", correlationLastPrefix, host, filename, id)
+}
+
+// Wraps a parser so the rows it writes are correlated
+type correlatingParser struct {
+	ServerlogsParser
+
+	// the index of the columns used in the header of the parser
+	ts, pid, req, sess, k, startTs int
+}
+
+// Wraps the parser in a correlating parser. The parser has to have the
+// columns of the JsonLogParser.
+func makeCorrelatingParser(parser ServerlogsParser) (*correlatingParser, error) {
+	p := &correlatingParser{ServerlogsParser: parser}
+	header := parser.Header()
+	for column, index := range map[string]*int{"ts": &p.ts, "pid": &p.pid, "req": &p.req, "sess": &p.sess, "k": &p.k, "start_ts": &p.startTs} {
+		if *index = indexOfString(header, column); *index < 0 {
+			return nil, fmt.Errorf("No '%s' column to correlate the rows by", column)
+		}
+	}
+	return p, nil
+}
+
+// Remembers the last row written by the parser
+type lastRowWriter struct {
+	ServerlogWriter
+	row []string
+}
+
+func (w *lastRowWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	w.row = fields
+	return w.ServerlogWriter.WriteParsed(source, fields)
+}
+
+func (w *lastRowWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	if sideWriter, ok := w.ServerlogWriter.(SideTableWriter); ok {
+		return sideWriter.WriteSide(source, table, headers, fields)
+	}
+	return nil
+}
+
+func (p *correlatingParser) Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error {
+	rowWriter := &lastRowWriter{ServerlogWriter: w}
+	if err := p.ServerlogsParser.Parse(state, src, line, rowWriter); err != nil {
+		return err
+	}
+
+	sideWriter, ok := w.(SideTableWriter)
+	if rowWriter.row == nil || !ok {
+		return nil
+	}
+	return p.correlate(state, src, rowWriter.row, sideWriter)
+}
+
+func (p *correlatingParser) correlate(state ServerlogParserState, src *ServerlogsSource, row []string, w SideTableWriter) error {
+	ts, req, sess := row[p.ts], row[p.req], row[p.sess]
+
+	// the last row of the requests and sessions, for the spans without an end
+	for _, kind := range []string{"", sessionLockKind} {
+		if id, hasId := correlationId(kind, req, sess); hasId {
+			state.Set(correlationLastKey(src.Host, src.Filename, id), []byte(ts))
+		}
+	}
+
+	kind, isBegin, isSpan := correlationKind(row[p.k])
+	if !isSpan {
+		return nil
+	}
+	id, hasId := correlationId(kind, req, sess)
+	if !hasId {
+		return nil
+	}
+
+	// the spans of the same kind and request are nested, so the last one
+	// started is the one ending
+	openKey := correlationOpenKey(src, kind, id)
+	open := []correlationSpan{}
+	if _, err := getParserStateJson(state, openKey, &open); err != nil {
+		return err
+	}
+
+	if isBegin {
+		open = append(open, correlationSpan{
+			Host: src.Host, Filename: src.Filename,
+			Req: req, Sess: sess, Pid: row[p.pid], Kind: kind, Start: ts,
+		})
+		return setParserStateJson(state, openKey, open)
+	}
+
+	if len(open) == 0 {
+		// an end without a start starts at the start_ts of the row (the ts
+		// less the elapsed time if the row has one)
+		span := &correlationSpan{Req: req, Sess: sess, Pid: row[p.pid], Kind: kind, Start: row[p.startTs]}
+		return writeCorrelatedSpan(w, src, span, ts, true)
+	}
+
+	span := open[len(open)-1]
+	if len(open) == 1 {
+		state.Set(openKey, nil)
+	} else if err := setParserStateJson(state, openKey, open[:len(open)-1]); err != nil {
+		return err
+	}
+	return writeCorrelatedSpan(w, src, &span, ts, false)
+}
+
+// Writes the spans left without an end
+func (p *correlatingParser) Finish(state ServerlogParserState, w ServerlogWriter) error {
+	if finisher, ok := p.ServerlogsParser.(ServerlogsFinisher); ok {
+		if err := finisher.Finish(state, w); err != nil {
+			return err
+		}
+	}
+
+	sideWriter, ok := w.(SideTableWriter)
+	if !ok {
+		return nil
+	}
+
+	for _, openKey := range state.Keys(correlationOpenPrefix) {
+		open := []correlationSpan{}
+		if _, err := getParserStateJson(state, openKey, &open); err != nil {
+			return err
+		}
+		state.Set(openKey, nil)
+
+		for i := range open {
+			span := &open[i]
+			end := span.Start
+			id, _ := correlationId(span.Kind, span.Req, span.Sess)
+			if last, hasLast := state.Get(correlationLastKey(span.Host, span.Filename, id)); hasLast {
+				end = string(last)
+			}
+			src := &ServerlogsSource{Host: span.Host, Filename: span.Filename}
+			if err := writeCorrelatedSpan(sideWriter, src, span, end, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeCorrelatedSpan(w SideTableWriter, src *ServerlogsSource, span *correlationSpan, end string, inferred bool) error {
+	duration := ""
+	start, startErr := time.Parse(jsonDateFormat, span.Start)
+	endTs, endErr := time.Parse(jsonDateFormat, end)
+	if startErr == nil && endErr == nil {
+		if endTs.Before(start) {
+			endTs, end = start, span.Start
+		}
+		duration = strconv.FormatInt(int64(endTs.Sub(start)/time.Millisecond), 10)
+	}
+
+	headers := make([]string, len(serverlogsRequestsColumns)-2)
+	for i, column := range serverlogsRequestsColumns[2:] {
+		headers[i] = column.column
+	}
+
+	return w.WriteSide(src, serverlogsRequestsTable.name, headers, []string{
+		span.Req, span.Sess, span.Pid, span.Kind,
+		span.Start, end, duration, strconv.FormatBool(inferred),
+	})
+}
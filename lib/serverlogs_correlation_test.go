@@ -0,0 +1,41 @@
+package insight_server
+
+import (
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestCorrelatingParser(t *testing.T) {
+	parser, err := makeCorrelatingParser(&JsonLogParser{})
+	tassert.Nil(t, err)
+
+	state := MakeServerlogParserState()
+	src := &ServerlogsSource{Host: "host1", Filename: "vizqlserver_1-0.log", Timezone: time.UTC}
+	w := &collectingServerlogWriter{}
+
+	for _, line := range []string{
+		`{"ts":"2016-03-25T00:59:10.000","pid":1,"tid":"1","sev":"info","req":"R1","sess":"S1","site":"-","user":"-","k":"lock-session","v":{}}`,
+		`{"ts":"2016-03-25T00:59:10.100","pid":1,"tid":"1","sev":"info","req":"R1","sess":"S1","site":"-","user":"-","k":"begin-query","v":{}}`,
+		`{"ts":"2016-03-25T00:59:10.600","pid":1,"tid":"1","sev":"info","req":"R1","sess":"S1","site":"-","user":"-","k":"end-query","v":{}}`,
+		// an end without a begin
+		`{"ts":"2016-03-25T00:59:11.000","pid":1,"tid":"1","sev":"info","req":"R2","sess":"S1","site":"-","user":"-","k":"end-commit","v":{"elapsed":0.25}}`,
+		// a begin without an end
+		`{"ts":"2016-03-25T00:59:12.000","pid":1,"tid":"1","sev":"info","req":"R3","sess":"S2","site":"-","user":"-","k":"begin-bootstrap","v":{}}`,
+		`{"ts":"2016-03-25T00:59:12.500","pid":1,"tid":"1","sev":"info","req":"R3","sess":"S2","site":"-","user":"-","k":"log","v":{}}`,
+		// no request
+		`{"ts":"2016-03-25T00:59:13.000","pid":1,"tid":"1","sev":"info","req":"-","sess":"-","site":"-","user":"-","k":"begin-query","v":{}}`,
+	} {
+		tassert.Nil(t, parser.Parse(state, src, line, w))
+	}
+	tassert.Nil(t, parser.Finish(state, w))
+
+	tassert.Equal(t, [][]string{
+		{"R1", "S1", "1", "query", "2016-03-25T00:59:10.1", "2016-03-25T00:59:10.6", "500", "false"},
+		{"R2", "S1", "1", "commit", "2016-03-25T00:59:10.75", "2016-03-25T00:59:11", "250", "true"},
+		{"R3", "S2", "1", "bootstrap", "2016-03-25T00:59:12", "2016-03-25T00:59:12.5", "500", "true"},
+		{"R1", "S1", "1", "session-lock", "2016-03-25T00:59:10", "2016-03-25T00:59:11", "1000", "true"},
+	}, w.side[serverlogsRequestsTable.name])
+	tassert.Len(t, w.parsed, 7)
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	log "github.com/palette-software/go-log-targets"
@@ -22,7 +21,10 @@ type ServerlogOuterJson struct {
 	Tid                               string
 }
 
-type JsonLogParser struct{}
+type JsonLogParser struct {
+	// The masking rules applied to the parsed rows (can be nil)
+	masking *MaskingRules
+}
 
 func (j *JsonLogParser) Header() []string {
 	return []string{
@@ -30,6 +32,7 @@ func (j *JsonLogParser) Header() []string {
 		"pid", "tid",
 		"sev", "req", "sess", "site", "user",
 		"k", "v", "elapsed_ms", "start_ts",
+		"a", "e", "extras",
 	}
 }
 
@@ -123,28 +126,26 @@ func getStartTime(end string, elapsed int64) string {
 // parses a server log in JSON format
 func (j *JsonLogParser) Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error {
 
-	// try to parse the log row
-	outerJson := ServerlogOuterJson{}
-	err := json.NewDecoder(strings.NewReader(line)).Decode(&outerJson)
-	if err != nil {
-		return fmt.Errorf("JSON parse error in '%s': %v", line, err)
-	}
+	var outerJson *ServerlogOuterJson
+	var err error
+	newerFields := &jsonLogNewerFields{}
 
-	// convert the tid
-	if outerJson.Tid, err = hexToDecimal(outerJson.Tid); err != nil {
-		return fmt.Errorf("Tid Parse error: %v", err)
+	// try to parse the log row in the schema of its file
+	if detectJsonLogSchema(state, src, line) == jsonLogSchemaNewer {
+		outerJson, newerFields, err = parseNewerJsonLogLine(line, src.Timezone)
+	} else {
+		outerJson, err = parseClassicJsonLogLine(line, src.Timezone)
 	}
-
-	tsUtc, err := convertTimestringToUTC(jsonDateFormat, outerJson.Ts, src.Timezone)
 	if err != nil {
-		return fmt.Errorf("Parsing log timestamp: %v", err)
+		return err
 	}
-
-	// Re-assign the converted timestamp
-	outerJson.Ts = tsUtc
+	tsUtc := outerJson.Ts
 
 	// ==================== JSON ====================
 
+	// drop the masked paths before the inner JSON is written out
+	j.masking.DropPaths(outerJson.V)
+
 	// since the inner JSON can be anything, we unmarshal it into
 	// a string, so the json marshaler can do his thing and we
 	// dont have to care about what data is inside
@@ -187,13 +188,29 @@ func (j *JsonLogParser) Parse(state ServerlogParserState, src *ServerlogsSource,
 	// "ts"
 	//"pid", "tid",
 	//"sev", "req", "sess", "site", "user",
-	//"k", "v", "elapsed_ms", "start_ts"
-	w.WriteParsed(src, []string{
+	//"k", "v", "elapsed_ms", "start_ts",
+	//"a", "e", "extras"
+	fields := []string{
 		outerJson.Ts,
 		strconv.Itoa(outerJson.Pid), outerJson.Tid, // the tid is already a string
 		outerJson.Sev, outerJson.Req, outerJson.Sess, outerJson.Site, outerJson.User,
 		outerJson.K, v, elapsed, start_ts,
-	})
+		newerFields.A, newerFields.E, newerFields.Extras,
+	}
+	j.masking.MaskFields(j.Header(), fields)
+	w.WriteParsed(src, fields)
+
+	// ==================== Side tables ====================
+
+	if sideWriter, ok := w.(SideTableWriter); ok {
+		row := make(map[string]string, len(fields))
+		for i, column := range j.Header() {
+			row[column] = fields[i]
+		}
+		if err := writeJsonLogSideRows(sideWriter, src, row, outerJson.V, j.masking); err != nil {
+			log.Errorf("Error writing side tables file=%s host=%s k=%s err=%s", src.Filename, src.Host, outerJson.K, err)
+		}
+	}
 
 	return nil
 
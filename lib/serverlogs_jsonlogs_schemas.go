@@ -0,0 +1,222 @@
+package insight_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON log schemas
+// ----------------
+//
+// The newer Tableau (and Hyper) logs have a decimal tid, timestamps with a
+// timezone offset and more top-level keys (like 'a' and 'e'). The schema is
+// detected from the first line of each log file and kept in the parser state.
+
+const (
+	jsonLogSchemaClassic = "classic"
+	jsonLogSchemaNewer   = "newer"
+)
+
+// The top-level keys of the classic logs
+var classicJsonLogKeys = map[string]bool{
+	"ts": true, "pid": true, "tid": true,
+	"sev": true, "req": true, "sess": true, "site": true, "user": true,
+	"k": true, "v": true,
+}
+
+// Timestamps ending in a timezone offset (like '+02:00' or 'Z')
+var jsonLogTsOffsetRegexp = regexp.MustCompile(`(Z|[+-]\d{2}:?\d{2})$`)
+
+var jsonLogTsOffsetFormats = []string{
+	"2006-01-02T15:04:05.999Z07:00",
+	"2006-01-02T15:04:05.999Z0700",
+}
+
+func jsonLogSchemaKey(src *ServerlogsSource) string {
+	return fmt.Sprintf("jsonlogs.schema:%s|%s", src.Host, src.Filename)
+}
+
+// Returns the schema of the log file of a line. The schema is detected from
+// the line if it is the first line of its file.
+func detectJsonLogSchema(state ServerlogParserState, src *ServerlogsSource, line string) string {
+	key := jsonLogSchemaKey(src)
+	if schema, hasSchema := state.Get(key); hasSchema {
+		return string(schema)
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		// broken lines dont tell the schema, the next line may
+		return jsonLogSchemaClassic
+	}
+
+	schema := jsonLogSchemaClassic
+	if isNewerJsonLog(fields) {
+		schema = jsonLogSchemaNewer
+	}
+	state.Set(key, []byte(schema))
+	return schema
+}
+
+func isNewerJsonLog(fields map[string]json.RawMessage) bool {
+	for key := range fields {
+		if !classicJsonLogKeys[key] {
+			return true
+		}
+	}
+
+	// the classic tid is a hex string
+	if tid := bytes.TrimSpace(fields["tid"]); len(tid) > 0 && tid[0] != '"' {
+		return true
+	}
+
+	var ts string
+	if json.Unmarshal(fields["ts"], &ts) == nil && jsonLogTsOffsetRegexp.MatchString(ts) {
+		return true
+	}
+	return false
+}
+
+// Classic schema
+// --------------
+
+func parseClassicJsonLogLine(line string, tz *time.Location) (*ServerlogOuterJson, error) {
+	outerJson := &ServerlogOuterJson{}
+	err := json.NewDecoder(strings.NewReader(line)).Decode(outerJson)
+	if err != nil {
+		return nil, fmt.Errorf("JSON parse error in '%s': %v", line, err)
+	}
+
+	// convert the tid
+	if outerJson.Tid, err = hexToDecimal(outerJson.Tid); err != nil {
+		return nil, fmt.Errorf("Tid Parse error: %v", err)
+	}
+
+	tsUtc, err := convertTimestringToUTC(jsonDateFormat, outerJson.Ts, tz)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing log timestamp: %v", err)
+	}
+
+	// Re-assign the converted timestamp
+	outerJson.Ts = tsUtc
+	return outerJson, nil
+}
+
+// Newer schema
+// ------------
+
+// The columns of the newer logs not in the classic logs (as JSON)
+type jsonLogNewerFields struct {
+	A, E string
+	// The top-level keys not known by the parser
+	Extras string
+}
+
+func parseNewerJsonLogLine(line string, tz *time.Location) (*ServerlogOuterJson, *jsonLogNewerFields, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return nil, nil, fmt.Errorf("JSON parse error in '%s': %v", line, err)
+	}
+
+	outerJson := &ServerlogOuterJson{}
+	newerFields := &jsonLogNewerFields{}
+	extras := map[string]json.RawMessage{}
+
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "ts":
+			err = json.Unmarshal(value, &outerJson.Ts)
+		case "pid":
+			outerJson.Pid, err = strconv.Atoi(jsonLogString(value))
+		case "tid":
+			outerJson.Tid, err = decimalTid(value)
+		case "sev":
+			outerJson.Sev = jsonLogString(value)
+		case "req":
+			outerJson.Req = jsonLogString(value)
+		case "sess":
+			outerJson.Sess = jsonLogString(value)
+		case "site":
+			outerJson.Site = jsonLogString(value)
+		case "user":
+			outerJson.User = jsonLogString(value)
+		case "k":
+			outerJson.K = jsonLogString(value)
+		case "v":
+			err = json.Unmarshal(value, &outerJson.V)
+		case "a":
+			newerFields.A = string(value)
+		case "e":
+			newerFields.E = string(value)
+		default:
+			extras[key] = value
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error parsing '%s' in '%s': %v", key, line, err)
+		}
+	}
+
+	if len(extras) > 0 {
+		extrasJson, err := json.Marshal(extras)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error encoding extra keys: %v", err)
+		}
+		newerFields.Extras = string(extrasJson)
+	}
+
+	tsUtc, err := convertJsonLogTimestamp(outerJson.Ts, tz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parsing log timestamp: %v", err)
+	}
+	outerJson.Ts = tsUtc
+
+	return outerJson, newerFields, nil
+}
+
+// Returns a JSON string value unquoted, any other value as JSON
+func jsonLogString(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	return string(bytes.TrimSpace(value))
+}
+
+// Returns the tid as a decimal string. The tid is decided by its JSON type:
+// the numbers (of the newer logs) are decimal, the strings (of the classic
+// logs) are hex even if they only have digits.
+func decimalTid(value json.RawMessage) (string, error) {
+	var hexTid string
+	if err := json.Unmarshal(value, &hexTid); err == nil {
+		return hexToDecimal(hexTid)
+	}
+
+	tid := string(bytes.TrimSpace(value))
+	if _, err := strconv.ParseInt(tid, 10, 64); err != nil {
+		return "", fmt.Errorf("Invalid tid '%s': %v", tid, err)
+	}
+	return tid, nil
+}
+
+// Converts a timestamp with an offset to UTC. Timestamps without an offset
+// are in the timezone of the host.
+func convertJsonLogTimestamp(ts string, tz *time.Location) (string, error) {
+	if !jsonLogTsOffsetRegexp.MatchString(ts) {
+		return convertTimestringToUTC(jsonDateFormat, ts, tz)
+	}
+
+	var err error
+	for _, format := range jsonLogTsOffsetFormats {
+		var parsed time.Time
+		if parsed, err = time.Parse(format, ts); err == nil {
+			return parsed.UTC().Format(jsonDateFormat), nil
+		}
+	}
+	return "", fmt.Errorf("Parsing timestamp '%s' with an offset: %v", ts, err)
+}
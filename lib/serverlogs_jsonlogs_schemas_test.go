@@ -0,0 +1,75 @@
+package insight_server
+
+import (
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestJsonLogParser_NewerSchema(t *testing.T) {
+	state := MakeServerlogParserState()
+	src := &ServerlogsSource{Host: "host1", Filename: "hyper_0.log", Timezone: time.UTC}
+	parser := &JsonLogParser{}
+	w := &collectingServerlogWriter{}
+
+	for _, line := range []string{
+		`{"ts":"2023-05-10T12:34:56.789+02:00","pid":4242,"tid":123456,"sev":"info","req":"-","sess":"S1","site":"-","user":"-","k":"query-end","a":{"depth":1},"e":{"id":"x"},"ctx":{"db":"d"},"v":{"elapsed":0.5}}`,
+		// the later lines of the file use the same schema
+		`{"ts":"2023-05-10T10:35:00Z","pid":4242,"tid":"99","sev":"info","req":"-","sess":"S1","site":"-","user":"-","k":"log","v":"text"}`,
+	} {
+		tassert.Nil(t, parser.Parse(state, src, line, w))
+	}
+	tassert.Len(t, w.errors, 0)
+
+	tassert.Equal(t, []string{
+		"hyper_0.log", "2023-05-10T10:34:56.789", "4242", "123456", "info", "-", "S1", "-", "-",
+		"query-end", `{"elapsed":0.5}`, "500", "2023-05-10T10:34:56.289",
+		`{"depth":1}`, `{"id":"x"}`, `{"ctx":{"db":"d"}}`,
+	}, w.parsed[0])
+	// a string tid is hex even in the newer logs
+	tassert.Equal(t, "153", w.parsed[1][3])
+	tassert.Equal(t, "", w.parsed[1][15])
+
+	// the classic files of the same upload keep their schema
+	classic := &ServerlogsSource{Host: "host1", Filename: "vizqlserver_1-0.log", Timezone: time.UTC}
+	tassert.Nil(t, parser.Parse(state, classic, `{"ts":"2016-03-25T00:59:10.599","pid":11540,"tid":"5640","sev":"info","req":"-","sess":"-","site":"-","user":"-","k":"log","v":"text"}`, w))
+	tassert.Equal(t, "22080", w.parsed[2][3])
+	tassert.Len(t, w.parsed[2], 16)
+}
+
+func TestDetectJsonLogSchema(t *testing.T) {
+	for line, schema := range map[string]string{
+		`{"ts":"2016-03-25T00:59:10.599","pid":1,"tid":"5640","k":"log","v":{}}`:      jsonLogSchemaClassic,
+		`{"ts":"2016-03-25T00:59:10.599","pid":1,"tid":5640,"k":"log","v":{}}`:        jsonLogSchemaNewer,
+		`{"ts":"2016-03-25T00:59:10.599+0100","pid":1,"tid":"5640","k":"log","v":{}}`: jsonLogSchemaNewer,
+		`{"ts":"2016-03-25T00:59:10.599","pid":1,"tid":"5640","e":{},"v":{}}`:         jsonLogSchemaNewer,
+		`not json`: jsonLogSchemaClassic,
+	} {
+		src := &ServerlogsSource{Host: "host1", Filename: "a.log"}
+		tassert.Equal(t, schema, detectJsonLogSchema(MakeServerlogParserState(), src, line), line)
+	}
+}
+
+func TestDecimalTid(t *testing.T) {
+	for value, tid := range map[string]string{
+		`1234`:   "1234",
+		`"1234"`: "4660",
+		`"1a2b"`: "6699",
+	} {
+		decimal, err := decimalTid([]byte(value))
+		tassert.Nil(t, err, value)
+		tassert.Equal(t, tid, decimal, value)
+	}
+
+	_, err := decimalTid([]byte(`12.5`))
+	tassert.NotNil(t, err)
+
+	// an all digit hex tid in a file detected as newer by its keys
+	state := MakeServerlogParserState()
+	w := &collectingServerlogWriter{}
+	src := &ServerlogsSource{Host: "host1", Filename: "vizqlserver_1-0.log", Timezone: time.UTC}
+	tassert.Nil(t, (&JsonLogParser{}).Parse(state, src, `{"ts":"2016-03-25T00:59:10.599","pid":1,"tid":"1234","sev":"info","k":"log","e":{},"v":{}}`, w))
+	tassert.Len(t, w.errors, 0)
+	tassert.Equal(t, "4660", w.parsed[0][3])
+}
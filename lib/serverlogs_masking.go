@@ -0,0 +1,275 @@
+package insight_server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Masking
+// =======
+//
+// The serverlogs contain user names, emails, SQL literals and paths from the
+// sites of the customers. The masking rules from the configuration are
+// applied by the parsers to the parsed rows before they are written, and to
+// the rows of the error tables.
+
+// The types of the masking rules
+const (
+	// Replaces the matches of a regexp
+	MaskingRuleRegex = "regex"
+	// Replaces the values with their keyed hash
+	MaskingRuleHmac = "hmac"
+	// Drops paths from the JSON values of the 'v' column
+	MaskingRuleDrop = "drop"
+)
+
+// The columns the regex rules apply to when no columns are given
+var defaultMaskingColumns = []string{"v", "line", "message"}
+
+// A masking rule from the configuration
+type MaskingRuleConfig struct {
+	Type string `json:"type"`
+
+	// The columns of the parsed rows the rule applies to (regex and hmac
+	// rules). The regex rules apply to the v, line and message columns by
+	// default.
+	Columns []string `json:"columns,omitempty"`
+
+	// The regexp and its replacement (regex rules)
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	// The dot separated paths in the 'v' column (drop rules)
+	Paths []string `json:"paths,omitempty"`
+}
+
+type maskingRule struct {
+	MaskingRuleConfig
+
+	pattern *regexp.Regexp
+	columns map[string]bool
+	paths   [][]string
+}
+
+// The compiled masking rules, applied in the order of the configuration
+type MaskingRules struct {
+	rules []*maskingRule
+	// The key of the hmac rules
+	key []byte
+}
+
+// Loads the masking rules from a JSON file. The key is used by the hmac
+// rules.
+func LoadMaskingRules(fileName, key string) (*MaskingRules, error) {
+	rulesFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening masking rules file '%s': %v", fileName, err)
+	}
+	defer rulesFile.Close()
+
+	configs := []MaskingRuleConfig{}
+	if err := json.NewDecoder(rulesFile).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("Error parsing masking rules file '%s': %v", fileName, err)
+	}
+	return MakeMaskingRules(configs, key)
+}
+
+// Compiles the masking rules and checks them
+func MakeMaskingRules(configs []MaskingRuleConfig, key string) (*MaskingRules, error) {
+	o := &MaskingRules{key: []byte(key)}
+	for i, config := range configs {
+		rule := &maskingRule{MaskingRuleConfig: config, columns: map[string]bool{}}
+
+		columns := config.Columns
+		switch config.Type {
+		case MaskingRuleRegex:
+			pattern, err := regexp.Compile(config.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern in masking rule %d '%s': %v", i, config.Pattern, err)
+			}
+			rule.pattern = pattern
+			if len(columns) == 0 {
+				columns = defaultMaskingColumns
+			}
+		case MaskingRuleHmac:
+			if key == "" {
+				return nil, fmt.Errorf("No masking key given for the hmac masking rule %d", i)
+			}
+			if len(columns) == 0 {
+				return nil, fmt.Errorf("No columns given for the hmac masking rule %d", i)
+			}
+		case MaskingRuleDrop:
+			if len(config.Paths) == 0 {
+				return nil, fmt.Errorf("No paths given for the drop masking rule %d", i)
+			}
+			for _, path := range config.Paths {
+				rule.paths = append(rule.paths, strings.Split(path, "."))
+			}
+		default:
+			return nil, fmt.Errorf("Unknown type '%s' of masking rule %d", config.Type, i)
+		}
+
+		for _, column := range columns {
+			rule.columns[column] = true
+		}
+		o.rules = append(o.rules, rule)
+	}
+	return o, nil
+}
+
+// Masks a value of a column
+func (m *MaskingRules) maskColumn(column, value string) string {
+	if m == nil || value == "" {
+		return value
+	}
+	for _, rule := range m.rules {
+		if !rule.columns[column] {
+			continue
+		}
+		switch rule.Type {
+		case MaskingRuleRegex:
+			value = rule.pattern.ReplaceAllString(value, rule.Replacement)
+		case MaskingRuleHmac:
+			// keep the placeholders Tableau uses for no user
+			if value != "-" {
+				mac := hmac.New(sha256.New, m.key)
+				mac.Write([]byte(value))
+				value = hex.EncodeToString(mac.Sum(nil))
+			}
+		}
+	}
+	return value
+}
+
+// Masks the fields of a parsed row in place. The header has the names of
+// the fields.
+func (m *MaskingRules) MaskFields(header, fields []string) {
+	if m == nil {
+		return
+	}
+	for i, column := range header {
+		if i < len(fields) {
+			fields[i] = m.maskColumn(column, fields[i])
+		}
+	}
+}
+
+// Masks the text of an error row with all the regex rules (the error rows
+// are not split into columns)
+func (m *MaskingRules) MaskText(text string) string {
+	if m == nil {
+		return text
+	}
+	for _, rule := range m.rules {
+		if rule.Type == MaskingRuleRegex {
+			text = rule.pattern.ReplaceAllString(text, rule.Replacement)
+		}
+	}
+	return text
+}
+
+// Returns true if there are hmac or drop rules (the rules needing the
+// columns of a row)
+func (m *MaskingRules) hasColumnRules() bool {
+	if m == nil {
+		return false
+	}
+	for _, rule := range m.rules {
+		if rule.Type != MaskingRuleRegex {
+			return true
+		}
+	}
+	return false
+}
+
+// Masks the raw line of an error row. JSON lines get the hmac rules applied
+// to their keys and the drop rules to their 'v' value before the regex
+// rules. Other lines cannot be masked by column, so they are dropped if there
+// are hmac or drop rules.
+func (m *MaskingRules) MaskLine(line string) string {
+	if !m.hasColumnRules() {
+		return m.MaskText(line)
+	}
+
+	var object map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		return ""
+	}
+
+	for key, value := range object {
+		switch value := value.(type) {
+		case string:
+			object[key] = m.maskColumn(key, value)
+		case json.Number:
+			object[key] = m.maskColumn(key, value.String())
+		}
+	}
+	m.DropPaths(object["v"])
+
+	masked, err := json.Marshal(object)
+	if err != nil {
+		return ""
+	}
+	return m.MaskText(string(masked))
+}
+
+// Drops the paths of the drop rules from the decoded value of 'v'
+func (m *MaskingRules) DropPaths(v interface{}) {
+	if m == nil {
+		return
+	}
+	for _, rule := range m.rules {
+		for _, path := range rule.paths {
+			dropJsonPath(v, path)
+		}
+	}
+}
+
+func dropJsonPath(v interface{}, path []string) {
+	object, isObject := v.(map[string]interface{})
+	if !isObject || len(path) == 0 {
+		return
+	}
+	if len(path) == 1 {
+		delete(object, path[0])
+		return
+	}
+	dropJsonPath(object[path[0]], path[1:])
+}
+
+// Error rows
+// ----------
+
+// Masks the rows written to the error tables
+type maskingServerlogWriter struct {
+	ServerlogWriter
+	masking *MaskingRules
+}
+
+func (w *maskingServerlogWriter) WriteError(source *ServerlogsSource, parseErr error, line string) error {
+	return w.ServerlogWriter.WriteError(source, fmt.Errorf("%s", w.masking.MaskText(fmt.Sprint(parseErr))), w.masking.MaskLine(line))
+}
+
+func (w *maskingServerlogWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	if sideWriter, ok := w.ServerlogWriter.(SideTableWriter); ok {
+		return sideWriter.WriteSide(source, table, headers, fields)
+	}
+	return nil
+}
+
+// Wraps the writer so its error rows are masked. Returns the writer itself
+// if there are no masking rules.
+func maskErrorRows(w ServerlogWriter, masking *MaskingRules) ServerlogWriter {
+	if masking == nil {
+		return w
+	}
+	return &maskingServerlogWriter{ServerlogWriter: w, masking: masking}
+}
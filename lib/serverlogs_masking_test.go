@@ -0,0 +1,97 @@
+package insight_server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func makeTestMaskingRules(t *testing.T) *MaskingRules {
+	masking, err := MakeMaskingRules([]MaskingRuleConfig{
+		{Type: MaskingRuleRegex, Pattern: `[\w.+-]+@[\w-]+\.[\w.]+`, Replacement: "<email>"},
+		{Type: MaskingRuleHmac, Columns: []string{"user"}},
+		{Type: MaskingRuleDrop, Paths: []string{"connection.password"}},
+	}, "secret")
+	tassert.Nil(t, err)
+	return masking
+}
+
+func TestMakeMaskingRules(t *testing.T) {
+	for _, config := range []MaskingRuleConfig{
+		{Type: "unknown"},
+		{Type: MaskingRuleRegex, Pattern: "("},
+		{Type: MaskingRuleHmac},
+		{Type: MaskingRuleDrop},
+	} {
+		_, err := MakeMaskingRules([]MaskingRuleConfig{config}, "secret")
+		tassert.NotNil(t, err, "%+v", config)
+	}
+
+	// no key for the hmac rules
+	_, err := MakeMaskingRules([]MaskingRuleConfig{{Type: MaskingRuleHmac, Columns: []string{"user"}}}, "")
+	tassert.NotNil(t, err)
+}
+
+func TestJsonLogParser_Masking(t *testing.T) {
+	masking := makeTestMaskingRules(t)
+	src := &ServerlogsSource{Host: "host1", Filename: "vizqlserver_1-0.log", Timezone: time.UTC}
+	parser := &JsonLogParser{masking: masking}
+	w := &collectingServerlogWriter{}
+
+	line := `{"ts":"2016-03-25T00:59:10.599","pid":11540,"tid":"5640","sev":"info","req":"R1","sess":"S1","site":"PGS","user":"jane","k":"end-query","v":{"query":"SELECT * FROM t WHERE email = 'jane@example.com'","connection":{"password":"hunter2","host":"db"}}}`
+	tassert.Nil(t, parser.Parse(MakeServerlogParserState(), src, line, w))
+
+	tassert.Len(t, w.parsed, 1)
+	user := w.parsed[0][8]
+	tassert.Len(t, user, 64)
+	tassert.Equal(t, masking.maskColumn("user", "jane"), user)
+	tassert.Equal(t, `{"connection":{"host":"db"},"query":"SELECT * FROM t WHERE email = '<email>'"}`, w.parsed[0][10])
+
+	// the side tables get the masked values
+	tassert.Equal(t, user, w.side["serverlogs_queries"][0][6])
+	tassert.Equal(t, "SELECT * FROM t WHERE email = '<email>'", w.side["serverlogs_queries"][0][7])
+}
+
+func TestPlainLogParser_Masking(t *testing.T) {
+	input := "filename\vhost\vline\n" +
+		"a.log\vhost1\v2016-10-07 15:48:25.123 (1234): Login of jane@example.com\n"
+
+	parser, err := MakePlainlogParser("")
+	tassert.Nil(t, err)
+	parser.masking = makeTestMaskingRules(t)
+
+	w := &collectingServerlogWriter{}
+	tassert.Nil(t, ParseServerlogsWith(strings.NewReader(input), parser, w, time.UTC))
+	tassert.Len(t, w.parsed, 1)
+	tassert.Equal(t, "Login of <email>", w.parsed[0][3])
+}
+
+func TestMaskingServerlogWriter_ErrorRows(t *testing.T) {
+	inner := &collectingServerlogWriter{}
+	w := maskErrorRows(inner, makeTestMaskingRules(t))
+
+	tassert.Nil(t, w.WriteError(&ServerlogsSource{}, errors.New("bad line"), "broken jane@example.com"))
+	// the plain lines cannot be masked by the hmac rules, they are dropped
+	tassert.Equal(t, []string{""}, inner.errors)
+
+	// the user is hashed, the password is dropped from the JSON lines
+	tassert.Nil(t, w.WriteError(&ServerlogsSource{}, errors.New("bad ts"),
+		`{"ts":"broken","user":"jane","v":{"connection":{"password":"secret","host":"db"},"to":"jane@example.com"}}`))
+	tassert.Len(t, inner.errors, 2)
+	tassert.NotContains(t, inner.errors[1], `"jane"`)
+	tassert.NotContains(t, inner.errors[1], "secret")
+	tassert.Contains(t, inner.errors[1], `"host":"db"`)
+	tassert.Contains(t, inner.errors[1], `"to":"<email>"`)
+	tassert.Contains(t, inner.errors[1], `"user":"`+makeTestMaskingRules(t).maskColumn("user", "jane")+`"`)
+
+	// only regex rules mask the plain lines
+	regexOnly, err := MakeMaskingRules([]MaskingRuleConfig{{Type: MaskingRuleRegex, Pattern: `jane@example\.com`, Replacement: "<email>"}}, "")
+	tassert.Nil(t, err)
+	tassert.Equal(t, "broken <email>", regexOnly.MaskLine("broken jane@example.com"))
+
+	// no rules, no wrapping
+	tassert.Equal(t, inner, maskErrorRows(inner, nil))
+}
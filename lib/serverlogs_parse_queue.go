@@ -0,0 +1,241 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Serverlogs parse queue
+// ======================
+//
+// Keeps the serverlog parse requests on disk (one JSON file per request), so
+// the archived serverlogs waiting for parsing when the server stops are
+// parsed after the next startup, and the outcome of each parse is recorded.
+
+// The statuses of the parse requests
+const (
+	ParseStatusPending    = "pending"
+	ParseStatusInProgress = "in-progress"
+	ParseStatusDone       = "done"
+	ParseStatusFailed     = "failed"
+)
+
+// A parse request in the queue
+type ServerlogsParseItem struct {
+	Id string `json:"id"`
+
+	ServerlogInput
+
+	Status string `json:"status"`
+	// The error of the last attempt if it failed
+	Error string `json:"error,omitempty"`
+	// The number of times parsing was started
+	Attempts int `json:"attempts"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type ServerlogsParseQueue struct {
+	directory string
+	// how long the finished requests are kept
+	maxAge time.Duration
+
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+const parseQueueItemExt = ".json"
+
+// How often the finished requests are pruned
+const parseQueuePruneInterval = time.Hour
+
+func NewServerlogsParseQueue(directory string, maxAge time.Duration) (*ServerlogsParseQueue, error) {
+	if err := CreateDirectoryIfNotExists(directory); err != nil {
+		return nil, fmt.Errorf("Error creating parse queue directory '%s': %v", directory, err)
+	}
+
+	q := &ServerlogsParseQueue{directory: directory, maxAge: maxAge, lastPrune: time.Now()}
+	q.prune()
+	return q, nil
+}
+
+func (q *ServerlogsParseQueue) itemFile(id string) string {
+	return filepath.Join(q.directory, SanitizeName(id)+parseQueueItemExt)
+}
+
+// Adds a new pending parse request. If the queue is nil, the request is
+// only kept in memory.
+func (q *ServerlogsParseQueue) Add(input ServerlogInput) (*ServerlogsParseItem, error) {
+	now := time.Now().UTC()
+	item := &ServerlogsParseItem{
+		Id:             makeRandomId(),
+		ServerlogInput: input,
+		Status:         ParseStatusPending,
+		Created:        now,
+		Updated:        now,
+	}
+	if q == nil {
+		return item, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if time.Since(q.lastPrune) > parseQueuePruneInterval {
+		q.lastPrune = time.Now()
+		go q.prune()
+	}
+
+	if err := q.writeItem(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Marks a request as being parsed
+func (q *ServerlogsParseQueue) Start(item *ServerlogsParseItem) {
+	item.Status = ParseStatusInProgress
+	item.Attempts++
+	item.Updated = time.Now().UTC()
+	q.update(item)
+}
+
+// Marks a request as done or failed depending on the error
+func (q *ServerlogsParseQueue) Finish(item *ServerlogsParseItem, parseErr error) {
+	item.Status = ParseStatusDone
+	item.Error = ""
+	if parseErr != nil {
+		item.Status = ParseStatusFailed
+		item.Error = fmt.Sprint(parseErr)
+	}
+	item.Updated = time.Now().UTC()
+	q.update(item)
+}
+
+// Writes the status of a request. The request is still parsed if this fails,
+// so errors are only logged.
+func (q *ServerlogsParseQueue) update(item *ServerlogsParseItem) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.writeItem(item); err != nil {
+		log.Errorf("Error updating parse request. id=%s status=%s err=%s", item.Id, item.Status, err)
+	}
+}
+
+// Writes a request through a temp file, so the file is either complete or
+// missing
+func (q *ServerlogsParseQueue) writeItem(item *ServerlogsParseItem) error {
+	tmpFile, err := ioutil.TempFile(q.directory, "parse-queue-item")
+	if err != nil {
+		return fmt.Errorf("Error opening temp file: %v", err)
+	}
+	defer tmpFile.Close()
+
+	if err := json.NewEncoder(tmpFile).Encode(item); err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Error serializing parse request: %v", err)
+	}
+
+	// close the temp file so we flush
+	tmpFile.Close()
+
+	if err := os.Rename(tmpFile.Name(), q.itemFile(item.Id)); err != nil {
+		return fmt.Errorf("Error while moving parse request '%s' to '%s': %v", tmpFile.Name(), q.itemFile(item.Id), err)
+	}
+	return nil
+}
+
+// Returns all requests in the queue, the oldest first
+func (q *ServerlogsParseQueue) List() ([]*ServerlogsParseItem, error) {
+	if q == nil {
+		return []*ServerlogsParseItem{}, nil
+	}
+
+	files, err := ioutil.ReadDir(q.directory)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing parse queue directory '%s': %v", q.directory, err)
+	}
+
+	o := []*ServerlogsParseItem{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != parseQueueItemExt {
+			continue
+		}
+		item, err := q.Get(strings.TrimSuffix(file.Name(), parseQueueItemExt))
+		if err != nil {
+			log.Errorf("Skipping invalid parse request. file=%s err=%s", file.Name(), err)
+			continue
+		}
+		o = append(o, item)
+	}
+
+	sort.Slice(o, func(i, j int) bool { return o[i].Created.Before(o[j].Created) })
+	return o, nil
+}
+
+// Loads a request
+func (q *ServerlogsParseQueue) Get(id string) (*ServerlogsParseItem, error) {
+	itemFile, err := os.Open(q.itemFile(id))
+	if err != nil {
+		return nil, err
+	}
+	defer itemFile.Close()
+
+	item := &ServerlogsParseItem{}
+	if err := json.NewDecoder(itemFile).Decode(item); err != nil {
+		return nil, fmt.Errorf("Error loading parse request '%s': %v", id, err)
+	}
+	return item, nil
+}
+
+// Returns the requests that were not parsed yet: the pending ones and the
+// ones interrupted while in progress, the oldest first
+func (q *ServerlogsParseQueue) Unfinished() ([]*ServerlogsParseItem, error) {
+	items, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+
+	o := []*ServerlogsParseItem{}
+	for _, item := range items {
+		if item.Status == ParseStatusPending || item.Status == ParseStatusInProgress {
+			o = append(o, item)
+		}
+	}
+	return o, nil
+}
+
+// Removes the requests finished successfully before maxAge. The failed ones
+// are kept until they are parsed again (or removed by hand).
+func (q *ServerlogsParseQueue) prune() {
+	items, err := q.List()
+	if err != nil {
+		log.Errorf("Error pruning parse queue. err=%s", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-q.maxAge)
+	for _, item := range items {
+		if item.Status != ParseStatusDone || item.Updated.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(q.itemFile(item.Id)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing parse request. id=%s err=%s", item.Id, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package insight_server
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestServerlogsParseQueue_Statuses(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	queue, err := NewServerlogsParseQueue(filepath.Join(env.TmpDir, "parse-queue"), time.Hour)
+	tassert.Nil(t, err)
+
+	meta := makeTestUploadMeta("")
+	meta.Timezone = time.UTC
+	meta.TableName = "serverlogs"
+
+	first, err := queue.Add(ServerlogInput{Meta: meta, ArchivedFile: "first.csv.gz", Format: LogFormatJson})
+	tassert.Nil(t, err)
+	second, err := queue.Add(ServerlogInput{Meta: meta, ArchivedFile: "second.csv.gz", Format: LogFormatPlain})
+	tassert.Nil(t, err)
+
+	queue.Start(first)
+	queue.Finish(first, fmt.Errorf("Bad serverlog"))
+	queue.Start(second)
+
+	// the in-progress one was interrupted
+	unfinished, err := queue.Unfinished()
+	tassert.Nil(t, err)
+	tassert.Len(t, unfinished, 1)
+	tassert.Equal(t, "second.csv.gz", unfinished[0].ArchivedFile)
+	tassert.Equal(t, LogFormatPlain, unfinished[0].Format)
+	tassert.Equal(t, "serverlogs", unfinished[0].Meta.TableName)
+	tassert.Equal(t, time.UTC, unfinished[0].Meta.Timezone)
+
+	loaded, err := queue.Get(first.Id)
+	tassert.Nil(t, err)
+	tassert.Equal(t, ParseStatusFailed, loaded.Status)
+	tassert.Equal(t, "Bad serverlog", loaded.Error)
+	tassert.Equal(t, 1, loaded.Attempts)
+}
+
+func TestServerlogsParserPool_Replay(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	queue, err := NewServerlogsParseQueue(filepath.Join(env.TmpDir, "parse-queue"), time.Hour)
+	tassert.Nil(t, err)
+	env.ParseQueue = queue
+
+	meta := makeTestUploadMeta("")
+	meta.Timezone = time.UTC
+	meta.TableName = "serverlogs"
+
+	// left over by the previous run (more than the queue holds), the archived
+	// files are gone so they fail
+	items := []*ServerlogsParseItem{}
+	for i := 0; i < 3; i++ {
+		item, err := queue.Add(ServerlogInput{Meta: meta, ArchivedFile: filepath.Join(env.TmpDir, fmt.Sprintf("missing-%d.csv.gz", i))})
+		tassert.Nil(t, err)
+		items = append(items, item)
+	}
+
+	// interrupted while parsing, it is not parsed again
+	interrupted, err := queue.Add(ServerlogInput{Meta: meta, ArchivedFile: filepath.Join(env.TmpDir, "interrupted.csv.gz")})
+	tassert.Nil(t, err)
+	queue.Start(interrupted)
+
+	pool, err := MakeServerlogsParser(env, 1, 1)
+	tassert.Nil(t, err)
+
+	for _, item := range items {
+		for i := 0; i < 100; i++ {
+			if item, err = queue.Get(item.Id); err == nil && item.Status == ParseStatusFailed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		tassert.Equal(t, ParseStatusFailed, item.Status)
+		tassert.Equal(t, 1, item.Attempts)
+	}
+
+	interrupted, err = queue.Get(interrupted.Id)
+	tassert.Nil(t, err)
+	tassert.Equal(t, ParseStatusFailed, interrupted.Status)
+	tassert.Equal(t, errParseInterrupted.Error(), interrupted.Error)
+	tassert.Equal(t, 1, interrupted.Attempts)
+
+	// new files are accepted once the old ones are queued
+	<-pool.replayed
+	tassert.True(t, pool.Reserve(meta))
+}
+
+func TestServerlogsParserPool_ReserveWhileReplaying(t *testing.T) {
+	pool := &ServerlogsParserPool{
+		queues:   []chan *ServerlogsParseItem{make(chan *ServerlogsParseItem, 1)},
+		slots:    []chan struct{}{make(chan struct{}, 1)},
+		replayed: make(chan struct{}),
+	}
+	meta := makeTestUploadMeta("")
+
+	tassert.False(t, pool.Reserve(meta))
+	close(pool.replayed)
+	tassert.True(t, pool.Reserve(meta))
+}
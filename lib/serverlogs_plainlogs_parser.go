@@ -4,14 +4,16 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 // Plain logs
 // ----------
 
 var (
-	plainLineParserRegexp  = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}.[0-9]{3}) \(([0-9]+)\): (.*)$`)
-	plainLineElapsedRegexp = regexp.MustCompile(`^.*Elapsed time:(\d+\.\d+)s.*`)
+	plainLineParserRegexp = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}.[0-9]{3}) \(([0-9]+)\): (.*)$`)
+	// (?s) so the elapsed time is found in any line of multi-line entries
+	plainLineElapsedRegexp = regexp.MustCompile(`(?s)^.*Elapsed time:(\d+\.\d+)s.*`)
 )
 
 const (
@@ -22,6 +24,8 @@ const (
 // The key of the pid header in the parser state
 
 type PlainLogParser struct {
+	// The masking rules applied to the parsed rows (can be nil)
+	masking *MaskingRules
 }
 
 func MakePlainlogParser(dbDirectory string) (*PlainLogParser, error) {
@@ -35,13 +39,96 @@ func (p *PlainLogParser) Header() []string {
 	}
 }
 
+// Multi-line entries
+// ------------------
+//
+// Lines not starting with a timestamp and a pid (like the lines of stack
+// traces) are continuations of the previous entry of the same log file. The
+// entries are kept in the parser state until the next entry (or the end of
+// the upload) arrives, and are written out with their lines joined.
+
+// An entry waiting for its continuation lines
+type plainLogEntry struct {
+	ts, pid string
+	lines   []string
+}
+
+// The log files with entries waiting
+type plainLogSource struct {
+	host, filename string
+}
+
+// The entries waiting, kept in the state as they are so the continuation
+// lines are only appended
+type plainLogPending struct {
+	entries map[plainLogSource]*plainLogEntry
+	// the log files in the order they were seen
+	sources []plainLogSource
+	known   map[plainLogSource]bool
+}
+
+const plainPendingKey = "plainlogs.pending"
+
+// Returns the entries waiting in the state
+func getPlainLogPending(state ServerlogParserState) *plainLogPending {
+	if value, _ := state.Value(plainPendingKey); value != nil {
+		return value.(*plainLogPending)
+	}
+	pending := &plainLogPending{entries: map[plainLogSource]*plainLogEntry{}, known: map[plainLogSource]bool{}}
+	state.SetValue(plainPendingKey, pending)
+	return pending
+}
+
+// Writes out the entry waiting for the log file (if there is one)
+func (p *PlainLogParser) flushEntry(pending *plainLogPending, src *ServerlogsSource, w ServerlogWriter) error {
+	source := plainLogSource{src.Host, src.Filename}
+	entry, hasEntry := pending.entries[source]
+	if !hasEntry {
+		return nil
+	}
+	delete(pending.entries, source)
+	line := strings.Join(entry.lines, "\n")
+
+	// Get the elapsed time from the whole entry
+	elapsedMs, err := getElapsedFromPlainlogs(line)
+	var elapsed, start_ts string
+	if err == nil {
+		elapsed = strconv.FormatInt(elapsedMs, 10)
+		start_ts = getStartTime(entry.ts, elapsedMs)
+	} else {
+		elapsed = "0"
+		start_ts = entry.ts
+	}
+
+	// Write the parsed line out (make sure its in the right order)
+	fields := []string{entry.ts, entry.pid, line, elapsed, start_ts}
+	p.masking.MaskFields(p.Header(), fields)
+	return w.WriteParsed(src, fields)
+}
+
+// Keeps an entry in the state until its continuation lines arrive
+func (p *PlainLogParser) holdEntry(pending *plainLogPending, src *ServerlogsSource, entry *plainLogEntry) {
+	source := plainLogSource{src.Host, src.Filename}
+	if !pending.known[source] {
+		pending.known[source] = true
+		pending.sources = append(pending.sources, source)
+	}
+	pending.entries[source] = entry
+}
+
 // Parses a plaintext log line
 func (p *PlainLogParser) Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error {
 
 	// try to extract the timestamp
 	matches := plainLineParserRegexp.FindAllStringSubmatch(line, -1)
 	if len(matches) != 1 {
-		return fmt.Errorf("Error in regex matching log line: got %d row instead of 1", len(matches))
+		// continue the previous entry of this log file if there is one
+		entry, hasEntry := getPlainLogPending(state).entries[plainLogSource{src.Host, src.Filename}]
+		if !hasEntry {
+			return fmt.Errorf("Error in regex matching log line: got %d row instead of 1", len(matches))
+		}
+		entry.lines = append(entry.lines, line)
+		return nil
 	}
 
 	// get the parts
@@ -60,23 +147,26 @@ func (p *PlainLogParser) Parse(state ServerlogParserState, src *ServerlogsSource
 		return fmt.Errorf("Error parsing pid '%s': %v", pid, err)
 	}
 
-	// ==================== Elapsed ====================
+	// ==================== Emitting the line ====================
 
-	// Get the elapsed time
-	elapsedMs, err := getElapsedFromPlainlogs(line)
-	var elapsed, start_ts string
-	if err == nil {
-		elapsed = strconv.FormatInt(elapsedMs, 10)
-		start_ts = getStartTime(tsUtc, elapsedMs)
-	} else {
-		elapsed = "0"
-		start_ts = tsUtc
+	// a new entry starts, so the previous one is complete
+	pending := getPlainLogPending(state)
+	if err := p.flushEntry(pending, src, w); err != nil {
+		return err
 	}
 
-	// ==================== Emitting the line ====================
-
-	// Write the parsed line out (make sure its in the right order)
-	w.WriteParsed(src, []string{tsUtc, pid, line, elapsed, start_ts})
+	p.holdEntry(pending, src, &plainLogEntry{ts: tsUtc, pid: pid, lines: []string{line}})
+	return nil
+}
 
+// Writes out the entries still waiting at the end of the upload
+func (p *PlainLogParser) Finish(state ServerlogParserState, w ServerlogWriter) error {
+	pending := getPlainLogPending(state)
+	for _, source := range pending.sources {
+		if err := p.flushEntry(pending, &ServerlogsSource{Host: source.host, Filename: source.filename}, w); err != nil {
+			return err
+		}
+	}
+	state.SetValue(plainPendingKey, nil)
 	return nil
 }
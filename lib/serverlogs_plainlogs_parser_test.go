@@ -0,0 +1,76 @@
+package insight_server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+// Writer collecting the rows in memory
+type collectingServerlogWriter struct {
+	parsed [][]string
+	errors []string
+	// the side rows by table
+	side map[string][][]string
+}
+
+func (c *collectingServerlogWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	c.parsed = append(c.parsed, append([]string{source.Filename}, fields...))
+	return nil
+}
+func (c *collectingServerlogWriter) WriteError(source *ServerlogsSource, err error, line string) error {
+	c.errors = append(c.errors, line)
+	return nil
+}
+func (c *collectingServerlogWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	if c.side == nil {
+		c.side = map[string][][]string{}
+	}
+	c.side[table] = append(c.side[table], fields)
+	return nil
+}
+func (c *collectingServerlogWriter) Close() error        { return nil }
+func (c *collectingServerlogWriter) ParsedRowCount() int { return len(c.parsed) }
+func (c *collectingServerlogWriter) ErrorRowCount() int  { return len(c.errors) }
+
+func TestPlainLogParser_MultiLine(t *testing.T) {
+	input := "filename\vhost\vline\n" +
+		// a continuation before any entry
+		"a.log\vhost1\v   at nowhere\n" +
+		"a.log\vhost1\v2016-10-07 15:48:25.123 (1234): Exception thrown\n" +
+		"b.log\vhost1\v2016-10-07 15:48:25.200 (42): Single line\n" +
+		"a.log\vhost1\v   at Foo.Bar()\n" +
+		"a.log\vhost1\v   Elapsed time:1.500s\n" +
+		"a.log\vhost1\v2016-10-07 15:48:26.000 (1234): Next entry\n"
+
+	parser, err := MakePlainlogParser("")
+	tassert.Nil(t, err)
+
+	w := &collectingServerlogWriter{}
+	tassert.Nil(t, ParseServerlogsWith(strings.NewReader(input), parser, w, time.UTC))
+
+	tassert.Equal(t, []string{"   at nowhere"}, w.errors)
+	tassert.Equal(t, [][]string{
+		{"a.log", "2016-10-07T15:48:25.123", "1234", "Exception thrown\n   at Foo.Bar()\n   Elapsed time:1.500s", "1500", "2016-10-07T15:48:23.623"},
+		{"a.log", "2016-10-07T15:48:26", "1234", "Next entry", "0", "2016-10-07T15:48:26"},
+		{"b.log", "2016-10-07T15:48:25.2", "42", "Single line", "0", "2016-10-07T15:48:25.2"},
+	}, w.parsed)
+
+	// a long stack trace is collected in one entry, the state is empty
+	// after the end of the upload
+	state := MakeServerlogParserState()
+	src := &ServerlogsSource{Host: "host1", Filename: "c.log", Timezone: time.UTC}
+	w = &collectingServerlogWriter{}
+	tassert.Nil(t, parser.Parse(state, src, "2016-10-07 15:48:25.123 (1234): Exception thrown", w))
+	for i := 0; i < 50000; i++ {
+		tassert.Nil(t, parser.Parse(state, src, "   at Foo.Bar()", w))
+	}
+	tassert.Nil(t, parser.Finish(state, w))
+	tassert.Len(t, w.parsed, 1)
+	tassert.Equal(t, 50001, strings.Count(w.parsed[0][3], "\n")+1)
+
+	tassert.Nil(t, parser.Finish(state, w))
+	tassert.Len(t, w.parsed, 1)
+}
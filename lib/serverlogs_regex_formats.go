@@ -0,0 +1,353 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Regex log formats
+// =================
+//
+// Logs of other layouts (like the Apache access logs or the logs of the
+// repository) are parsed by the formats defined in the configuration. Each
+// format has a regexp with named groups for the columns and writes to its own
+// table (and error table).
+
+// The columns of the regex formats (as the names of the regexp groups)
+var regexLogColumns = []string{"ts", "pid", "tid", "sev", "message"}
+
+// The column types of the regex formats for the loader
+var regexLogColumnTypes = map[string]string{
+	"ts":      "timestamp without time zone",
+	"pid":     "integer",
+	"tid":     "text",
+	"sev":     "text",
+	"message": "text",
+}
+
+// A log format from the configuration
+type RegexLogFormatConfig struct {
+	// The name of the format
+	Name string `json:"name"`
+	// The table the parsed rows go to (the errors go to error_<table>)
+	Table string `json:"table"`
+
+	// Regexp matching the table name of the uploads in this format
+	MatchTable string `json:"match_table,omitempty"`
+	// Regexp matching the name of the log files in this format sent in the
+	// plainlogs uploads
+	MatchFilename string `json:"match_filename,omitempty"`
+
+	// Regexp matching a log line with named groups for the columns:
+	// ts, pid, tid, sev and message (only ts is required)
+	Regex string `json:"regex"`
+	// The layout of the ts group (in the format of the time package)
+	TimestampLayout string `json:"timestamp_layout"`
+}
+
+// A compiled log format. It is the parser of its lines.
+type RegexLogFormat struct {
+	RegexLogFormatConfig
+
+	matchTable, matchFilename, regex *regexp.Regexp
+	// the index of the group of each column (0 if the column has no group)
+	groups []int
+	// the masking rules applied to the parsed rows (can be nil)
+	masking *MaskingRules
+}
+
+// The formats in the order of the configuration, the first match wins
+type RegexLogFormats struct {
+	formats []*RegexLogFormat
+}
+
+// Loads the log formats from a JSON file
+func LoadRegexLogFormats(fileName string) (*RegexLogFormats, error) {
+	formatsFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening log formats file '%s': %v", fileName, err)
+	}
+	defer formatsFile.Close()
+
+	configs := []RegexLogFormatConfig{}
+	if err := json.NewDecoder(formatsFile).Decode(&configs); err != nil {
+		return nil, fmt.Errorf("Error parsing log formats file '%s': %v", fileName, err)
+	}
+	return MakeRegexLogFormats(configs)
+}
+
+// Compiles the patterns of the log formats and checks them
+func MakeRegexLogFormats(configs []RegexLogFormatConfig) (*RegexLogFormats, error) {
+	o := &RegexLogFormats{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("Log format without a name")
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("Duplicate log format '%s'", config.Name)
+		}
+		names[config.Name] = true
+
+		format, err := makeRegexLogFormat(config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid log format '%s': %v", config.Name, err)
+		}
+		o.formats = append(o.formats, format)
+	}
+	return o, nil
+}
+
+func makeRegexLogFormat(config RegexLogFormatConfig) (*RegexLogFormat, error) {
+	if config.Table == "" || SanitizeName(config.Table) != config.Table {
+		return nil, fmt.Errorf("Invalid table name '%s'", config.Table)
+	}
+	if config.MatchTable == "" && config.MatchFilename == "" {
+		return nil, fmt.Errorf("Either match_table or match_filename is required")
+	}
+	if config.TimestampLayout == "" {
+		return nil, fmt.Errorf("No timestamp_layout given")
+	}
+
+	format := &RegexLogFormat{RegexLogFormatConfig: config}
+
+	var err error
+	if format.matchTable, err = compileRoutePattern(config.MatchTable); err != nil {
+		return nil, fmt.Errorf("Invalid match_table pattern '%s': %v", config.MatchTable, err)
+	}
+	if format.matchFilename, err = compileRoutePattern(config.MatchFilename); err != nil {
+		return nil, fmt.Errorf("Invalid match_filename pattern '%s': %v", config.MatchFilename, err)
+	}
+	if format.regex, err = regexp.Compile(config.Regex); err != nil {
+		return nil, fmt.Errorf("Invalid regex '%s': %v", config.Regex, err)
+	}
+
+	format.groups = make([]int, len(regexLogColumns))
+	for i, name := range format.regex.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		column := indexOfString(regexLogColumns, name)
+		if column < 0 {
+			return nil, fmt.Errorf("Unknown group '%s' in regex, known groups: %v", name, regexLogColumns)
+		}
+		format.groups[column] = i
+	}
+	if format.groups[0] == 0 {
+		return nil, fmt.Errorf("No 'ts' group in regex '%s'", config.Regex)
+	}
+
+	return format, nil
+}
+
+func indexOfString(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the format of the uploads of a table or nil if there is none
+func (f *RegexLogFormats) ForTable(table string) *RegexLogFormat {
+	if f == nil {
+		return nil
+	}
+	for _, format := range f.formats {
+		if format.matchTable != nil && format.matchTable.MatchString(table) {
+			return format
+		}
+	}
+	return nil
+}
+
+// Returns the format of a log file in the plainlogs uploads or nil if there
+// is none
+func (f *RegexLogFormats) ForFilename(filename string) *RegexLogFormat {
+	if f == nil {
+		return nil
+	}
+	for _, format := range f.formats {
+		if format.matchFilename != nil && format.matchFilename.MatchString(filename) {
+			return format
+		}
+	}
+	return nil
+}
+
+// Returns true if any of the formats matches log files by their name
+func (f *RegexLogFormats) HasFilenameMatches() bool {
+	if f == nil {
+		return false
+	}
+	for _, format := range f.formats {
+		if format.matchFilename != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the format with the name or nil if there is none
+func (f *RegexLogFormats) Get(name string) *RegexLogFormat {
+	if f == nil {
+		return nil
+	}
+	for _, format := range f.formats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// The routes sending the uploads of the formats to the serverlogs parser
+func (f *RegexLogFormats) UploadRoutes() []UploadRoute {
+	o := []UploadRoute{}
+	if f == nil {
+		return o
+	}
+	for _, format := range f.formats {
+		if format.MatchTable != "" {
+			o = append(o, UploadRoute{Table: format.MatchTable, Handlers: []string{UploadHandlerParseServerlogs}})
+		}
+	}
+	return o
+}
+
+// Parser
+// ------
+
+func (f *RegexLogFormat) Header() []string {
+	return regexLogColumns
+}
+
+func (f *RegexLogFormat) Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error {
+	match := f.regex.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("Line does not match the '%s' log format", f.Name)
+	}
+
+	fields := make([]string, len(regexLogColumns))
+	for i, group := range f.groups {
+		if group > 0 {
+			fields[i] = match[group]
+		}
+	}
+
+	ts, err := convertTimestringToUTC(f.TimestampLayout, fields[0], src.Timezone)
+	if err != nil {
+		return err
+	}
+	fields[0] = ts
+
+	if pid := fields[1]; pid != "" {
+		if _, err := strconv.Atoi(pid); err != nil {
+			return fmt.Errorf("Invalid pid '%s': %v", pid, err)
+		}
+	}
+
+	f.masking.MaskFields(regexLogColumns, fields)
+	return w.WriteParsed(src, fields)
+}
+
+// Sets the masking rules of the rows parsed by the formats
+func (f *RegexLogFormats) SetMasking(masking *MaskingRules) {
+	if f == nil {
+		return
+	}
+	for _, format := range f.formats {
+		format.masking = masking
+	}
+}
+
+// Returns the metadata of an upload with the table set to the table of the
+// format
+func (f *RegexLogFormat) outputMeta(meta *UploadMeta, outputs *TableOutputs) *UploadMeta {
+	o := *meta
+	o.TableName = f.Table
+	o.OutputCodec = outputs.Get(f.Table)
+	return &o
+}
+
+// Routing by filename
+// -------------------
+
+// Sends the lines of the log files matched by a format to the parser of that
+// format, and the rest to the parser of the upload
+type regexLogRouter struct {
+	ServerlogsParser
+	formats *RegexLogFormats
+
+	// creates the writer of a format when its first line arrives
+	newWriter func(format *RegexLogFormat) ServerlogWriter
+	writers   map[string]ServerlogWriter
+}
+
+func (r *regexLogRouter) Parse(state ServerlogParserState, src *ServerlogsSource, line string, w ServerlogWriter) error {
+	format := r.formats.ForFilename(src.Filename)
+	if format == nil {
+		return r.ServerlogsParser.Parse(state, src, line, w)
+	}
+
+	formatWriter, ok := r.writers[format.Name]
+	if !ok {
+		formatWriter = r.newWriter(format)
+		r.writers[format.Name] = formatWriter
+	}
+
+	// the errors go to the error table of the format
+	if err := format.Parse(state, src, line, formatWriter); err != nil {
+		return formatWriter.WriteError(src, err, line)
+	}
+	return nil
+}
+
+func (r *regexLogRouter) Finish(state ServerlogParserState, w ServerlogWriter) error {
+	if finisher, ok := r.ServerlogsParser.(ServerlogsFinisher); ok {
+		return finisher.Finish(state, w)
+	}
+	return nil
+}
+
+// Metadata
+// --------
+
+// The metadata of the tables of the formats, the same way as the
+// preparsedServerlogsColumns
+func (f *RegexLogFormats) metadataColumns() [][]metaColumn {
+	o := [][]metaColumn{}
+	if f == nil {
+		return o
+	}
+	seen := map[string]bool{}
+	for _, format := range f.formats {
+		// formats may share a table
+		if seen[format.Table] {
+			continue
+		}
+		seen[format.Table] = true
+
+		table := metaTable{"public", format.Table}
+		columns := []metaColumn{
+			metaColumn{table, "filename", "text"},
+			metaColumn{table, "host_name", "text"},
+		}
+		for _, column := range regexLogColumns {
+			columns = append(columns, metaColumn{table, column, regexLogColumnTypes[column]})
+		}
+
+		errorTable := metaTable{"public", fmt.Sprintf("error_%s", format.Table)}
+		o = append(o, columns, []metaColumn{
+			metaColumn{errorTable, "error", "text"},
+			metaColumn{errorTable, "host_name", "text"},
+			metaColumn{errorTable, "filename", "text"},
+			metaColumn{errorTable, "line", "text"},
+		})
+	}
+	return o
+}
@@ -0,0 +1,105 @@
+package insight_server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func makeTestApacheLogFormats(t *testing.T) *RegexLogFormats {
+	formats, err := MakeRegexLogFormats([]RegexLogFormatConfig{
+		{
+			Name:            "apache",
+			Table:           "apachelogs",
+			MatchTable:      "^apachelogs",
+			MatchFilename:   `^access\.\d+\.log$`,
+			Regex:           `^\S+ \S+ \S+ \[(?P<ts>[^\]]+)\] (?P<message>.*)$`,
+			TimestampLayout: "02/Jan/2006:15:04:05 -0700",
+		},
+	})
+	tassert.Nil(t, err)
+	return formats
+}
+
+func TestMakeRegexLogFormats(t *testing.T) {
+	valid := RegexLogFormatConfig{Name: "a", Table: "alogs", MatchTable: "^alogs", Regex: `^(?P<ts>\S+) (?P<message>.*)$`, TimestampLayout: time.RFC3339}
+	_, err := MakeRegexLogFormats([]RegexLogFormatConfig{valid})
+	tassert.Nil(t, err)
+
+	// the same name twice
+	_, err = MakeRegexLogFormats([]RegexLogFormatConfig{valid, valid})
+	tassert.NotNil(t, err)
+
+	for _, change := range []func(c *RegexLogFormatConfig){
+		func(c *RegexLogFormatConfig) { c.Table = "../alogs" },
+		func(c *RegexLogFormatConfig) { c.MatchTable = "" },
+		func(c *RegexLogFormatConfig) { c.Regex = `^(?P<message>.*)$` },
+		func(c *RegexLogFormatConfig) { c.Regex = `^(?P<ts>\S+) (?P<text>.*)$` },
+		func(c *RegexLogFormatConfig) { c.TimestampLayout = "" },
+	} {
+		config := valid
+		change(&config)
+		_, err := MakeRegexLogFormats([]RegexLogFormatConfig{config})
+		tassert.NotNil(t, err, "%+v", config)
+	}
+}
+
+func TestRegexLogFormat_Parse(t *testing.T) {
+	format := makeTestApacheLogFormats(t).ForTable("apachelogs")
+	tassert.NotNil(t, format)
+
+	w := &collectingServerlogWriter{}
+	input := "filename\vhost\vline\n" +
+		"access.0.log\vhost1\v127.0.0.1 - - [07/Oct/2016:15:48:25 +0200] GET / HTTP/1.1 200 512\n" +
+		"access.0.log\vhost1\vnot an access log line\n"
+	tassert.Nil(t, ParseServerlogsWith(strings.NewReader(input), format, w, time.UTC))
+
+	tassert.Equal(t, [][]string{
+		{"access.0.log", "2016-10-07T13:48:25", "", "", "", "GET / HTTP/1.1 200 512"},
+	}, w.parsed)
+	tassert.Equal(t, []string{"not an access log line"}, w.errors)
+}
+
+func TestRegexLogFormat_FilenameRouting(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	env.LogFormats = makeTestApacheLogFormats(t)
+
+	archivedFile := writeTestArchivedServerlog(t, env, "host1", "plainlogs-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz",
+		"filename\vhost\vline\n"+
+			"vizqlserver_1-0.log\vhost1\v2016-10-07 15:48:25.123 (1234): Request completed\n"+
+			"access.0.log\vhost1\v127.0.0.1 - - [07/Oct/2016:15:48:25 +0200] GET / HTTP/1.1 200 512\n"+
+			"access.0.log\vhost1\vnot an access log line\n")
+	meta, _ := makeArchivedServerlogMeta(archivedFile)
+	meta.Timezone = time.UTC
+
+	logFormat, _, isServerlog := serverlogFormatOf(env, meta.TableName)
+	tassert.True(t, isServerlog)
+	tassert.Equal(t, LogFormatPlain, logFormat)
+
+	parserMap, err := makeServerlogsParserMap(env)
+	tassert.Nil(t, err)
+	result, err := processServerlogRequest(env, ServerlogInput{Meta: meta, ArchivedFile: archivedFile, Format: LogFormatPlain}, parserMap[LogFormatPlain])
+	tassert.Nil(t, err)
+	tassert.Equal(t, ServerlogsParseResult{ParsedRows: 2, ErrorRows: 1}, result)
+
+	outputDir := filepath.Join(env.BaseDir, PALETTE_BASE_FOLDER, "uploads", "public", "host1")
+	for _, pattern := range []string{"plainlogs-*", "apachelogs-*", "errors_apachelogs-*"} {
+		outputs, err := filepath.Glob(filepath.Join(outputDir, pattern))
+		tassert.Nil(t, err)
+		tassert.Len(t, outputs, 1, pattern)
+	}
+}
+
+func TestRegexLogFormats_Metadata(t *testing.T) {
+	formats := makeTestApacheLogFormats(t)
+
+	columns := serverlogsMetadataColumns(formats)
+	tassert.Equal(t, "apachelogs", columns[len(columns)-2][0].table.name)
+	tassert.Equal(t, "error_apachelogs", columns[len(columns)-1][0].table.name)
+	tassert.Equal(t, ParquetTimestamp, parquetColumnsFromMetadata("apachelogs", columns)[2].Type)
+	tassert.Len(t, parquetColumnsFromMetadata("error_apachelogs", columns), 4)
+}
@@ -0,0 +1,454 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/namsral/flag"
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Serverlogs re-parsing
+// =====================
+//
+// Feeds archived serverlogs through the parsers again (after a parser fix for
+// example). The archived files are selected by host, date range and glob,
+// and the outputs are written the same way as for new uploads.
+
+// Selects the archived serverlogs to re-parse
+type ReparseSelector struct {
+	// Only the files of this host (all hosts if empty)
+	Host string `json:"host,omitempty"`
+	// Only the files created in [From, To) (unlimited if zero)
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Glob matching the path of the file relative to the archives directory
+	// (or its name)
+	Glob string `json:"glob,omitempty"`
+	// The timezone of the logs (used if the parse queue does not know it)
+	Timezone *time.Location `json:"-"`
+}
+
+// The format of the from and to params
+const reparseDateFormat = "2006-01-02"
+
+// Creates a selector from its string parameters. The dates are days in the
+// '2006-01-02' format, both ends are inclusive.
+func ParseReparseSelector(host, from, to, glob, tz string) (*ReparseSelector, error) {
+	sel := &ReparseSelector{Host: host, Glob: glob, Timezone: time.UTC}
+
+	if from != "" {
+		fromDate, err := time.Parse(reparseDateFormat, from)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid from date '%s': %v", from, err)
+		}
+		sel.From = fromDate
+	}
+
+	if to != "" {
+		toDate, err := time.Parse(reparseDateFormat, to)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid to date '%s': %v", to, err)
+		}
+		sel.To = toDate.Add(24 * time.Hour)
+	}
+
+	if glob != "" {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("Invalid glob '%s': %v", glob, err)
+		}
+	}
+
+	if tz != "" {
+		timezone, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown time zone '%s': %v", tz, err)
+		}
+		sel.Timezone = timezone
+	}
+
+	return sel, nil
+}
+
+// Matches the names of the archived files:
+// serverlogs-2016-04-19--12-36-58--seq000--part0000-bc2ce0e4421cd7dea704eff080bb6f43.csv.gz
+var archivedServerlogRegexp = regexp.MustCompile(`^(.+?)-(\d{4}-\d{2}-\d{2}--\d{2}-\d{2}-\d{2})--seq(\d+)--part(\d+)-`)
+
+// Creates the metadata of an archived file from its path
+// (<archives>/palette/uploads/<pkg>/<host>/<file>). The table is not checked,
+// see serverlogFormatOf().
+func makeArchivedServerlogMeta(archivedFile string) (*UploadMeta, bool) {
+	fileName := filepath.Base(archivedFile)
+	parts := archivedServerlogRegexp.FindStringSubmatch(fileName)
+	if parts == nil {
+		return nil, false
+	}
+
+	date, err := time.Parse("2006-01-02--15-04-05", parts[2])
+	if err != nil {
+		return nil, false
+	}
+	seqIdx, _ := strconv.Atoi(parts[3])
+	partIdx, _ := strconv.Atoi(parts[4])
+
+	hostDir := filepath.Dir(archivedFile)
+	return &UploadMeta{
+		OriginalFilename: fileName,
+		Pkg:              filepath.Base(filepath.Dir(hostDir)),
+		Host:             filepath.Base(hostDir),
+		TableName:        parts[1],
+		Date:             date,
+		SeqIdx:           seqIdx,
+		PartIdx:          partIdx,
+	}, true
+}
+
+// Returns true if the archived file is selected
+func (s *ReparseSelector) matches(relativePath string, meta *UploadMeta) bool {
+	if s.Host != "" && s.Host != meta.Host {
+		return false
+	}
+	if !s.From.IsZero() && meta.Date.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && !meta.Date.Before(s.To) {
+		return false
+	}
+	if s.Glob != "" {
+		pathMatch, _ := filepath.Match(s.Glob, filepath.ToSlash(relativePath))
+		nameMatch, _ := filepath.Match(s.Glob, filepath.Base(relativePath))
+		return pathMatch || nameMatch
+	}
+	return true
+}
+
+// Finds the archived serverlogs selected, the oldest first. The metadata
+// of the files still in the parse queue comes from there (so their timezone
+// is the one sent by the agent).
+func findArchivedServerlogs(env *UploadHandlerEnv, sel *ReparseSelector, useOldFormatFilename bool) ([]ServerlogInput, error) {
+	queuedItems, err := env.ParseQueue.List()
+	if err != nil {
+		return nil, err
+	}
+	queuedMetas := map[string]*UploadMeta{}
+	for _, item := range queuedItems {
+		queuedMetas[item.ArchivedFile] = item.Meta
+	}
+
+	o := []ServerlogInput{}
+	err = filepath.Walk(env.ArchivesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		meta, isArchived := makeArchivedServerlogMeta(path)
+		if !isArchived {
+			return nil
+		}
+		logFormat, formatName, isServerlog := serverlogFormatOf(env, meta.TableName)
+		if !isServerlog {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(env.ArchivesDir, path)
+		if err != nil {
+			return err
+		}
+		if !sel.matches(relativePath, meta) {
+			return nil
+		}
+
+		if queuedMeta, ok := queuedMetas[path]; ok {
+			meta = queuedMeta
+		} else {
+			meta.Timezone = sel.Timezone
+			meta.UseOldFormatFilename = useOldFormatFilename
+		}
+		// the outputs follow the current configuration
+		meta.OutputCodec = env.Outputs.Get(meta.TableName)
+
+		o = append(o, ServerlogInput{Meta: meta, ArchivedFile: path, Format: logFormat, FormatName: formatName})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing archived serverlogs in '%s': %v", env.ArchivesDir, err)
+	}
+
+	sort.SliceStable(o, func(i, j int) bool {
+		a, b := o[i].Meta, o[j].Meta
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		if a.SeqIdx != b.SeqIdx {
+			return a.SeqIdx < b.SeqIdx
+		}
+		return a.PartIdx < b.PartIdx
+	})
+	return o, nil
+}
+
+// Jobs
+// ----
+
+// The statuses of the reparse jobs
+const (
+	ReparseStatusRunning = "running"
+	ReparseStatusDone    = "done"
+)
+
+// The outcome of re-parsing an archived file
+type ReparseFileResult struct {
+	ArchivedFile string `json:"archived_file"`
+	ServerlogsParseResult
+	Error string `json:"error,omitempty"`
+}
+
+// A re-parse of a set of archived files
+type ReparseJob struct {
+	Id       string           `json:"id"`
+	Selector *ReparseSelector `json:"selector"`
+	Status   string           `json:"status"`
+
+	// The number of selected, processed and failed files
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+
+	// The sum of the rows written
+	ServerlogsParseResult
+
+	Files []ReparseFileResult `json:"files"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// Runs the reparse jobs and keeps their progress
+type ServerlogsReparser struct {
+	env                  *UploadHandlerEnv
+	parserMap            map[LogFormat]ServerlogsParser
+	useOldFormatFilename bool
+
+	jobs map[string]*ReparseJob
+	lock sync.Mutex
+}
+
+func NewServerlogsReparser(env *UploadHandlerEnv, useOldFormatFilename bool) (*ServerlogsReparser, error) {
+	parserMap, err := makeServerlogsParserMap(env)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerlogsReparser{
+		env:                  env,
+		parserMap:            parserMap,
+		useOldFormatFilename: useOldFormatFilename,
+		jobs:                 map[string]*ReparseJob{},
+	}, nil
+}
+
+// Creates a job for the selected files
+func (r *ServerlogsReparser) newJob(sel *ReparseSelector) (*ReparseJob, []ServerlogInput, error) {
+	inputs, err := findArchivedServerlogs(r.env, sel, r.useOldFormatFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	job := &ReparseJob{
+		Id:       makeRandomId(),
+		Selector: sel,
+		Status:   ReparseStatusRunning,
+		Total:    len(inputs),
+		Files:    []ReparseFileResult{},
+		Started:  time.Now().UTC(),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.jobs[job.Id] = job
+	return job, inputs, nil
+}
+
+// Parses the files of a job one after the other. The progress callback
+// (if any) gets the result of each file.
+func (r *ServerlogsReparser) run(job *ReparseJob, inputs []ServerlogInput, progress func(job *ReparseJob, result *ReparseFileResult)) {
+	log.Infof("Starting reparse. id=%s files=%d", job.Id, len(inputs))
+
+	for _, input := range inputs {
+		result, err := processServerlogRequest(r.env, input, serverlogParserFor(r.env, r.parserMap, input))
+		fileResult := ReparseFileResult{ArchivedFile: input.ArchivedFile, ServerlogsParseResult: result}
+		if err != nil {
+			fileResult.Error = fmt.Sprint(err)
+			log.Errorf("Error during reparsing of serverlog. id=%s file=%s err=%s", job.Id, input.ArchivedFile, err)
+		}
+
+		r.lock.Lock()
+		job.Processed++
+		if err != nil {
+			job.Failed++
+		}
+		job.ParsedRows += result.ParsedRows
+		job.ErrorRows += result.ErrorRows
+		job.Files = append(job.Files, fileResult)
+		r.lock.Unlock()
+
+		if progress != nil {
+			progress(job, &fileResult)
+		}
+	}
+
+	r.lock.Lock()
+	job.Status = ReparseStatusDone
+	job.Finished = time.Now().UTC()
+	r.lock.Unlock()
+
+	log.Infof("Finished reparse. id=%s files=%d failed=%d count=%d errorCount=%d",
+		job.Id, job.Processed, job.Failed, job.ParsedRows, job.ErrorRows)
+}
+
+// Starts re-parsing the selected files in the background
+func (r *ServerlogsReparser) Start(sel *ReparseSelector) (*ReparseJob, error) {
+	job, inputs, err := r.newJob(sel)
+	if err != nil {
+		return nil, err
+	}
+	go r.run(job, inputs, nil)
+	return r.Get(job.Id)
+}
+
+// Returns a snapshot of a job
+func (r *ServerlogsReparser) Get(id string) (*ReparseJob, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("No such reparse job: '%s'", id)
+	}
+	return job.snapshot(), nil
+}
+
+// Returns a snapshot of all jobs, the oldest first
+func (r *ServerlogsReparser) List() []*ReparseJob {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	o := make([]*ReparseJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		o = append(o, job.snapshot())
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Started.Before(o[j].Started) })
+	return o
+}
+
+func (j *ReparseJob) snapshot() *ReparseJob {
+	o := *j
+	o.Files = append([]ReparseFileResult{}, j.Files...)
+	return &o
+}
+
+// HTTP HANDLERS
+// =============
+
+func writeReparseJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Error("Error encoding reparse json for http.", err)
+	}
+}
+
+// Handler for POST /api/v1/serverlogs/reparse
+func MakeStartReparseHandler(reparser *ServerlogsReparser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		sel, err := ParseReparseSelector(params.Get("host"), params.Get("from"), params.Get("to"), params.Get("glob"), params.Get("tz"))
+		if err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		job, err := reparser.Start(sel)
+		if err != nil {
+			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+			return
+		}
+		writeReparseJson(w, http.StatusAccepted, job)
+	}
+}
+
+// Handler for GET /api/v1/serverlogs/reparse
+func MakeListReparseHandler(reparser *ServerlogsReparser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReparseJson(w, http.StatusOK, reparser.List())
+	}
+}
+
+// Handler for GET /api/v1/serverlogs/reparse/{id}
+func MakeGetReparseHandler(reparser *ServerlogsReparser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := reparser.Get(mux.Vars(r)["id"])
+		if err != nil {
+			WriteResponse(w, http.StatusNotFound, "No such reparse job", r)
+			return
+		}
+		writeReparseJson(w, http.StatusOK, job)
+	}
+}
+
+// COMMAND LINE
+// ============
+
+// Runs the 'reparse' subcommand: re-parses the selected files and prints
+// the progress. Returns an error if any of the files failed.
+func RunReparseCommand(env *UploadHandlerEnv, useOldFormatFilename bool, args []string) error {
+	flags := flag.NewFlagSet("reparse", flag.ExitOnError)
+	host := flags.String("host", "", "Only re-parse the serverlogs of this host.")
+	from := flags.String("from", "", "Only re-parse the serverlogs created on or after this day (2006-01-02).")
+	to := flags.String("to", "", "Only re-parse the serverlogs created on or before this day (2006-01-02).")
+	glob := flags.String("glob", "", "Only re-parse the archived files matching this glob (relative to the archive path).")
+	tz := flags.String("tz", "", "The timezone of the serverlogs not in the parse queue (UTC by default).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sel, err := ParseReparseSelector(*host, *from, *to, *glob, *tz)
+	if err != nil {
+		return err
+	}
+
+	reparser, err := NewServerlogsReparser(env, useOldFormatFilename)
+	if err != nil {
+		return err
+	}
+
+	job, inputs, err := reparser.newJob(sel)
+	if err != nil {
+		return err
+	}
+
+	reparser.run(job, inputs, func(job *ReparseJob, result *ReparseFileResult) {
+		status := "ok"
+		if result.Error != "" {
+			status = result.Error
+		}
+		fmt.Printf("[%d/%d] %s rows=%d errors=%d %s\n", job.Processed, job.Total, result.ArchivedFile, result.ParsedRows, result.ErrorRows, status)
+	})
+
+	fmt.Printf("Re-parsed %d files: failed=%d rows=%d errors=%d\n", job.Processed, job.Failed, job.ParsedRows, job.ErrorRows)
+	if job.Failed > 0 {
+		return fmt.Errorf("Failed to re-parse %d of %d files", job.Failed, job.Total)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package insight_server
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+// Writes a gzipped serverlog to the archives of a host
+func writeTestArchivedServerlog(t *testing.T, env *UploadHandlerEnv, host, fileName, contents string) string {
+	archivedFile := filepath.Join(env.ArchivesDir, PALETTE_BASE_FOLDER, "uploads", "public", host, fileName)
+	tassert.Nil(t, os.MkdirAll(filepath.Dir(archivedFile), 0755))
+
+	f, err := os.Create(archivedFile)
+	tassert.Nil(t, err)
+	defer f.Close()
+
+	w := gzip.NewWriter(f)
+	w.Write([]byte(contents))
+	tassert.Nil(t, w.Close())
+	return archivedFile
+}
+
+const testPlainServerlog = "filename\vhost\vline\n" +
+	"vizqlserver_1-0.log\vhost1\v2016-10-07 15:48:25.123 (1234): Request completed\n" +
+	// a continuation without an entry to continue
+	"vizqlserver_1-1.log\vhost1\vnot a log line\n"
+
+func TestServerlogsReparser(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	selected := writeTestArchivedServerlog(t, env, "host1", "plainlogs-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testPlainServerlog)
+	// another host, another day and not a serverlog
+	writeTestArchivedServerlog(t, env, "host2", "plainlogs-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testPlainServerlog)
+	writeTestArchivedServerlog(t, env, "host1", "plainlogs-2016-10-09--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testPlainServerlog)
+	writeTestArchivedServerlog(t, env, "host1", "metadata-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", "")
+
+	sel, err := ParseReparseSelector("host1", "2016-10-06", "2016-10-07", "", "Europe/Budapest")
+	tassert.Nil(t, err)
+
+	reparser, err := NewServerlogsReparser(env, false)
+	tassert.Nil(t, err)
+
+	job, inputs, err := reparser.newJob(sel)
+	tassert.Nil(t, err)
+	tassert.Len(t, inputs, 1)
+	tassert.Equal(t, selected, inputs[0].ArchivedFile)
+	tassert.Equal(t, LogFormatPlain, inputs[0].Format)
+	tassert.Equal(t, "host1", inputs[0].Meta.Host)
+	tassert.Equal(t, "plainlogs", inputs[0].Meta.TableName)
+	tassert.Equal(t, "Europe/Budapest", inputs[0].Meta.Timezone.String())
+
+	reparser.run(job, inputs, nil)
+
+	job, err = reparser.Get(job.Id)
+	tassert.Nil(t, err)
+	tassert.Equal(t, ReparseStatusDone, job.Status)
+	tassert.Equal(t, 1, job.Processed)
+	tassert.Equal(t, 0, job.Failed)
+	tassert.Equal(t, 1, job.ParsedRows)
+	tassert.Equal(t, 1, job.ErrorRows)
+
+	outputs, err := filepath.Glob(filepath.Join(env.BaseDir, PALETTE_BASE_FOLDER, "uploads", "public", "host1", "plainlogs-*.csv.gz"))
+	tassert.Nil(t, err)
+	tassert.Len(t, outputs, 1)
+}
+
+func TestParseReparseSelector(t *testing.T) {
+	sel, err := ParseReparseSelector("", "", "2016-10-07", "serverlogs-*", "")
+	tassert.Nil(t, err)
+	tassert.Equal(t, time.UTC, sel.Timezone)
+	tassert.Equal(t, time.Date(2016, time.October, 8, 0, 0, 0, 0, time.UTC), sel.To)
+
+	_, err = ParseReparseSelector("", "yesterday", "", "", "")
+	tassert.NotNil(t, err)
+	_, err = ParseReparseSelector("", "", "", "[", "")
+	tassert.NotNil(t, err)
+}
@@ -0,0 +1,189 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Side tables
+// ===========
+//
+// The values of some well-known keys of the JSON serverlogs (like the query
+// text and the row count of 'end-query') are extracted from the 'v' column
+// to typed side tables, so they dont have to be dug out of the JSON in SQL.
+
+// A table extracted from the JSON serverlogs
+type jsonLogSideTable struct {
+	table metaTable
+	// the 'k' values of the rows going to this table
+	keys    []string
+	columns []jsonLogSideColumn
+}
+
+// A column of a side table
+type jsonLogSideColumn struct {
+	column, formatType string
+	// The values tried in order, the first one present is used: the
+	// columns of the parsed row (like "sess") or the keys of the inner JSON
+	// prefixed with "v." (like "v.query")
+	sources []string
+}
+
+var jsonLogSideTables = []jsonLogSideTable{
+	{
+		table: metaTable{"public", "serverlogs_queries"},
+		keys:  []string{"end-query"},
+		columns: []jsonLogSideColumn{
+			{"ts", "timestamp without time zone", []string{"ts"}},
+			{"pid", "integer", []string{"pid"}},
+			{"tid", "integer", []string{"tid"}},
+			{"req", "text", []string{"req"}},
+			{"sess", "text", []string{"sess"}},
+			{"site", "text", []string{"site"}},
+			{"user", "text", []string{"user"}},
+			{"query", "text", []string{"v.query"}},
+			{"query_hash", "text", []string{"v.query-hash"}},
+			{"protocol_id", "integer", []string{"v.protocol-id"}},
+			{"rows", "integer", []string{"v.rows"}},
+			{"cols", "integer", []string{"v.cols"}},
+			{"elapsed_ms", "integer", []string{"elapsed_ms"}},
+		},
+	},
+	{
+		table: metaTable{"public", "serverlogs_query_batches"},
+		keys:  []string{"qp-batch-summary"},
+		columns: []jsonLogSideColumn{
+			{"ts", "timestamp without time zone", []string{"ts"}},
+			{"pid", "integer", []string{"pid"}},
+			{"tid", "integer", []string{"tid"}},
+			{"req", "text", []string{"req"}},
+			{"sess", "text", []string{"sess"}},
+			{"site", "text", []string{"site"}},
+			{"user", "text", []string{"user"}},
+			{"query_batch_id", "text", []string{"v.query-batch-id"}},
+			{"job_count", "integer", []string{"v.job-count"}},
+			{"elapsed_ms", "integer", []string{"elapsed_ms"}},
+		},
+	},
+	{
+		table: metaTable{"public", "serverlogs_sessions"},
+		keys:  []string{"create-session", "lock-session"},
+		columns: []jsonLogSideColumn{
+			{"ts", "timestamp without time zone", []string{"ts"}},
+			{"pid", "integer", []string{"pid"}},
+			{"tid", "integer", []string{"tid"}},
+			{"k", "text", []string{"k"}},
+			{"session", "text", []string{"v.session", "sess"}},
+			{"user", "text", []string{"v.user", "user"}},
+			{"workbook", "text", []string{"v.workbook", "v.workbook-name"}},
+			{"site", "text", []string{"v.site", "site"}},
+		},
+	},
+}
+
+// The side tables by the 'k' values
+var jsonLogSideTablesByKey = map[string][]*jsonLogSideTable{}
+
+func init() {
+	for i := range jsonLogSideTables {
+		table := &jsonLogSideTables[i]
+		for _, key := range table.keys {
+			jsonLogSideTablesByKey[key] = append(jsonLogSideTablesByKey[key], table)
+		}
+	}
+}
+
+// The headers of a side table
+func (t *jsonLogSideTable) headers() []string {
+	o := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		o[i] = column.column
+	}
+	return o
+}
+
+// The metadata of the side table (with the columns added by the writers)
+func (t *jsonLogSideTable) metadataColumns() []metaColumn {
+	o := []metaColumn{
+		{t.table, "filename", "text"},
+		{t.table, "host_name", "text"},
+	}
+	for _, column := range t.columns {
+		o = append(o, metaColumn{t.table, column.column, column.formatType})
+	}
+	return o
+}
+
+// Writes the side rows of a parsed JSON serverlog row. The row is given by
+// its columns (by the names in the header of the JsonLogParser), already
+// masked.
+func writeJsonLogSideRows(w SideTableWriter, src *ServerlogsSource, row map[string]string, v interface{}, masking *MaskingRules) error {
+	inner, _ := v.(map[string]interface{})
+
+	for _, table := range jsonLogSideTablesByKey[row["k"]] {
+		fields := make([]string, len(table.columns))
+		for i, column := range table.columns {
+			fields[i] = column.value(row, inner, masking)
+		}
+		if err := w.WriteSide(src, table.table.name, table.headers(), fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value of the column converted to its type. Values that cannot
+// be converted are left empty (so they are loaded as nulls). The values from
+// the inner JSON are masked by the rules of the 'v' column and of the side
+// column.
+func (c *jsonLogSideColumn) value(row map[string]string, inner map[string]interface{}, masking *MaskingRules) string {
+	for _, source := range c.sources {
+		if len(source) > 2 && source[:2] == "v." {
+			value, hasValue := inner[source[2:]]
+			if !hasValue || value == nil {
+				continue
+			}
+			return masking.maskColumn(c.column, masking.maskColumn("v", formatSideValue(value, c.formatType)))
+		}
+		if rowValue := row[source]; rowValue != "" {
+			return formatSideValue(rowValue, c.formatType)
+		}
+	}
+	return ""
+}
+
+func formatSideValue(value interface{}, formatType string) string {
+	if formatType == "integer" {
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatInt(int64(v), 10)
+		case string:
+			if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return v
+			}
+		}
+		return ""
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	// objects and arrays are kept as JSON
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// The metadata of all side tables
+func jsonLogSideTablesMetadata() [][]metaColumn {
+	o := make([][]metaColumn, len(jsonLogSideTables))
+	for i := range jsonLogSideTables {
+		o[i] = jsonLogSideTables[i].metadataColumns()
+	}
+	return o
+}
@@ -0,0 +1,60 @@
+package insight_server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestJsonLogParser_SideTables(t *testing.T) {
+	src := &ServerlogsSource{Host: "host1", Filename: "vizqlserver_1-0.log", Timezone: time.UTC}
+	parser := &JsonLogParser{}
+	w := &collectingServerlogWriter{}
+
+	for _, line := range []string{
+		`{"ts":"2016-03-25T00:59:10.599","pid":11540,"tid":"5640","sev":"info","req":"R1","sess":"S1","site":"PGS","user":"pg","k":"end-query","v":{"query":"SELECT 1","cols":2,"protocol-id":11575,"rows":"10","elapsed":0.034,"query-hash":867325541}}`,
+		`{"ts":"2016-03-25T00:59:11.000","pid":11540,"tid":"5640","sev":"info","req":"R1","sess":"S1","site":"PGS","user":"pg","k":"lock-session","v":{"workbook":"Sales"}}`,
+		// no side table for this key
+		`{"ts":"2016-03-25T00:59:12.000","pid":11540,"tid":"5640","sev":"info","req":"R1","sess":"S1","site":"PGS","user":"pg","k":"begin-query","v":{"query":"SELECT 1"}}`,
+	} {
+		tassert.Nil(t, parser.Parse(MakeServerlogParserState(), src, line, w))
+	}
+
+	tassert.Len(t, w.parsed, 3)
+	tassert.Len(t, w.side, 2)
+	tassert.Equal(t, [][]string{
+		{"2016-03-25T00:59:10.599", "11540", "22080", "R1", "S1", "PGS", "pg", "SELECT 1", "867325541", "11575", "10", "2", "34"},
+	}, w.side["serverlogs_queries"])
+	tassert.Equal(t, [][]string{
+		{"2016-03-25T00:59:11", "11540", "22080", "lock-session", "S1", "pg", "Sales", "PGS"},
+	}, w.side["serverlogs_sessions"])
+}
+
+func TestFormatSideValue(t *testing.T) {
+	tassert.Equal(t, "12", formatSideValue(12.0, "integer"))
+	tassert.Equal(t, "12", formatSideValue("12", "integer"))
+	tassert.Equal(t, "", formatSideValue("twelve", "integer"))
+	tassert.Equal(t, "0.5", formatSideValue(0.5, "text"))
+	tassert.Equal(t, `["a"]`, formatSideValue([]interface{}{"a"}, "text"))
+}
+
+func TestJsonLogParser_SideTableOutputs(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+
+	archivedFile := writeTestArchivedServerlog(t, env, "host1", "serverlogs-2016-03-25--00-59-10--seq000--part0000-00000000000000000000000000000000.csv.gz",
+		"filename\vhost\vline\n"+
+			`vizqlserver_1-0.log`+"\vhost1\v"+`{"ts":"2016-03-25T00:59:10.599","pid":11540,"tid":"5640","sev":"info","req":"R1","sess":"S1","site":"PGS","user":"pg","k":"end-query","v":{"query":"SELECT 1","rows":10}}`+"\n")
+	meta, _ := makeArchivedServerlogMeta(archivedFile)
+	meta.Timezone = time.UTC
+
+	result, err := processServerlogRequest(env, ServerlogInput{Meta: meta, ArchivedFile: archivedFile, Format: LogFormatJson}, &JsonLogParser{})
+	tassert.Nil(t, err)
+	tassert.Equal(t, ServerlogsParseResult{ParsedRows: 1}, result)
+
+	outputs, err := filepath.Glob(filepath.Join(env.BaseDir, PALETTE_BASE_FOLDER, "uploads", "public", "host1", "serverlogs_queries-*"))
+	tassert.Nil(t, err)
+	tassert.Len(t, outputs, 1)
+}
@@ -0,0 +1,434 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Serverlog sinks
+// ===============
+//
+// The parsed rows of an upload are written to the output of its table (the
+// CSV or parquet files loaded to the database) and copied to the other sinks
+// enabled in the env, like the NDJSON files and the live rows of the
+// serverlogs endpoint. A failing sink other than the output is disabled for
+// the rest of the upload, but it does not fail the parsing.
+
+// The rows written to a sink while parsing a serverlog file
+type ServerlogSinkResult struct {
+	Sink  string `json:"sink"`
+	Table string `json:"table"`
+	ServerlogsParseResult
+	Error string `json:"error,omitempty"`
+}
+
+// Creates a sink of the parsed rows of an upload. Returns nil if the sink is
+// not enabled in the env.
+type ServerlogSinkFactory func(env *UploadHandlerEnv, meta *UploadMeta, header []string) ServerlogWriter
+
+type namedServerlogSinkFactory struct {
+	name    string
+	factory ServerlogSinkFactory
+}
+
+var (
+	serverlogSinkFactories     = []namedServerlogSinkFactory{}
+	serverlogSinkFactoriesLock sync.Mutex
+)
+
+// Adds a sink to the writers of the parsed serverlogs. The sinks get the
+// rows in the order they were registered. Panics if the name is already
+// taken.
+func RegisterServerlogSink(name string, factory ServerlogSinkFactory) {
+	serverlogSinkFactoriesLock.Lock()
+	defer serverlogSinkFactoriesLock.Unlock()
+
+	for _, sink := range serverlogSinkFactories {
+		if sink.name == name {
+			panic(fmt.Sprintf("Serverlog sink '%s' is already registered", name))
+		}
+	}
+	serverlogSinkFactories = append(serverlogSinkFactories, namedServerlogSinkFactory{name, factory})
+}
+
+func getServerlogSinkFactories() []namedServerlogSinkFactory {
+	serverlogSinkFactoriesLock.Lock()
+	defer serverlogSinkFactoriesLock.Unlock()
+	return append([]namedServerlogSinkFactory{}, serverlogSinkFactories...)
+}
+
+// The names of the built-in sinks
+const (
+	ServerlogSinkNdjson = "ndjson"
+	ServerlogSinkLive   = "live"
+)
+
+func init() {
+	RegisterServerlogSink(ServerlogSinkNdjson, func(env *UploadHandlerEnv, meta *UploadMeta, header []string) ServerlogWriter {
+		if env.NdjsonDir == "" {
+			return nil
+		}
+		return NewServerlogsNdjsonWriter(env.NdjsonDir, env.TmpDir, meta, header)
+	})
+	RegisterServerlogSink(ServerlogSinkLive, func(env *UploadHandlerEnv, meta *UploadMeta, header []string) ServerlogWriter {
+		if env.LiveRows == nil {
+			return nil
+		}
+		return env.LiveRows.newWriter(meta.TableName, header)
+	})
+}
+
+// Fan-out
+// -------
+
+type serverlogSink struct {
+	name string
+	w    ServerlogWriter
+	// the first error of the sink, it gets no more rows after it
+	err error
+}
+
+// Writes the rows to all its sinks. The first sink is the output of the
+// table: its counts are the counts of the writer and its errors are
+// returned.
+type fanoutServerlogWriter struct {
+	table string
+	sinks []*serverlogSink
+}
+
+func newFanoutServerlogWriter(table, name string, w ServerlogWriter) *fanoutServerlogWriter {
+	return &fanoutServerlogWriter{
+		table: table,
+		sinks: []*serverlogSink{{name: name, w: w}},
+	}
+}
+
+func (f *fanoutServerlogWriter) addSink(name string, w ServerlogWriter) {
+	f.sinks = append(f.sinks, &serverlogSink{name: name, w: w})
+}
+
+// Writes to each sink still working. Returns the error of the output.
+func (f *fanoutServerlogWriter) forEach(write func(w ServerlogWriter) error) error {
+	for i, sink := range f.sinks {
+		if sink.err != nil {
+			continue
+		}
+		err := write(sink.w)
+		if i == 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error writing serverlog sink, disabling it. sink=%s table=%s err=%s", sink.name, f.table, err)
+			sink.err = err
+		}
+	}
+	return nil
+}
+
+func (f *fanoutServerlogWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	return f.forEach(func(w ServerlogWriter) error {
+		return w.WriteParsed(source, fields)
+	})
+}
+
+func (f *fanoutServerlogWriter) WriteError(source *ServerlogsSource, parseErr error, line string) error {
+	return f.forEach(func(w ServerlogWriter) error {
+		return w.WriteError(source, parseErr, line)
+	})
+}
+
+func (f *fanoutServerlogWriter) WriteSide(source *ServerlogsSource, table string, headers, fields []string) error {
+	return f.forEach(func(w ServerlogWriter) error {
+		if sideWriter, ok := w.(SideTableWriter); ok {
+			return sideWriter.WriteSide(source, table, headers, fields)
+		}
+		return nil
+	})
+}
+
+// Closes all sinks, returns the error of the output
+func (f *fanoutServerlogWriter) Close() error {
+	for _, sink := range f.sinks[1:] {
+		if err := sink.w.Close(); err != nil && sink.err == nil {
+			log.Errorf("Error closing serverlog sink. sink=%s table=%s err=%s", sink.name, f.table, err)
+			sink.err = err
+		}
+	}
+	return f.sinks[0].w.Close()
+}
+
+func (f *fanoutServerlogWriter) ParsedRowCount() int {
+	return f.sinks[0].w.ParsedRowCount()
+}
+
+func (f *fanoutServerlogWriter) ErrorRowCount() int {
+	return f.sinks[0].w.ErrorRowCount()
+}
+
+// Returns the names of the output files of all sinks
+func (f *fanoutServerlogWriter) OutputFileNames() []string {
+	o := []string{}
+	for _, sink := range f.sinks {
+		if withOutputs, ok := sink.w.(interface {
+			OutputFileNames() []string
+		}); ok {
+			o = append(o, withOutputs.OutputFileNames()...)
+		}
+	}
+	return o
+}
+
+// Returns the rows written to each sink
+func (f *fanoutServerlogWriter) SinkResults() []ServerlogSinkResult {
+	o := make([]ServerlogSinkResult, len(f.sinks))
+	for i, sink := range f.sinks {
+		o[i] = ServerlogSinkResult{
+			Sink:  sink.name,
+			Table: f.table,
+			ServerlogsParseResult: ServerlogsParseResult{
+				ParsedRows: sink.w.ParsedRowCount(),
+				ErrorRows:  sink.w.ErrorRowCount(),
+			},
+		}
+		if sink.err != nil {
+			o[i].Error = fmt.Sprint(sink.err)
+		}
+	}
+	return o
+}
+
+// NDJSON
+// ------
+
+// Returns the name of an NDJSON output of the upload. The {{md5}} token is
+// replaced by the writer.
+func (u *UploadMeta) GetNdjsonOutputFilename(ndjsonDir, table string) string {
+	return filepath.Join(
+		ndjsonDir,
+		SanitizeName(u.Host),
+		fmt.Sprintf("%s-%s--seq%03d--part%04d-{{md5}}.ndjson",
+			SanitizeName(table),
+			u.Date.UTC().Format("2006-01-02--15-04-05"),
+			u.SeqIdx,
+			u.PartIdx,
+		),
+	)
+}
+
+// Writes the rows as JSON objects keyed by the headers, one per line
+type ndjsonFileWriter struct {
+	tmpDir       string
+	baseFileName string
+	headers      []string
+	codec        *OutputCodec
+
+	file        *FileWriterWithTemp
+	encoder     *json.Encoder
+	outFileName string
+	isClosed    bool
+}
+
+func newNdjsonFileWriter(tmpDir, baseFileName string, headers []string, codec *OutputCodec) *ndjsonFileWriter {
+	return &ndjsonFileWriter{
+		tmpDir:       tmpDir,
+		baseFileName: baseFileName,
+		headers:      headers,
+		codec:        codec,
+	}
+}
+
+func (w *ndjsonFileWriter) WriteRow(row []string) error {
+	if w.file == nil {
+		f, err := NewFileWriterWithTemp(w.baseFileName, w.tmpDir, w.codec)
+		if err != nil {
+			return fmt.Errorf("Error creating NDJSON output file for '%s': %v", w.baseFileName, err)
+		}
+		w.file = f
+		w.outFileName = f.GetRandomFileName()
+		w.encoder = json.NewEncoder(f)
+	}
+
+	object := make(map[string]string, len(w.headers))
+	for i, header := range w.headers {
+		if i < len(row) {
+			object[header] = row[i]
+		}
+	}
+	if err := w.encoder.Encode(object); err != nil {
+		return fmt.Errorf("Error writing NDJSON output row: %v", err)
+	}
+	return nil
+}
+
+func (w *ndjsonFileWriter) OutputFileNames() []string {
+	if w.file == nil {
+		return []string{}
+	}
+	return []string{w.outFileName}
+}
+
+func (w *ndjsonFileWriter) Close() error {
+	if w.isClosed || w.file == nil {
+		return nil
+	}
+	w.isClosed = true
+
+	if err := w.file.CloseWithFileName(w.outFileName); err != nil {
+		return fmt.Errorf("Error closing NDJSON output: %v", err)
+	}
+	return nil
+}
+
+// Creates a serverlogs writer writing NDJSON files (for the parsed rows,
+// the error rows and the side tables) to the ndjsonDir
+func NewServerlogsNdjsonWriter(ndjsonDir, tmpDir string, meta *UploadMeta, parsedHeaders []string) ServerlogWriter {
+	makeWriter := func(table string, headers []string) rowFileWriter {
+		return newNdjsonFileWriter(tmpDir, meta.GetNdjsonOutputFilename(ndjsonDir, table), headers, meta.GetOutputCodec())
+	}
+
+	return &serverlogsWriter{
+		parsedWriter:  makeWriter(meta.TableName, append([]string{"filename", "host_name"}, parsedHeaders...)),
+		errorsWriter:  makeWriter(fmt.Sprintf("errors_%s", meta.TableName), []string{"error", "host_name", "filename", "line"}),
+		newSideWriter: makeWriter,
+		isClosed:      false,
+	}
+}
+
+// Live rows
+// ---------
+
+// A row parsed recently
+type ServerlogLiveRow struct {
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	File  string    `json:"file"`
+	Table string    `json:"table"`
+
+	// The parsed row by its columns
+	Row map[string]string `json:"row,omitempty"`
+	// The error and the line of the error rows
+	Error string `json:"error,omitempty"`
+	Line  string `json:"line,omitempty"`
+}
+
+// The number of live rows kept by default
+const defaultServerlogsLiveRowsSize = 1000
+
+// Keeps the latest parsed rows in memory for the live view
+type ServerlogsLiveRows struct {
+	// the rows in a ring buffer, the oldest at next once the buffer is full
+	rows []*ServerlogLiveRow
+	next int
+	size int
+
+	lock sync.Mutex
+}
+
+func NewServerlogsLiveRows(size int) *ServerlogsLiveRows {
+	if size <= 0 {
+		size = defaultServerlogsLiveRowsSize
+	}
+	return &ServerlogsLiveRows{size: size}
+}
+
+func (l *ServerlogsLiveRows) add(row *ServerlogLiveRow) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.rows) < l.size {
+		l.rows = append(l.rows, row)
+		return
+	}
+	l.rows[l.next] = row
+	l.next = (l.next + 1) % l.size
+}
+
+// Returns the latest rows of a host and table (empty for any), the newest
+// first
+func (l *ServerlogsLiveRows) Find(host, table string, limit int) []*ServerlogLiveRow {
+	o := []*ServerlogLiveRow{}
+	if l == nil {
+		return o
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i := len(l.rows) - 1; i >= 0 && len(o) < limit; i-- {
+		row := l.rows[(l.next+i)%len(l.rows)]
+		if (host == "" || host == row.Host) && (table == "" || table == row.Table) {
+			o = append(o, row)
+		}
+	}
+	return o
+}
+
+// Writes the rows of an upload to the live rows
+type liveRowsWriter struct {
+	live    *ServerlogsLiveRows
+	table   string
+	headers []string
+
+	parsedCount, errorCount int
+}
+
+func (l *ServerlogsLiveRows) newWriter(table string, headers []string) *liveRowsWriter {
+	return &liveRowsWriter{live: l, table: table, headers: headers}
+}
+
+func (w *liveRowsWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	row := make(map[string]string, len(w.headers))
+	for i, header := range w.headers {
+		if i < len(fields) {
+			row[header] = fields[i]
+		}
+	}
+	w.live.add(&ServerlogLiveRow{Time: time.Now().UTC(), Host: source.Host, File: source.Filename, Table: w.table, Row: row})
+	w.parsedCount++
+	return nil
+}
+
+func (w *liveRowsWriter) WriteError(source *ServerlogsSource, parseErr error, line string) error {
+	w.live.add(&ServerlogLiveRow{Time: time.Now().UTC(), Host: source.Host, File: source.Filename, Table: w.table, Error: fmt.Sprint(parseErr), Line: line})
+	w.errorCount++
+	return nil
+}
+
+func (w *liveRowsWriter) Close() error        { return nil }
+func (w *liveRowsWriter) ParsedRowCount() int { return w.parsedCount }
+func (w *liveRowsWriter) ErrorRowCount() int  { return w.errorCount }
+
+// The number of live rows sent by default
+const defaultServerlogsLiveLimit = 100
+
+// Handler for GET /api/v1/serverlogs/live
+func MakeServerlogsLiveHandler(live *ServerlogsLiveRows) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		limit := defaultServerlogsLiveLimit
+		if limitParam := params.Get("limit"); limitParam != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+				WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit '%s'", limitParam), r)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(live.Find(params.Get("host"), params.Get("table"), limit)); err != nil {
+			log.Error("Error encoding live serverlogs json for http.", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package insight_server
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+// A sink failing all writes
+type failingServerlogWriter struct {
+	collectingServerlogWriter
+}
+
+func (f *failingServerlogWriter) WriteParsed(source *ServerlogsSource, fields []string) error {
+	return errors.New("disk full")
+}
+
+func TestFanoutServerlogWriter(t *testing.T) {
+	output := &collectingServerlogWriter{}
+	live := NewServerlogsLiveRows(2)
+
+	w := newFanoutServerlogWriter("plainlogs", "csv", output)
+	w.addSink("failing", &failingServerlogWriter{})
+	w.addSink(ServerlogSinkLive, live.newWriter("plainlogs", []string{"ts", "line"}))
+
+	src := &ServerlogsSource{Host: "host1", Filename: "a.log"}
+	for _, line := range []string{"first", "second", "third"} {
+		// the failing sink does not fail the writes
+		tassert.Nil(t, w.WriteParsed(src, []string{"2016-10-07T15:48:25", line}))
+	}
+	tassert.Nil(t, w.WriteError(src, errors.New("bad line"), "broken"))
+	tassert.Nil(t, w.Close())
+
+	tassert.Equal(t, 3, w.ParsedRowCount())
+	tassert.Equal(t, 1, w.ErrorRowCount())
+
+	results := w.SinkResults()
+	tassert.Len(t, results, 3)
+	tassert.Equal(t, ServerlogSinkResult{Sink: "csv", Table: "plainlogs", ServerlogsParseResult: ServerlogsParseResult{ParsedRows: 3, ErrorRows: 1}}, results[0])
+	tassert.Equal(t, "disk full", results[1].Error)
+	// the failing sink is skipped after its first error
+	tassert.Equal(t, 0, results[1].ErrorRows)
+	tassert.Equal(t, ServerlogsParseResult{ParsedRows: 3, ErrorRows: 1}, results[2].ServerlogsParseResult)
+
+	// only the latest rows are kept, the newest first
+	rows := live.Find("host1", "", 10)
+	tassert.Len(t, rows, 2)
+	tassert.Equal(t, "broken", rows[0].Line)
+	tassert.Equal(t, "third", rows[1].Row["line"])
+	tassert.Len(t, live.Find("host2", "", 10), 0)
+	tassert.Len(t, live.Find("", "plainlogs", 1), 1)
+}
+
+func TestServerlogSinks_Ndjson(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	env.NdjsonDir = filepath.Join(env.TmpDir, "ndjson")
+	env.ParseStats = NewServerlogsStats(0)
+
+	archivedFile := writeTestArchivedServerlog(t, env, "host1", "plainlogs-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz",
+		"filename\vhost\vline\n"+
+			"vizqlserver_1-0.log\vhost1\v2016-10-07 15:48:25.123 (1234): Request completed\n")
+	meta, _ := makeArchivedServerlogMeta(archivedFile)
+	meta.Timezone = time.UTC
+
+	parser, err := MakePlainlogParser("")
+	tassert.Nil(t, err)
+	result, err := processServerlogRequest(env, ServerlogInput{Meta: meta, ArchivedFile: archivedFile, Format: LogFormatPlain}, parser)
+	tassert.Nil(t, err)
+	tassert.Equal(t, ServerlogsParseResult{ParsedRows: 1}, result)
+
+	outputs, err := filepath.Glob(filepath.Join(env.NdjsonDir, "host1", "plainlogs-*.ndjson.gz"))
+	tassert.Nil(t, err)
+	tassert.Len(t, outputs, 1)
+
+	r, err := NewCompressedFileReader(outputs[0])
+	tassert.Nil(t, err)
+	contents, err := ioutil.ReadAll(r)
+	r.Close()
+	tassert.Nil(t, err)
+	tassert.True(t, strings.Contains(string(contents), `"line":"Request completed"`), string(contents))
+	tassert.True(t, strings.Contains(string(contents), `"host_name":"host1"`), string(contents))
+
+	files := env.ParseStats.Find(&ServerlogsStatsFilter{})
+	tassert.Len(t, files, 1)
+	tassert.Len(t, files[0].Sinks, 2)
+	tassert.Equal(t, ServerlogSinkNdjson, files[0].Sinks[1].Sink)
+	tassert.Equal(t, 1, files[0].Sinks[1].ParsedRows)
+	tassert.Contains(t, files[0].Outputs, outputs[0])
+}
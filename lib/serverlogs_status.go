@@ -0,0 +1,237 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Serverlogs status
+// =================
+//
+// Records the outcome of parsing each serverlog file, so the error rates of
+// the hosts (and of their log files) can be followed through the status
+// endpoint. The results are kept in memory, only the latest ones are kept.
+
+// The outcome of parsing a serverlog file
+type ServerlogsFileResult struct {
+	Host         string `json:"host"`
+	File         string `json:"file"`
+	Table        string `json:"table"`
+	Format       string `json:"format"`
+	ArchivedFile string `json:"archived_file"`
+
+	ServerlogsParseResult
+
+	// The rows by log key: the Tableau log file the rows come from
+	// (like 'vizqlserver_1-0.log')
+	Logs map[string]*ServerlogsParseResult `json:"logs"`
+
+	// The output files written
+	Outputs []string `json:"outputs"`
+	// The rows written to each sink
+	Sinks []ServerlogSinkResult `json:"sinks,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// The number of file results kept by default
+const defaultServerlogsStatsSize = 10000
+
+type ServerlogsStats struct {
+	// the results in a ring buffer, the oldest at next once the buffer is full
+	results []*ServerlogsFileResult
+	next    int
+	size    int
+
+	lock sync.Mutex
+}
+
+func NewServerlogsStats(size int) *ServerlogsStats {
+	if size <= 0 {
+		size = defaultServerlogsStatsSize
+	}
+	return &ServerlogsStats{size: size}
+}
+
+// Adds the result of a file. Does nothing if the stats are nil.
+func (s *ServerlogsStats) Record(result *ServerlogsFileResult) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.results) < s.size {
+		s.results = append(s.results, result)
+		return
+	}
+	s.results[s.next] = result
+	s.next = (s.next + 1) % s.size
+}
+
+// Selects the file results by host and the time they finished
+type ServerlogsStatsFilter struct {
+	Host     string
+	From, To time.Time
+}
+
+func (f *ServerlogsStatsFilter) matches(result *ServerlogsFileResult) bool {
+	if f.Host != "" && f.Host != result.Host {
+		return false
+	}
+	if !f.From.IsZero() && result.Finished.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !result.Finished.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// Returns the file results matching the filter, the newest first
+func (s *ServerlogsStats) Find(filter *ServerlogsStatsFilter) []*ServerlogsFileResult {
+	if s == nil {
+		return []*ServerlogsFileResult{}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o := []*ServerlogsFileResult{}
+	for i := len(s.results) - 1; i >= 0; i-- {
+		result := s.results[(s.next+i)%len(s.results)]
+		if filter.matches(result) {
+			o = append(o, result)
+		}
+	}
+	return o
+}
+
+// Aggregates
+// ----------
+
+// The rows written with the rate of the error rows
+type ServerlogsErrorRate struct {
+	ServerlogsParseResult
+	// error rows / all rows
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func (r *ServerlogsErrorRate) add(result ServerlogsParseResult) {
+	r.ParsedRows += result.ParsedRows
+	r.ErrorRows += result.ErrorRows
+	if total := r.ParsedRows + r.ErrorRows; total > 0 {
+		r.ErrorRate = float64(r.ErrorRows) / float64(total)
+	}
+}
+
+// The totals of a host
+type ServerlogsHostStatus struct {
+	ServerlogsErrorRate
+	Files       int `json:"files"`
+	FailedFiles int `json:"failed_files"`
+	// The totals by log key
+	Logs map[string]*ServerlogsErrorRate `json:"logs"`
+}
+
+// The response of the status endpoint
+type ServerlogsStatus struct {
+	Hosts map[string]*ServerlogsHostStatus `json:"hosts"`
+	Files []*ServerlogsFileResult          `json:"files"`
+}
+
+// Sums the file results by host and log key
+func aggregateServerlogsResults(results []*ServerlogsFileResult) map[string]*ServerlogsHostStatus {
+	hosts := map[string]*ServerlogsHostStatus{}
+	for _, result := range results {
+		host, ok := hosts[result.Host]
+		if !ok {
+			host = &ServerlogsHostStatus{Logs: map[string]*ServerlogsErrorRate{}}
+			hosts[result.Host] = host
+		}
+
+		host.Files++
+		if result.Error != "" {
+			host.FailedFiles++
+		}
+		host.add(result.ServerlogsParseResult)
+
+		for logKey, logResult := range result.Logs {
+			if _, ok := host.Logs[logKey]; !ok {
+				host.Logs[logKey] = &ServerlogsErrorRate{}
+			}
+			host.Logs[logKey].add(*logResult)
+		}
+	}
+	return hosts
+}
+
+// HTTP HANDLERS
+// =============
+
+// The number of file results sent by default
+const defaultServerlogsStatusLimit = 100
+
+// Parses a time param given as RFC3339 or as a day
+func parseStatusTimeParam(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(reparseDateFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid '%s' time '%s', expected RFC3339 or 2006-01-02", name, value)
+	}
+	return t, nil
+}
+
+// Handler for GET /api/v1/serverlogs/status
+func MakeServerlogsStatusHandler(stats *ServerlogsStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		filter := &ServerlogsStatsFilter{Host: params.Get("host")}
+
+		var err error
+		if filter.From, err = parseStatusTimeParam("from", params.Get("from")); err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+		if filter.To, err = parseStatusTimeParam("to", params.Get("to")); err != nil {
+			WriteResponse(w, http.StatusBadRequest, fmt.Sprint(err), r)
+			return
+		}
+
+		limit := defaultServerlogsStatusLimit
+		if limitParam := params.Get("limit"); limitParam != "" {
+			if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+				WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit '%s'", limitParam), r)
+				return
+			}
+		}
+
+		results := stats.Find(filter)
+		status := &ServerlogsStatus{Hosts: aggregateServerlogsResults(results), Files: results}
+		if len(status.Files) > limit {
+			status.Files = status.Files[:limit]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Error("Error encoding serverlogs status json for http.", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestServerlogsStats_Record(t *testing.T) {
+	env, cleanup := makeTestQuarantineEnv(t)
+	defer cleanup()
+	env.ParseStats = NewServerlogsStats(0)
+
+	archivedFile := writeTestArchivedServerlog(t, env, "host1", "plainlogs-2016-10-07--15-48-25--seq000--part0000-00000000000000000000000000000000.csv.gz", testPlainServerlog)
+	meta, _ := makeArchivedServerlogMeta(archivedFile)
+	meta.Timezone = time.UTC
+
+	parserMap, err := makeServerlogsParserMap(env)
+	tassert.Nil(t, err)
+	result, err := processServerlogRequest(env, ServerlogInput{Meta: meta, ArchivedFile: archivedFile, Format: LogFormatPlain}, parserMap[LogFormatPlain])
+	tassert.Nil(t, err)
+	tassert.Equal(t, ServerlogsParseResult{ParsedRows: 1, ErrorRows: 1}, result)
+
+	// a file that is gone
+	_, err = processServerlogRequest(env, ServerlogInput{Meta: meta, ArchivedFile: filepath.Join(env.TmpDir, "missing.csv.gz"), Format: LogFormatPlain}, parserMap[LogFormatPlain])
+	tassert.NotNil(t, err)
+
+	results := env.ParseStats.Find(&ServerlogsStatsFilter{Host: "host1"})
+	tassert.Len(t, results, 2)
+	tassert.NotEqual(t, "", results[0].Error)
+	tassert.Equal(t, "plain", results[1].Format)
+	tassert.Len(t, results[1].Outputs, 2)
+	tassert.Equal(t, &ServerlogsParseResult{ParsedRows: 1}, results[1].Logs["vizqlserver_1-0.log"])
+	tassert.Equal(t, &ServerlogsParseResult{ErrorRows: 1}, results[1].Logs["vizqlserver_1-1.log"])
+
+	tassert.Len(t, env.ParseStats.Find(&ServerlogsStatsFilter{Host: "host2"}), 0)
+	tassert.Len(t, env.ParseStats.Find(&ServerlogsStatsFilter{From: time.Now().Add(time.Hour)}), 0)
+
+	// the totals by host and log key
+	w := httptest.NewRecorder()
+	MakeServerlogsStatusHandler(env.ParseStats).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/serverlogs/status?host=host1&limit=1", nil))
+	tassert.Equal(t, http.StatusOK, w.Code)
+
+	status := &ServerlogsStatus{}
+	tassert.Nil(t, json.NewDecoder(w.Body).Decode(status))
+	tassert.Len(t, status.Files, 1)
+	tassert.Equal(t, 2, status.Hosts["host1"].Files)
+	tassert.Equal(t, 1, status.Hosts["host1"].FailedFiles)
+	tassert.Equal(t, 0.5, status.Hosts["host1"].ErrorRate)
+	tassert.Equal(t, 0.0, status.Hosts["host1"].Logs["vizqlserver_1-0.log"].ErrorRate)
+	tassert.Equal(t, 1.0, status.Hosts["host1"].Logs["vizqlserver_1-1.log"].ErrorRate)
+}
+
+func TestServerlogsStats_Ring(t *testing.T) {
+	stats := NewServerlogsStats(2)
+	for _, host := range []string{"a", "b", "c"} {
+		stats.Record(&ServerlogsFileResult{Host: host})
+	}
+
+	results := stats.Find(&ServerlogsStatsFilter{})
+	tassert.Len(t, results, 2)
+	tassert.Equal(t, "c", results[0].Host)
+	tassert.Equal(t, "b", results[1].Host)
+}
@@ -0,0 +1,227 @@
+package insight_server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table schemas
+// =============
+//
+// The expected columns of the uploaded tables. Uploads of tables with a
+// schema have their header and the first rows checked before they get to
+// the loader, tables without a schema are passed through unchecked.
+
+// The column types we can check
+const (
+	TableColumnInt       = "int"
+	TableColumnTimestamp = "timestamp"
+	TableColumnText      = "text"
+)
+
+type TableSchemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type TableSchema struct {
+	Table   string              `json:"table"`
+	Columns []TableSchemaColumn `json:"columns"`
+}
+
+// The schemas by table name
+type TableSchemas map[string]*TableSchema
+
+const (
+	// How many rows after the header are checked
+	tableSchemaSampleRows = 100
+	// The most bytes read for the sample (the rows after it are not checked)
+	tableSchemaSampleMaxBytes = 16 * 1024 * 1024
+)
+
+// Loads the table schemas from a JSON file
+func LoadTableSchemas(fileName string) (TableSchemas, error) {
+	schemasFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening table schemas file '%s': %v", fileName, err)
+	}
+	defer schemasFile.Close()
+
+	schemas := []*TableSchema{}
+	if err := json.NewDecoder(schemasFile).Decode(&schemas); err != nil {
+		return nil, fmt.Errorf("Error parsing table schemas file '%s': %v", fileName, err)
+	}
+	return MakeTableSchemas(schemas)
+}
+
+// Checks the schemas and indexes them by table name
+func MakeTableSchemas(schemas []*TableSchema) (TableSchemas, error) {
+	o := TableSchemas{}
+	for _, schema := range schemas {
+		if _, isDuplicate := o[schema.Table]; isDuplicate {
+			return nil, fmt.Errorf("Duplicate schema for table '%s'", schema.Table)
+		}
+		for _, column := range schema.Columns {
+			if _, isKnown := tableColumnCheckers[column.Type]; !isKnown {
+				return nil, fmt.Errorf("Unknown type '%s' for column '%s' of table '%s'", column.Type, column.Name, schema.Table)
+			}
+		}
+		o[schema.Table] = schema
+	}
+	return o, nil
+}
+
+// Returns the schema for a table or nil if the table has no schema
+func (t TableSchemas) Get(table string) *TableSchema {
+	return t[table]
+}
+
+// Validation
+// ----------
+
+// The differences between an upload and the schema of its table
+type TableSchemaError struct {
+	Table       string
+	Differences []string
+}
+
+func (e *TableSchemaError) Error() string {
+	return fmt.Sprintf("Upload does not match the schema of table '%s':\n%s", e.Table, strings.Join(e.Differences, "\n"))
+}
+
+// The layouts accepted for timestamp columns
+var tableTimestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+}
+
+// Parses a timestamp value in any of the accepted layouts
+func parseTimestampValue(value string) (time.Time, error) {
+	for _, layout := range tableTimestampLayouts {
+		if ts, err := time.Parse(layout, value); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unknown timestamp format: '%s'", value)
+}
+
+func isTimestampValue(value string) bool {
+	_, err := parseTimestampValue(value)
+	return err == nil
+}
+
+// Checks a value for the types. Empty values are NULLs, those are accepted
+// for any type.
+var tableColumnCheckers = map[string]func(string) bool{
+	TableColumnInt: func(value string) bool {
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	},
+	TableColumnTimestamp: isTimestampValue,
+	TableColumnText: func(value string) bool {
+		return true
+	},
+}
+
+// Checks the header of the upload against the schema
+func (s *TableSchema) checkHeader(header []string) []string {
+	differences := []string{}
+	for i, column := range s.Columns {
+		if i >= len(header) {
+			differences = append(differences, fmt.Sprintf("missing column #%d: expected '%s'", i+1, column.Name))
+			continue
+		}
+		if header[i] != column.Name {
+			differences = append(differences, fmt.Sprintf("column #%d: expected '%s' got '%s'", i+1, column.Name, header[i]))
+		}
+	}
+	for i := len(s.Columns); i < len(header); i++ {
+		differences = append(differences, fmt.Sprintf("unexpected column #%d: '%s'", i+1, header[i]))
+	}
+	return differences
+}
+
+// Checks a row of the upload against the schema. rowIdx is the index of the
+// row in the file (the header is row 1).
+func (s *TableSchema) checkRow(rowIdx int, row []string) []string {
+	if len(row) != len(s.Columns) {
+		return []string{fmt.Sprintf("row %d: expected %d columns got %d", rowIdx, len(s.Columns), len(row))}
+	}
+
+	differences := []string{}
+	for i, column := range s.Columns {
+		if row[i] == "" {
+			continue
+		}
+		if !tableColumnCheckers[column.Type](row[i]) {
+			differences = append(differences, fmt.Sprintf("row %d: column '%s' expected %s got '%s'", rowIdx, column.Name, column.Type, row[i]))
+		}
+	}
+	return differences
+}
+
+// Reads the header and the first rows of an upload and checks them against
+// the schema. Returns a reader that still reads the whole upload, and an
+// error listing the differences if the sample does not match the schema.
+func (s *TableSchema) validateSample(r io.Reader) (io.Reader, error) {
+	// read the sample by CSV records (so a quoted field with newlines in it
+	// is not cut in half), keeping the bytes read for the copy
+	sample := &bytes.Buffer{}
+	csvReader := MakeCsvReader(io.TeeReader(io.LimitReader(r, tableSchemaSampleMaxBytes), sample))
+	csvReader.FieldsPerRecord = -1
+
+	// the bytes read for the sample and the rest of the upload
+	o := io.MultiReader(sample, r)
+
+	// stops checking at read errors (they are picked up while copying the
+	// rest) and at the end of the sample
+	isSampleEnd := func(err error) bool {
+		_, isParseError := err.(*csv.ParseError)
+		return err == io.EOF || !isParseError || sample.Len() >= tableSchemaSampleMaxBytes
+	}
+
+	header, err := csvReader.Read()
+	if err != nil {
+		if isSampleEnd(err) {
+			// an empty file has nothing wrong in it
+			return o, nil
+		}
+		return o, s.makeError([]string{fmt.Sprintf("Error reading header: %v", err)})
+	}
+
+	differences := s.checkHeader(header)
+	for rowIdx := 2; rowIdx <= tableSchemaSampleRows+1; rowIdx++ {
+		row, err := csvReader.Read()
+		if err != nil {
+			if !isSampleEnd(err) {
+				differences = append(differences, fmt.Sprintf("row %d: %v", rowIdx, err))
+			}
+			break
+		}
+		differences = append(differences, s.checkRow(rowIdx, row)...)
+	}
+
+	if len(differences) > 0 {
+		return o, s.makeError(differences)
+	}
+	return o, nil
+}
+
+// Wraps the differences so the uploader responds with 422
+func (s *TableSchema) makeError(differences []string) error {
+	return &UploadError{
+		Status: http.StatusUnprocessableEntity,
+		Err:    &TableSchemaError{Table: s.Table, Differences: differences},
+	}
+}
@@ -0,0 +1,76 @@
+package insight_server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+var testTableSchema = &TableSchema{
+	Table: "threadinfo",
+	Columns: []TableSchemaColumn{
+		{Name: "ts", Type: TableColumnTimestamp},
+		{Name: "pid", Type: TableColumnInt},
+		{Name: "name", Type: TableColumnText},
+	},
+}
+
+func TestTableSchema_ValidSample(t *testing.T) {
+	contents := "ts\vpid\vname\n2016-10-07 15:48:25.123\v42\vfoo\n\v\v\n"
+
+	reader, err := testTableSchema.validateSample(strings.NewReader(contents))
+	tassert.Nil(t, err)
+
+	// the whole upload can still be read
+	data, err := ioutil.ReadAll(reader)
+	tassert.Nil(t, err)
+	tassert.Equal(t, contents, string(data))
+}
+
+func TestTableSchema_MultiLineSample(t *testing.T) {
+	schema := &TableSchema{
+		Table: "threadinfo",
+		Columns: []TableSchemaColumn{
+			{Name: "name", Type: TableColumnText},
+			{Name: "pid", Type: TableColumnInt},
+		},
+	}
+
+	// a quoted field with a newline in it at the end of the sample
+	contents := "name\vpid\n" +
+		strings.Repeat("foo\v42\n", tableSchemaSampleRows-1) +
+		"\"foo\nbar\"\v42\n" +
+		"foo\v42\n"
+
+	reader, err := schema.validateSample(strings.NewReader(contents))
+	tassert.Nil(t, err)
+
+	data, err := ioutil.ReadAll(reader)
+	tassert.Nil(t, err)
+	tassert.Equal(t, contents, string(data))
+}
+
+func TestTableSchema_InvalidSample(t *testing.T) {
+	contents := "ts\vprocess_id\vname\n2016-10-07 15:48:25\vnot-a-number\vfoo\n2016-10-07\v1\n"
+
+	_, err := testTableSchema.validateSample(strings.NewReader(contents))
+	tassert.NotNil(t, err)
+	tassert.Equal(t, http.StatusUnprocessableEntity, getUploadErrorStatus(err))
+
+	schemaErr := err.(*UploadError).Err.(*TableSchemaError)
+	tassert.Equal(t, []string{
+		"column #2: expected 'pid' got 'process_id'",
+		"row 2: column 'pid' expected int got 'not-a-number'",
+		"row 3: expected 3 columns got 2",
+	}, schemaErr.Differences)
+}
+
+func TestMakeTableSchemas_UnknownType(t *testing.T) {
+	_, err := MakeTableSchemas([]*TableSchema{
+		{Table: "threadinfo", Columns: []TableSchemaColumn{{Name: "ts", Type: "date"}}},
+	})
+	tassert.NotNil(t, err)
+}
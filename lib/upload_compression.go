@@ -0,0 +1,132 @@
+package insight_server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Upload compression
+// ==================
+//
+// The agents tell the compression of the uploads in the `compression` URL
+// parameter. If it is not given, the compression is detected from the
+// magic bytes at the start of the upload.
+
+// The values of the compression URL parameter
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionLz4   = "lz4"
+	CompressionBzip2 = "bzip2"
+)
+
+// Creates a reader decompressing the upload
+type uploadDecompressor func(r io.Reader) (io.ReadCloser, error)
+
+var uploadDecompressors = map[string]uploadDecompressor{
+	CompressionNone: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+	CompressionGzip: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	CompressionZstd: func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+	CompressionLz4: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	},
+	CompressionBzip2: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+}
+
+// The magic bytes the compressed streams start with
+var uploadCompressionMagics = []struct {
+	compression string
+	magic       []byte
+	// the bytes allowed after the magic (any byte if empty)
+	next string
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}, ""},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}, ""},
+	{CompressionLz4, []byte{0x04, 0x22, 0x4d, 0x18}, ""},
+	// followed by the block size, so a plain "BZh..." text is not taken
+	// for bzip2
+	{CompressionBzip2, []byte("BZh"), "123456789"},
+}
+
+// The longest magic we have to look for
+const uploadCompressionMagicMaxLength = 4
+
+// Returns the names of the compressions we can handle
+func UploadCompressionNames() []string {
+	names := make([]string, 0, len(uploadDecompressors))
+	for name := range uploadDecompressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checks the value of the compression URL parameter. An empty value means
+// detecting the compression.
+func checkUploadCompression(compression string) error {
+	if compression == "" {
+		return nil
+	}
+	if _, isKnown := uploadDecompressors[compression]; !isKnown {
+		return &UploadError{http.StatusBadRequest, fmt.Errorf("Unknown compression '%s', known compressions: %v", compression, UploadCompressionNames())}
+	}
+	return nil
+}
+
+// Detects the compression from the magic bytes. Returns the reader that
+// has to be used instead of r.
+func detectUploadCompression(r io.Reader) (string, io.Reader) {
+	bufferedReader := bufio.NewReader(r)
+	// a short read just means a short upload
+	header, _ := bufferedReader.Peek(uploadCompressionMagicMaxLength)
+	for _, m := range uploadCompressionMagics {
+		if !bytes.HasPrefix(header, m.magic) {
+			continue
+		}
+		if m.next == "" || (len(header) > len(m.magic) && strings.IndexByte(m.next, header[len(m.magic)]) >= 0) {
+			return m.compression, bufferedReader
+		}
+	}
+	return CompressionNone, bufferedReader
+}
+
+// Returns a reader decompressing an upload
+func makeUploadDecompressor(compression string, r io.Reader) (io.ReadCloser, error) {
+	if err := checkUploadCompression(compression); err != nil {
+		return nil, err
+	}
+
+	if compression == "" {
+		compression, r = detectUploadCompression(r)
+	}
+
+	reader, err := uploadDecompressors[compression](r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %s reader: %v", compression, err)
+	}
+	return reader, nil
+}
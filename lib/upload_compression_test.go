@@ -0,0 +1,77 @@
+package insight_server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	tassert "github.com/stretchr/testify/assert"
+)
+
+const testCompressionContents = "a\vb\n1\v2\n"
+
+// testCompressionContents compressed by bzip2
+const testBzip2Contents = "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xa1\xd8\x60\xe5\x00\x00\x03\x49\x00\x00\x18\x30\x00\x30\x00\x20\x00\x30\xc0\x08\x69\xb2\x88\x23\x27\x8b\xb9\x22\x9c\x28\x48\x50\xec\x30\x72\x80"
+
+func compressForTest(t *testing.T, compression string) []byte {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(buf)
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(buf)
+		tassert.Nil(t, err)
+		w = encoder
+	case CompressionLz4:
+		w = lz4.NewWriter(buf)
+	case CompressionBzip2:
+		return []byte(testBzip2Contents)
+	}
+	w.Write([]byte(testCompressionContents))
+	tassert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func assertDecompresses(t *testing.T, compression string, data []byte) {
+	reader, err := makeUploadDecompressor(compression, bytes.NewReader(data))
+	tassert.Nil(t, err)
+	if reader == nil {
+		return
+	}
+	defer reader.Close()
+
+	contents, err := ioutil.ReadAll(reader)
+	tassert.Nil(t, err)
+	tassert.Equal(t, testCompressionContents, string(contents))
+}
+
+func TestMakeUploadDecompressor(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd, CompressionLz4, CompressionBzip2} {
+		data := compressForTest(t, compression)
+		// by the url parameter
+		assertDecompresses(t, compression, data)
+		// by the magic bytes
+		assertDecompresses(t, "", data)
+	}
+
+	assertDecompresses(t, "", []byte(testCompressionContents))
+	assertDecompresses(t, CompressionNone, []byte(testCompressionContents))
+
+	// plain text starting like bzip2 without the block size
+	for _, contents := range []string{"BZh\vb\n", "BZh", "BZh0"} {
+		compression, _ := detectUploadCompression(bytes.NewReader([]byte(contents)))
+		tassert.Equal(t, CompressionNone, compression, contents)
+	}
+}
+
+func TestMakeUploadDecompressor_Unknown(t *testing.T) {
+	_, err := makeUploadDecompressor("rar", bytes.NewReader([]byte(testCompressionContents)))
+	tassert.NotNil(t, err)
+	tassert.Equal(t, http.StatusBadRequest, getUploadErrorStatus(err))
+}
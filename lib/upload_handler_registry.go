@@ -0,0 +1,289 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Upload handler registry
+// =======================
+//
+// Upload handlers are registered by name, and the upload routes map the
+// uploaded tables to a list of handler names. The first handler in the list
+// that can handle the upload gets it.
+
+// The environment the upload handlers are created in
+type UploadHandlerEnv struct {
+	// The directory for the temporary files
+	TmpDir string
+	// The directory where the loader picks up the output files
+	BaseDir string
+	// The directory where the raw uploads are archived
+	ArchivesDir string
+	// The root directory of the parquet outputs
+	ParquetDir string
+
+	// Where the failed uploads go (can be nil, then they are dropped)
+	Quarantine *Quarantine
+	// The expected columns of the tables going to the loader (can be nil)
+	Schemas TableSchemas
+	// The codecs of the output files (can be nil)
+	Outputs *TableOutputs
+
+	// The durable queue of the serverlog parse requests (can be nil, then
+	// the requests are only kept in memory)
+	ParseQueue *ServerlogsParseQueue
+	// The results of the serverlog parsing (can be nil)
+	ParseStats *ServerlogsStats
+	// The number of serverlog parser workers and the size of their queues
+	// (0 means the default)
+	ParserWorkers, ParserQueueSize int
+	// The log formats from the configuration (can be nil)
+	LogFormats *RegexLogFormats
+	// Write the spans of the requests and sessions of the JSON serverlogs
+	// to the serverlogs_requests table
+	CorrelateRequests bool
+	// The masking rules applied to the parsed serverlogs (can be nil)
+	Masking *MaskingRules
+	// When the CSV outputs of the parsed serverlogs continue in a new file
+	OutputRotation OutputRotation
+	// The directory of the NDJSON copies of the parsed serverlogs (empty if
+	// they are not written)
+	NdjsonDir string
+	// The latest parsed serverlog rows (can be nil)
+	LiveRows *ServerlogsLiveRows
+	// Copies the outputs going to the loader into the database (can be nil)
+	PgCopy *PgCopier
+}
+
+// Creates a new instance of an upload handler
+type UploadHandlerFactory func(env *UploadHandlerEnv) (UploadHandler, error)
+
+var (
+	uploadHandlerFactories     = map[string]UploadHandlerFactory{}
+	uploadHandlerFactoriesLock sync.Mutex
+)
+
+// Makes an upload handler available for the upload routes by the given name.
+// Panics if the name is already taken.
+func RegisterUploadHandler(name string, factory UploadHandlerFactory) {
+	uploadHandlerFactoriesLock.Lock()
+	defer uploadHandlerFactoriesLock.Unlock()
+
+	if _, isRegistered := uploadHandlerFactories[name]; isRegistered {
+		panic(fmt.Sprintf("Upload handler '%s' is already registered", name))
+	}
+	uploadHandlerFactories[name] = factory
+}
+
+// Removes a registered upload handler
+func unregisterUploadHandler(name string) {
+	uploadHandlerFactoriesLock.Lock()
+	defer uploadHandlerFactoriesLock.Unlock()
+	delete(uploadHandlerFactories, name)
+}
+
+// Returns the names of the registered upload handlers
+func UploadHandlerNames() []string {
+	uploadHandlerFactoriesLock.Lock()
+	defer uploadHandlerFactoriesLock.Unlock()
+
+	names := make([]string, 0, len(uploadHandlerFactories))
+	for name := range uploadHandlerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getUploadHandlerFactory(name string) (UploadHandlerFactory, bool) {
+	uploadHandlerFactoriesLock.Lock()
+	defer uploadHandlerFactoriesLock.Unlock()
+
+	factory, isRegistered := uploadHandlerFactories[name]
+	return factory, isRegistered
+}
+
+// The names of the built-in handlers
+const (
+	UploadHandlerParseServerlogs = "parse-serverlogs"
+	UploadHandlerMetadata        = "metadata"
+	UploadHandlerPassThrough     = "pass-through"
+	UploadHandlerArchiveOnly     = "archive-only"
+	UploadHandlerDrop            = "drop"
+)
+
+func init() {
+	RegisterUploadHandler(UploadHandlerParseServerlogs, func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return NewServerlogsUploadHandler(env)
+	})
+	RegisterUploadHandler(UploadHandlerMetadata, func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return NewMetadataUploadHandler(env), nil
+	})
+	RegisterUploadHandler(UploadHandlerPassThrough, func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return &FallbackUploadHandler{env: env}, nil
+	})
+	RegisterUploadHandler(UploadHandlerArchiveOnly, func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return &archiveOnlyUploadHandler{env: env}, nil
+	})
+	RegisterUploadHandler(UploadHandlerDrop, func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return &dropUploadHandler{}, nil
+	})
+}
+
+// Routes
+// ------
+
+// Maps uploads to a list of upload handlers
+type UploadRoute struct {
+	// Regexp matching the table name of the upload
+	Table string `json:"table"`
+	// Optional regexp matching the package of the upload
+	Pkg string `json:"pkg,omitempty"`
+	// Optional regexp matching the host of the upload
+	Host string `json:"host,omitempty"`
+
+	// The names of the handlers to try in order
+	Handlers []string `json:"handlers"`
+}
+
+// The routes used for all uploads not matched by the configured routes
+var DefaultUploadRoutes = []UploadRoute{
+	{Table: isJsonServerlogRegexp.String(), Handlers: []string{UploadHandlerParseServerlogs}},
+	{Table: isPlainServerlogRegexp.String(), Handlers: []string{UploadHandlerParseServerlogs}},
+	{Table: isMetadataRegexp.String(), Handlers: []string{UploadHandlerMetadata}},
+}
+
+// Loads the upload routes from a JSON file
+func LoadUploadRoutes(fileName string) ([]UploadRoute, error) {
+	routesFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening upload routes file '%s': %v", fileName, err)
+	}
+	defer routesFile.Close()
+
+	routes := []UploadRoute{}
+	if err := json.NewDecoder(routesFile).Decode(&routes); err != nil {
+		return nil, fmt.Errorf("Error parsing upload routes file '%s': %v", fileName, err)
+	}
+	return routes, nil
+}
+
+// A route with the patterns compiled and the handlers created
+type uploadRoute struct {
+	table, pkg, host *regexp.Regexp
+	handlers         []UploadHandler
+}
+
+// Returns true if this route is responsible for an upload
+func (r *uploadRoute) matches(meta *UploadMeta) bool {
+	return r.table.MatchString(meta.TableName) &&
+		(r.pkg == nil || r.pkg.MatchString(meta.Pkg)) &&
+		(r.host == nil || r.host.MatchString(meta.Host))
+}
+
+// Compiles an optional pattern of a route
+func compileRoutePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// Creates the handlers for the routes. Each handler is only created once,
+// even if it is used by many routes.
+func makeUploadRoutes(env *UploadHandlerEnv, routes []UploadRoute) ([]*uploadRoute, map[string]UploadHandler, error) {
+	handlers := map[string]UploadHandler{}
+	getHandler := func(name string) (UploadHandler, error) {
+		if handler, hasHandler := handlers[name]; hasHandler {
+			return handler, nil
+		}
+
+		factory, isRegistered := getUploadHandlerFactory(name)
+		if !isRegistered {
+			return nil, fmt.Errorf("Unknown upload handler '%s', known handlers: %v", name, UploadHandlerNames())
+		}
+
+		handler, err := factory(env)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating upload handler '%s': %v", name, err)
+		}
+		handlers[name] = handler
+		return handler, nil
+	}
+
+	o := make([]*uploadRoute, len(routes))
+	for i, route := range routes {
+		table, err := regexp.Compile(route.Table)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid table pattern in upload route '%s': %v", route.Table, err)
+		}
+		pkg, err := compileRoutePattern(route.Pkg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid pkg pattern in upload route '%s': %v", route.Pkg, err)
+		}
+		host, err := compileRoutePattern(route.Host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid host pattern in upload route '%s': %v", route.Host, err)
+		}
+
+		if len(route.Handlers) == 0 {
+			return nil, nil, fmt.Errorf("No handlers given for upload route '%s'", route.Table)
+		}
+
+		routeHandlers := make([]UploadHandler, len(route.Handlers))
+		for j, name := range route.Handlers {
+			if routeHandlers[j], err = getHandler(name); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		log.Infof("Upload route: table=%s pkg=%s host=%s handlers=%v", route.Table, route.Pkg, route.Host, route.Handlers)
+		o[i] = &uploadRoute{table: table, pkg: pkg, host: host, handlers: routeHandlers}
+	}
+
+	return o, handlers, nil
+}
+
+// Archive only handler
+// ====================
+
+// Stores the uploads in the archives without passing them to the loader
+type archiveOnlyUploadHandler struct {
+	env *UploadHandlerEnv
+}
+
+func (a *archiveOnlyUploadHandler) CanHandle(meta *UploadMeta) bool {
+	return true
+}
+
+func (a *archiveOnlyUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	_, err := copyUploadedFileAndCheckMd5(a.env, meta, reader, nil, a.env.ArchivesDir, false)
+	return err
+}
+
+// Drop handler
+// ============
+
+// Accepts uploads without storing them anywhere
+type dropUploadHandler struct{}
+
+func (d *dropUploadHandler) CanHandle(meta *UploadMeta) bool {
+	return true
+}
+
+func (d *dropUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return fmt.Errorf("Error reading upload: %v", err)
+	}
+	log.Infof("Dropped upload. host=%s file=%s table=%s", meta.Host, meta.OriginalFilename, meta.TableName)
+	return nil
+}
@@ -0,0 +1,53 @@
+package insight_server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func TestUploader_Routes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-routes")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	handler := &countingUploadHandler{}
+	RegisterUploadHandler("test-counting", func(env *UploadHandlerEnv) (UploadHandler, error) {
+		return handler, nil
+	})
+	defer unregisterUploadHandler("test-counting")
+
+	env := &UploadHandlerEnv{TmpDir: dir, BaseDir: dir, ArchivesDir: dir}
+	uploader, err := NewUploader(env, []UploadRoute{
+		{Table: "^countersamples$", Host: "^node1$", Handlers: []string{"test-counting"}},
+		{Table: "^threadinfo$", Handlers: []string{UploadHandlerDrop}},
+	}, false, nil)
+	tassert.Nil(t, err)
+
+	meta := makeTestUploadMeta("md5")
+	meta.TableName = "countersamples"
+	meta.Host = "node1"
+	tassert.Equal(t, handler, uploader.findUploadHandler(meta))
+
+	// the host does not match, so the fallback gets it
+	meta.Host = "node2"
+	tassert.IsType(t, &FallbackUploadHandler{}, uploader.findUploadHandler(meta))
+
+	// the default routes are still there
+	meta.TableName = "serverlogs"
+	tassert.IsType(t, &ServerlogsUploadHandler{}, uploader.findUploadHandler(meta))
+
+	meta.TableName = "threadinfo"
+	tassert.Nil(t, uploader.HandleUpload(meta, strings.NewReader("data")))
+	tassert.Equal(t, 0, handler.count)
+}
+
+func TestUploader_UnknownHandler(t *testing.T) {
+	_, err := NewUploader(&UploadHandlerEnv{}, []UploadRoute{
+		{Table: "^countersamples$", Handlers: []string{"no-such-handler"}},
+	}, false, nil)
+	tassert.NotNil(t, err)
+}
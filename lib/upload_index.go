@@ -0,0 +1,251 @@
+package insight_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Upload index
+// ============
+//
+// Keeps track of the uploads we already accepted, so uploads retried by the
+// agents (after a timeout for example) are not written twice.
+
+// The identity of an upload as sent by the agent
+type UploadKey struct {
+	Host      string    `json:"host"`
+	Pkg       string    `json:"pkg"`
+	TableName string    `json:"table"`
+	Date      time.Time `json:"date"`
+	SeqIdx    int       `json:"seq"`
+	PartIdx   int       `json:"part"`
+}
+
+func makeUploadKey(meta *UploadMeta) UploadKey {
+	return UploadKey{
+		Host:      meta.Host,
+		Pkg:       meta.Pkg,
+		TableName: meta.TableName,
+		Date:      meta.Date.UTC(),
+		SeqIdx:    meta.SeqIdx,
+		PartIdx:   meta.PartIdx,
+	}
+}
+
+func (k UploadKey) String() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d", k.Host, k.Pkg, k.TableName, k.Date.Format(agentFilenameDateFormat), k.SeqIdx, k.PartIdx)
+}
+
+// An accepted upload
+type UploadIndexEntry struct {
+	UploadKey
+
+	// The md5 the agent sent for this upload
+	Md5 []byte `json:"md5"`
+
+	// When did we accept the upload
+	Accepted time.Time `json:"accepted"`
+}
+
+type UploadIndexStatus int
+
+const (
+	// We have not seen this upload yet (or it was not finished)
+	UploadIsNew = UploadIndexStatus(iota)
+	// The upload was accepted before
+	UploadIsAccepted
+	// The upload is being handled right now
+	UploadIsInProgress
+)
+
+// INTERFACE
+// =========
+
+type UploadIndex interface {
+	// Checks the upload and marks it as in-progress if its new.
+	// Returns the previously accepted entry for UploadIsAccepted.
+	Begin(meta *UploadMeta) (UploadIndexStatus, *UploadIndexEntry, error)
+
+	// Marks the end of handling an upload started by Begin(). If success
+	// is true, the upload is added to the index.
+	Finish(meta *UploadMeta, success bool) error
+}
+
+// Creates a new upload index that persists its entries in the given directory.
+// Entries older than maxAge are forgotten.
+func MakeFileUploadIndex(directory string, maxAge time.Duration) (UploadIndex, error) {
+	if err := CreateDirectoryIfNotExists(directory); err != nil {
+		return nil, fmt.Errorf("Error creating upload index directory '%s': %v", directory, err)
+	}
+
+	index := &fileUploadIndex{
+		directory:  directory,
+		maxAge:     maxAge,
+		entries:    map[string]*UploadIndexEntry{},
+		inProgress: map[string]bool{},
+	}
+
+	if err := index.load(); err != nil {
+		return nil, err
+	}
+
+	// write back only the entries we still care about
+	if err := index.compact(); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// IMPLEMENTATION
+// ==============
+
+// the name of the journal file the entries are appended to
+const uploadIndexFileName = "uploads.json"
+
+// How often do we drop the expired entries from the journal
+const uploadIndexCompactInterval = 24 * time.Hour
+
+type fileUploadIndex struct {
+	directory string
+	maxAge    time.Duration
+
+	entries    map[string]*UploadIndexEntry
+	inProgress map[string]bool
+
+	journal     *os.File
+	lastCompact time.Time
+
+	lock sync.Mutex
+}
+
+func (u *fileUploadIndex) fileName() string {
+	return filepath.Join(u.directory, uploadIndexFileName)
+}
+
+func (u *fileUploadIndex) isExpired(entry *UploadIndexEntry) bool {
+	return time.Since(entry.Accepted) > u.maxAge
+}
+
+// Loads the entries from the journal
+func (u *fileUploadIndex) load() error {
+	journal, err := os.Open(u.fileName())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error opening upload index '%s': %v", u.fileName(), err)
+	}
+	defer journal.Close()
+
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		entry := &UploadIndexEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// a partially written last line should not keep the server from starting
+			log.Errorf("Skipping invalid upload index entry. file=%s err=%s", u.fileName(), err)
+			continue
+		}
+		if !u.isExpired(entry) {
+			u.entries[entry.UploadKey.String()] = entry
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Rewrites the journal with only the non-expired entries
+func (u *fileUploadIndex) compact() error {
+	tmpFile, err := ioutil.TempFile(u.directory, "uploads-compact")
+	if err != nil {
+		return fmt.Errorf("Error opening temp file: %v", err)
+	}
+	defer tmpFile.Close()
+
+	encoder := json.NewEncoder(tmpFile)
+	for key, entry := range u.entries {
+		if u.isExpired(entry) {
+			delete(u.entries, key)
+			continue
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("Error while serializing upload index entry: %v", err)
+		}
+	}
+
+	// close the temp file so we flush
+	tmpFile.Close()
+
+	if u.journal != nil {
+		u.journal.Close()
+		u.journal = nil
+	}
+
+	// move to its final destination
+	if err := os.Rename(tmpFile.Name(), u.fileName()); err != nil {
+		return fmt.Errorf("Error while moving upload index file '%s' to '%s': %v", tmpFile.Name(), u.fileName(), err)
+	}
+
+	journal, err := os.OpenFile(u.fileName(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening upload index '%s': %v", u.fileName(), err)
+	}
+
+	u.journal = journal
+	u.lastCompact = time.Now()
+	return nil
+}
+
+func (u *fileUploadIndex) Begin(meta *UploadMeta) (UploadIndexStatus, *UploadIndexEntry, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	key := makeUploadKey(meta).String()
+
+	if entry, hasEntry := u.entries[key]; hasEntry && !u.isExpired(entry) {
+		return UploadIsAccepted, entry, nil
+	}
+
+	if u.inProgress[key] {
+		return UploadIsInProgress, nil, nil
+	}
+
+	u.inProgress[key] = true
+	return UploadIsNew, nil, nil
+}
+
+func (u *fileUploadIndex) Finish(meta *UploadMeta, success bool) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	key := makeUploadKey(meta)
+	delete(u.inProgress, key.String())
+
+	if !success {
+		return nil
+	}
+
+	entry := &UploadIndexEntry{
+		UploadKey: key,
+		Md5:       meta.OriginalMd5,
+		Accepted:  time.Now().UTC(),
+	}
+	u.entries[key.String()] = entry
+
+	if time.Since(u.lastCompact) > uploadIndexCompactInterval {
+		return u.compact()
+	}
+
+	if err := json.NewEncoder(u.journal).Encode(entry); err != nil {
+		return fmt.Errorf("Error writing upload index entry: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package insight_server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	tassert "github.com/stretchr/testify/assert"
+)
+
+func makeTestUploadMeta(md5 string) *UploadMeta {
+	return &UploadMeta{
+		Host:        "local",
+		Pkg:         "public",
+		TableName:   "threadinfo",
+		Date:        time.Date(2016, time.October, 7, 15, 48, 25, 0, time.UTC),
+		OriginalMd5: []byte(md5),
+	}
+}
+
+// Upload handler that counts the uploads it got (the first failures uploads
+// fail)
+type countingUploadHandler struct {
+	count    int
+	failures int
+}
+
+func (c *countingUploadHandler) CanHandle(meta *UploadMeta) bool { return true }
+func (c *countingUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	c.count++
+	if c.count <= c.failures {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestFileUploadIndex_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-index")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	index, err := MakeFileUploadIndex(dir, time.Hour)
+	tassert.Nil(t, err)
+
+	meta := makeTestUploadMeta("md5")
+	status, _, err := index.Begin(meta)
+	tassert.Nil(t, err)
+	tassert.Equal(t, UploadIsNew, status)
+
+	status, _, _ = index.Begin(meta)
+	tassert.Equal(t, UploadIsInProgress, status)
+
+	tassert.Nil(t, index.Finish(meta, true))
+
+	// reload from disk
+	index, err = MakeFileUploadIndex(dir, time.Hour)
+	tassert.Nil(t, err)
+	status, entry, err := index.Begin(meta)
+	tassert.Nil(t, err)
+	tassert.Equal(t, UploadIsAccepted, status)
+	tassert.Equal(t, []byte("md5"), entry.Md5)
+
+	// expired entries are dropped on load
+	index, err = MakeFileUploadIndex(dir, 0)
+	tassert.Nil(t, err)
+	status, _, _ = index.Begin(meta)
+	tassert.Equal(t, UploadIsNew, status)
+}
+
+func TestUploader_SkipsDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-index")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	index, err := MakeFileUploadIndex(dir, time.Hour)
+	tassert.Nil(t, err)
+
+	handler := &countingUploadHandler{}
+	uploader := &Uploader{fallback: handler, index: index}
+
+	tassert.Nil(t, uploader.HandleUpload(makeTestUploadMeta("md5"), strings.NewReader("data")))
+	tassert.Nil(t, uploader.HandleUpload(makeTestUploadMeta("md5"), strings.NewReader("data")))
+	tassert.Equal(t, 1, handler.count)
+
+	err = uploader.HandleUpload(makeTestUploadMeta("other"), strings.NewReader("other data"))
+	tassert.NotNil(t, err)
+	tassert.Equal(t, http.StatusConflict, getUploadErrorStatus(err))
+	tassert.Equal(t, 1, handler.count)
+}
+
+func TestUploader_RetriesFailedUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-index")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	index, err := MakeFileUploadIndex(dir, time.Hour)
+	tassert.Nil(t, err)
+
+	handler := &countingUploadHandler{failures: 1}
+	uploader := &Uploader{fallback: handler, index: index}
+
+	// the failed upload is not accepted, the retry is handled again
+	tassert.NotNil(t, uploader.HandleUpload(makeTestUploadMeta("md5"), strings.NewReader("data")))
+	tassert.Nil(t, uploader.HandleUpload(makeTestUploadMeta("md5"), strings.NewReader("data")))
+	tassert.Equal(t, 2, handler.count)
+
+	tassert.Nil(t, uploader.HandleUpload(makeTestUploadMeta("md5"), strings.NewReader("data")))
+	tassert.Equal(t, 2, handler.count)
+}
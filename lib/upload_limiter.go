@@ -0,0 +1,306 @@
+package insight_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Upload limiter
+// ==============
+//
+// Limits the number of concurrent uploads and the bandwidth they may use,
+// both per agent host and for the whole server. Requests over the
+// concurrency limits are rejected right away with a Retry-After header:
+//
+// - 429 Too Many Requests if the host already has too many uploads running
+// - 503 Service Unavailable if the server as a whole is at its limit
+//
+// Bandwidth limits do not reject requests, they slow down reading the body.
+
+// The limits of the uploads. Zero means unlimited.
+type UploadLimits struct {
+	// The maximum number of concurrent uploads
+	MaxConcurrent int `json:"maxConcurrent"`
+	// The maximum number of concurrent uploads of one host
+	MaxConcurrentPerHost int `json:"maxConcurrentPerHost"`
+	// The maximum bytes per second read from all uploads
+	MaxBandwidth int64 `json:"maxBandwidth"`
+	// The maximum bytes per second read from the uploads of one host
+	MaxBandwidthPerHost int64 `json:"maxBandwidthPerHost"`
+	// The delay sent in the Retry-After header of rejected requests
+	RetryAfter time.Duration `json:"-"`
+}
+
+// The state of the uploads of one host (or of the whole server)
+type UploadLimiterState struct {
+	Active int `json:"active"`
+	// The number of requests rejected since startup
+	Rejected int64 `json:"rejected"`
+	// The number of body bytes read since startup
+	BytesRead int64 `json:"bytesRead"`
+	// When was the last upload started
+	LastUpload time.Time `json:"lastUpload,omitempty"`
+
+	bandwidth *bandwidthLimiter
+}
+
+// The JSON sent by the status endpoint
+type UploadLimiterStatus struct {
+	Limits            UploadLimits                  `json:"limits"`
+	RetryAfterSeconds int                           `json:"retryAfterSeconds"`
+	Global            UploadLimiterState            `json:"global"`
+	Hosts             map[string]UploadLimiterState `json:"hosts"`
+}
+
+type UploadLimiter struct {
+	limits UploadLimits
+
+	global UploadLimiterState
+	hosts  map[string]*UploadLimiterState
+
+	lock sync.Mutex
+}
+
+// The Retry-After used if none is configured
+const defaultUploadRetryAfter = 30 * time.Second
+
+func NewUploadLimiter(limits UploadLimits) *UploadLimiter {
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = defaultUploadRetryAfter
+	}
+	return &UploadLimiter{
+		limits: limits,
+		global: UploadLimiterState{bandwidth: newBandwidthLimiter(limits.MaxBandwidth)},
+		hosts:  map[string]*UploadLimiterState{},
+	}
+}
+
+// Tries to start an upload for a host. Returns the http status to reject the
+// request with, or 0 if the upload can go on (and release() has to be called
+// once it is done).
+func (l *UploadLimiter) acquire(host string) (*UploadLimiterState, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	hostState, ok := l.hosts[host]
+	if !ok {
+		hostState = &UploadLimiterState{bandwidth: newBandwidthLimiter(l.limits.MaxBandwidthPerHost)}
+		l.hosts[host] = hostState
+	}
+
+	if l.limits.MaxConcurrentPerHost > 0 && hostState.Active >= l.limits.MaxConcurrentPerHost {
+		hostState.Rejected++
+		l.global.Rejected++
+		return nil, http.StatusTooManyRequests
+	}
+	if l.limits.MaxConcurrent > 0 && l.global.Active >= l.limits.MaxConcurrent {
+		hostState.Rejected++
+		l.global.Rejected++
+		l.pruneHost(host, hostState)
+		return nil, http.StatusServiceUnavailable
+	}
+
+	now := time.Now().UTC()
+	hostState.Active++
+	hostState.LastUpload = now
+	l.global.Active++
+	l.global.LastUpload = now
+	return hostState, 0
+}
+
+func (l *UploadLimiter) release(host string, hostState *UploadLimiterState) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	hostState.Active--
+	l.global.Active--
+	l.pruneHost(host, hostState)
+}
+
+// Forgets a host without running uploads, so the hosts do not pile up
+func (l *UploadLimiter) pruneHost(host string, hostState *UploadLimiterState) {
+	if hostState.Active <= 0 && l.hosts[host] == hostState {
+		delete(l.hosts, host)
+	}
+}
+
+func (l *UploadLimiter) addBytesRead(hostState *UploadLimiterState, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	hostState.BytesRead += int64(n)
+	l.global.BytesRead += int64(n)
+}
+
+// Returns a snapshot of the limiter state
+func (l *UploadLimiter) Status() UploadLimiterStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	hosts := make(map[string]UploadLimiterState, len(l.hosts))
+	for host, state := range l.hosts {
+		hosts[host] = *state
+	}
+	return UploadLimiterStatus{
+		Limits:            l.limits,
+		RetryAfterSeconds: l.retryAfterSeconds(),
+		Global:            l.global,
+		Hosts:             hosts,
+	}
+}
+
+func (l *UploadLimiter) retryAfterSeconds() int {
+	seconds := int(l.limits.RetryAfter / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// Returns the host an upload request is coming from: the 'host' URL param
+// the agents send, or the remote address if there is none
+func getUploadRequestHost(r *http.Request) string {
+	if host := r.URL.Query().Get(hostUrlParam); host != "" {
+		return host
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Returns the host of the upload session of a request: the 'host' param
+// the session was created with, like the uploads of the same host in one
+// request
+func getUploadSessionRequestHost(store *UploadSessionStore, r *http.Request) string {
+	if session, err := store.Get(mux.Vars(r)["id"]); err == nil && session.Params[hostUrlParam] != "" {
+		return session.Params[hostUrlParam]
+	}
+	return getUploadRequestHost(r)
+}
+
+// Middleware limiting the uploads passing through it
+func (l *UploadLimiter) Middleware(h http.Handler) http.Handler {
+	return l.middleware(getUploadRequestHost, h)
+}
+
+// Middleware limiting the chunks and the commits of the upload sessions by
+// the host of their session
+func (l *UploadLimiter) SessionMiddleware(store *UploadSessionStore, h http.Handler) http.Handler {
+	return l.middleware(func(r *http.Request) string { return getUploadSessionRequestHost(store, r) }, h)
+}
+
+func (l *UploadLimiter) middleware(requestHost func(r *http.Request) string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+
+		hostState, status := l.acquire(host)
+		if status != 0 {
+			log.Warningf("Upload rejected by limiter: host=%s status=%d", host, status)
+			w.Header().Set("Retry-After", fmt.Sprint(l.retryAfterSeconds()))
+			WriteResponse(w, status, "Too many concurrent uploads, retry later", r)
+			return
+		}
+		defer l.release(host, hostState)
+
+		if r.Body != nil {
+			r.Body = &limitedUploadBody{
+				ReadCloser: r.Body,
+				limiter:    l,
+				hostState:  hostState,
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler for GET /api/v1/limits
+func MakeUploadLimiterStatusHandler(limiter *UploadLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(limiter.Status()); err != nil {
+			log.Error("Error encoding limiter status json for http.", err)
+		}
+	}
+}
+
+// Bandwidth limiting
+// ------------------
+
+// The largest chunk read from a limited body at once
+const limitedUploadBodyChunkSize = 32 * 1024
+
+// The request body of an upload that waits for the bandwidth limiters
+type limitedUploadBody struct {
+	io.ReadCloser
+	limiter   *UploadLimiter
+	hostState *UploadLimiterState
+}
+
+func (b *limitedUploadBody) Read(p []byte) (int, error) {
+	if len(p) > limitedUploadBodyChunkSize {
+		p = p[:limitedUploadBodyChunkSize]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.addBytesRead(b.hostState, n)
+
+		// wait for the slower of the two limits
+		wait := b.hostState.bandwidth.reserve(n)
+		if globalWait := b.limiter.global.bandwidth.reserve(n); globalWait > wait {
+			wait = globalWait
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// A token bucket of bytes allowing one second worth of burst
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	available      float64
+	last           time.Time
+	lock           sync.Mutex
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+		available:      float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Takes n bytes from the bucket and returns how long the caller has to wait
+// before using them
+func (b *bandwidthLimiter) reserve(n int) time.Duration {
+	if b == nil || b.bytesPerSecond <= 0 {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.available += now.Sub(b.last).Seconds() * float64(b.bytesPerSecond)
+	if b.available > float64(b.bytesPerSecond) {
+		b.available = float64(b.bytesPerSecond)
+	}
+	b.last = now
+
+	b.available -= float64(n)
+	if b.available >= 0 {
+		return 0
+	}
+	return time.Duration(-b.available / float64(b.bytesPerSecond) * float64(time.Second))
+}
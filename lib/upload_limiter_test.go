@@ -0,0 +1,105 @@
+package insight_server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	tassert "github.com/stretchr/testify/assert"
+)
+
+// Starts an upload through the limiter that blocks until release is closed
+func startBlockedUpload(limiter *UploadLimiter, host string, started *sync.WaitGroup, release chan struct{}) {
+	started.Add(1)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload?host="+host, nil))
+}
+
+func TestUploadLimiter_Concurrency(t *testing.T) {
+	limiter := NewUploadLimiter(UploadLimits{MaxConcurrent: 2, MaxConcurrentPerHost: 1, RetryAfter: 10 * time.Second})
+	okHandler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	release := make(chan struct{})
+	started := &sync.WaitGroup{}
+	startBlockedUpload(limiter, "host-a", started, release)
+	started.Wait()
+
+	// same host: over the per host limit
+	w := httptest.NewRecorder()
+	okHandler.ServeHTTP(w, httptest.NewRequest("POST", "/upload?host=host-a", nil))
+	tassert.Equal(t, http.StatusTooManyRequests, w.Code)
+	tassert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	startBlockedUpload(limiter, "host-b", started, release)
+	started.Wait()
+
+	// another host: over the global limit
+	w = httptest.NewRecorder()
+	okHandler.ServeHTTP(w, httptest.NewRequest("POST", "/upload?host=host-c", nil))
+	tassert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	tassert.Equal(t, "10", w.Header().Get("Retry-After"))
+
+	status := limiter.Status()
+	tassert.Equal(t, 2, status.Global.Active)
+	tassert.Equal(t, int64(2), status.Global.Rejected)
+	tassert.Equal(t, 1, status.Hosts["host-a"].Active)
+	tassert.Equal(t, int64(1), status.Hosts["host-a"].Rejected)
+
+	close(release)
+	for i := 0; i < 100 && limiter.Status().Global.Active > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the hosts without uploads are forgotten
+	tassert.Len(t, limiter.Status().Hosts, 0)
+
+	w = httptest.NewRecorder()
+	okHandler.ServeHTTP(w, httptest.NewRequest("POST", "/upload?host=host-a", nil))
+	tassert.Equal(t, http.StatusOK, w.Code)
+	tassert.Len(t, limiter.Status().Hosts, 0)
+}
+
+func TestUploadLimiter_Sessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-sessions")
+	tassert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewUploadSessionStore(dir)
+	tassert.Nil(t, err)
+	session, err := store.Create(map[string]string{"pkg": "public", "host": "host-a", "tz": "UTC"}, "threadinfo-2016-10-07--15-48-25--seq0000--part0000.csv")
+	tassert.Nil(t, err)
+
+	limiter := NewUploadLimiter(UploadLimits{MaxConcurrentPerHost: 1})
+	release := make(chan struct{})
+	started := &sync.WaitGroup{}
+	startBlockedUpload(limiter, "host-a", started, release)
+	started.Wait()
+	defer close(release)
+
+	// the chunks of the session count against the host of the session, not
+	// the remote address
+	handler := limiter.SessionMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("PUT", "/upload/sessions/"+session.Id, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, mux.SetURLVars(r, map[string]string{"id": session.Id}))
+	tassert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	b := newBandwidthLimiter(1000)
+	// one second of burst
+	tassert.Equal(t, time.Duration(0), b.reserve(1000))
+	wait := b.reserve(500)
+	tassert.True(t, wait > 400*time.Millisecond && wait <= 500*time.Millisecond, "wait: %v", wait)
+
+	// no limit
+	tassert.Equal(t, time.Duration(0), newBandwidthLimiter(0).reserve(1000000))
+}
@@ -2,6 +2,7 @@ package insight_server
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,9 +11,10 @@ import (
 
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"net/url"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -48,10 +50,47 @@ type UploadMeta struct {
 	// this flag from its implementation
 	UseOldFormatFilename bool
 
+	// The codec of the output files (nil means the default codec). Set
+	// from the configuration the same way as UseOldFormatFilename.
+	OutputCodec *OutputCodec
+
 	// The orignal Md5 the agent sent us
 	OriginalMd5 []byte
 }
 
+// Serializes the metadata to JSON. The timezone is serialized by its name.
+func (u UploadMeta) MarshalJSON() ([]byte, error) {
+	type uploadMetaFields UploadMeta
+	timezone := ""
+	if u.Timezone != nil {
+		timezone = u.Timezone.String()
+	}
+	return json.Marshal(&struct {
+		uploadMetaFields
+		Timezone string
+	}{uploadMetaFields(u), timezone})
+}
+
+// Loads metadata serialized by MarshalJSON()
+func (u *UploadMeta) UnmarshalJSON(data []byte) error {
+	type uploadMetaFields UploadMeta
+	fields := &struct {
+		*uploadMetaFields
+		Timezone string
+	}{uploadMetaFields: (*uploadMetaFields)(u)}
+
+	if err := json.Unmarshal(data, fields); err != nil {
+		return err
+	}
+
+	timezone, err := time.LoadLocation(fields.Timezone)
+	if err != nil {
+		return fmt.Errorf("Unknown time zone '%s': %v", fields.Timezone, err)
+	}
+	u.Timezone = timezone
+	return nil
+}
+
 // Returns the file name for an upload request
 func (u *UploadMeta) GetOutputFilename(baseDir string) string {
 	dateUtc := u.Date.UTC()
@@ -94,41 +133,152 @@ func (u *UploadMeta) GetOutputFilename(baseDir string) string {
 	))
 }
 
+// Returns the codec the output files of this upload are written with
+func (u *UploadMeta) GetOutputCodec() *OutputCodec {
+	if u.OutputCodec == nil {
+		return DefaultOutputCodec
+	}
+	return u.OutputCodec
+}
+
 // Gets a proper writer for this file
-func (u *UploadMeta) GetOutputGzippedWriter(baseDir, tmpDir string) (*GzippedFileWriterWithTemp, error) {
-	return NewGzippedFileWriterWithTemp(u.GetOutputFilename(baseDir), tmpDir)
+func (u *UploadMeta) GetOutputWriter(baseDir, tmpDir string) (*FileWriterWithTemp, error) {
+	return NewFileWriterWithTemp(u.GetOutputFilename(baseDir), tmpDir, u.GetOutputCodec())
 }
 
 const (
 	// The maximum size of the message we are willing to parse
-	// when dealing with multipart messages
+	// when dealing with multipart messages (uploads are streamed, so
+	// this only applies to the other endpoints)
 	multipartMaxSize = 2 * 1024 * 1024 * 1024
 
 	// The directory permissions to use when creating a new directory
 	OUTPUT_DEFAULT_DIRMODE = 0755
 )
 
-// Creates an http endpoint handler where
-func MakeUploadHandler(maxidBackend MaxIdBackend, tmpDir, baseDir, archivesDir string, useOldFormatFilename bool) (http.HandlerFunc, error) {
+// An error during handling an upload that should be reported to the agent
+// with a specific HTTP status
+type UploadError struct {
+	Status int
+	Err    error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprint(e.Err)
+}
+
+// Returns the HTTP status to respond with for an error returned by the upload handlers
+func getUploadErrorStatus(err error) int {
+	if uploadErr, ok := err.(*UploadError); ok {
+		return uploadErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// Dispatches uploaded files to the upload handler responsible for them
+type Uploader struct {
+	// the routes selecting the handlers for the uploads
+	routes []*uploadRoute
 	// the fallback handler to move files
-	fallbackHandler := &FallbackUploadHandler{tmpDir: tmpDir, baseDir: baseDir}
+	fallback UploadHandler
+
+	// the index of already accepted uploads (can be nil)
+	index UploadIndex
+
+	// the codecs of the output files (can be nil)
+	outputs *TableOutputs
 
-	serverlogsParserHandler, err := NewServerlogsUploadHandler(tmpDir, baseDir, archivesDir)
+	useOldFormatFilename bool
+}
 
-	// handle errors during parser handler creation (boltDB errors most likely)
+// Creates a new uploader. The routes are checked before the default routes,
+// uploads not matched by any route are passed through to the loader.
+// If index is not nil, uploads already in the index are not handled again.
+func NewUploader(env *UploadHandlerEnv, routes []UploadRoute, useOldFormatFilename bool, index UploadIndex) (*Uploader, error) {
+	allRoutes := append(append([]UploadRoute{}, routes...), env.LogFormats.UploadRoutes()...)
+	allRoutes = append(allRoutes, DefaultUploadRoutes...)
+	// the catch-all route, so the fallback handler is created like the rest
+	allRoutes = append(allRoutes, UploadRoute{Table: "", Handlers: []string{UploadHandlerPassThrough}})
+
+	uploadRoutes, handlers, err := makeUploadRoutes(env, allRoutes)
+	// handle errors during handler creation
 	if err != nil {
 		return nil, err
 	}
 
-	// processing handlers
-	handlers := []UploadHandler{
-		serverlogsParserHandler,
-		NewMetadataUploadHandler(tmpDir, baseDir, archivesDir),
+	return &Uploader{
+		routes:               uploadRoutes,
+		fallback:             handlers[UploadHandlerPassThrough],
+		index:                index,
+		outputs:              env.Outputs,
+		useOldFormatFilename: useOldFormatFilename,
+	}, nil
+}
+
+// Runs an uploaded file through the handler responsible for its table
+func (u *Uploader) HandleUpload(meta *UploadMeta, reader io.Reader) (err error) {
+	// update the filename flag and the output codec from the config
+	meta.UseOldFormatFilename = u.useOldFormatFilename
+	meta.OutputCodec = u.outputs.Get(meta.TableName)
+
+	if u.index != nil {
+		var status UploadIndexStatus
+		var entry *UploadIndexEntry
+		// assign to the named err, so the deferred Finish sees the result
+		if status, entry, err = u.index.Begin(meta); err != nil {
+			return err
+		}
+
+		switch status {
+		case UploadIsAccepted:
+			return checkDuplicateUpload(meta, reader, entry)
+		case UploadIsInProgress:
+			return &UploadError{http.StatusServiceUnavailable, fmt.Errorf("Upload of '%s' from '%s' is already in progress", meta.OriginalFilename, meta.Host)}
+		}
+
+		defer func() {
+			if indexErr := u.index.Finish(meta, err == nil); indexErr != nil {
+				log.Errorf("Error adding upload to the index. host=%s file=%s err=%s", meta.Host, meta.OriginalFilename, indexErr)
+			}
+		}()
+	}
+
+	// find the handler for this table
+	return u.findUploadHandler(meta).HandleUpload(meta, reader)
+}
+
+// Returns the handler for an upload from the first matching route
+func (u *Uploader) findUploadHandler(meta *UploadMeta) UploadHandler {
+	for _, route := range u.routes {
+		if route.matches(meta) {
+			return findUploadHandler(meta, route.handlers, u.fallback)
+		}
 	}
+	return u.fallback
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+// Checks if a re-sent upload is the same as the one we already accepted
+func checkDuplicateUpload(meta *UploadMeta, reader io.Reader, accepted *UploadIndexEntry) error {
+	// if the agent sent the md5 after the file, we have to read through the
+	// upload to get it
+	if meta.OriginalMd5 == nil {
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return fmt.Errorf("Error reading upload: %v", err)
+		}
+	}
 
-		//uploadHandlerInner(w, r, tenant, uploader, maxidBackend)
+	if !bytes.Equal(meta.OriginalMd5, accepted.Md5) {
+		return &UploadError{http.StatusConflict, fmt.Errorf("Upload of '%s' from '%s' was already accepted with a different md5: accepted '%032x' got '%032x'",
+			meta.OriginalFilename, meta.Host, accepted.Md5, meta.OriginalMd5)}
+	}
+
+	log.Infof("Skipping already accepted upload. host=%s file=%s accepted=%s", meta.Host, meta.OriginalFilename, accepted.Accepted.Format(time.RFC3339))
+	return nil
+}
+
+// Creates an http endpoint handler where
+func MakeUploadHandler(maxidBackend MaxIdBackend, uploader *Uploader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
 		// Convert the request to metadata for handling
 		meta, mainFile, err := MakeMetaFromRequest(r)
@@ -138,49 +288,190 @@ func MakeUploadHandler(maxidBackend MaxIdBackend, tmpDir, baseDir, archivesDir s
 		}
 		defer mainFile.Close()
 
-		// update the filename flag from the config
-		meta.UseOldFormatFilename = useOldFormatFilename
-
-		// find the handler for this table
-		if err := findUploadHandler(meta, handlers, fallbackHandler).HandleUpload(meta, mainFile); err != nil {
-			WriteResponse(w, http.StatusInternalServerError, fmt.Sprint(err), r)
+		if err := uploader.HandleUpload(meta, mainFile); err != nil {
+			WriteResponse(w, getUploadErrorStatus(err), fmt.Sprint(err), r)
 			return
 		}
 
-		// get the maxid and save it if needed
-		maxid, err := getUrlParam(r.URL, "maxid")
-		if err == nil {
-			if err := maxidBackend.SaveMaxId(meta.TableName, maxid); err != nil {
-				log.Errorf("Failed to save maxid: table=%s maxid=%s err=%s", meta.TableName, maxid, err)
-			}
-		}
+		saveMaxIdFromRequest(maxidBackend, meta, r)
 
 		WriteResponse(w, http.StatusOK, "OK", r)
-	}, nil
+	}
+}
+
+// Saves the maxid sent along with an upload (if there is one)
+func saveMaxIdFromRequest(maxidBackend MaxIdBackend, meta *UploadMeta, r *http.Request) {
+	maxid, err := getUrlParam(r.URL, "maxid")
+	if err != nil {
+		return
+	}
+	if err := maxidBackend.SaveMaxId(meta.TableName, maxid); err != nil {
+		log.Errorf("Failed to save maxid: table=%s maxid=%s err=%s", meta.TableName, maxid, err)
+	}
 }
 
 // Soring callbacks
 // ----------------
 
-// Converts an upload request to its metadata equivalent
-func MakeMetaFromRequest(req *http.Request) (*UploadMeta, multipart.File, error) {
+const (
+	pkgUrlParam         = "pkg"
+	hostUrlParam        = "host"
+	timezoneUrlParam    = "tz"
+	compressionUrlParam = "compression"
+)
+
+// The maximum size of the non-file fields of an upload we are willing to read
+const multipartFieldMaxSize = 1024
+
+// Converts an upload request to its metadata equivalent.
+//
+// The multipart body is streamed: the returned reader reads the '_file' part
+// directly from the request. Fields sent after the file part (like '_md5')
+// are read when the returned reader reaches the end of the file, so the
+// metadata is only complete after the reader returned io.EOF.
+func MakeMetaFromRequest(req *http.Request) (*UploadMeta, io.ReadCloser, error) {
 
-	// parse the multipart form
-	err := req.ParseMultipartForm(multipartMaxSize)
+	// validate the URL params before touching the body
+	urlParams, err := getUploadUrlParams(req.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	multipartReader, err := req.MultipartReader()
 	if err != nil {
 		return nil, nil, fmt.Errorf("Cannot parse multipart form: %v", err)
 	}
 
+	uploadReader := &multipartUploadReader{reader: multipartReader}
+
+	// read the fields up to the file
+	for uploadReader.part == nil {
+		part, err := multipartReader.NextPart()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("Cannot find the field '_file' in the upload request")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot parse multipart form: %v", err)
+		}
+
+		if part.FormName() == "_file" {
+			uploadReader.part = part
+			break
+		}
+
+		if err := uploadReader.readField(part); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// if the md5 came before the file, we can check it right away
+	var fileMd5 []byte
+	if len(uploadReader.md5Fields) > 0 {
+		if fileMd5, err = decodeMd5Field(uploadReader.md5Fields); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	meta, err := makeUploadMeta(urlParams, uploadReader.part.FileName(), fileMd5)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploadReader.meta = meta
+	return meta, uploadReader, nil
+}
+
+// Reads the '_file' part of a multipart upload, and the remaining fields
+// of the upload after the file part is finished.
+type multipartUploadReader struct {
+	reader *multipart.Reader
+	part   *multipart.Part
+
+	meta *UploadMeta
+
+	// the values of the '_md5' fields
+	md5Fields []string
+
+	// the error to return once the file part is done (io.EOF on success)
+	err error
+}
+
+func (m *multipartUploadReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	n, err := m.part.Read(p)
+	if err == io.EOF {
+		// read the rest of the form before signaling the end of the file
+		m.err = m.readRemainingFields()
+		if m.err == nil {
+			m.err = io.EOF
+		}
+		return n, m.err
+	}
+	return n, err
+}
+
+// The body of the request is closed by the http server
+func (m *multipartUploadReader) Close() error {
+	return nil
+}
+
+// Reads a non-file field of the upload
+func (m *multipartUploadReader) readField(part *multipart.Part) error {
+	defer part.Close()
+
+	switch part.FormName() {
+	case "_md5":
+		value, err := ioutil.ReadAll(io.LimitReader(part, multipartFieldMaxSize))
+		if err != nil {
+			return fmt.Errorf("Error reading the '_md5' field: %v", err)
+		}
+		m.md5Fields = append(m.md5Fields, string(value))
+	case "_file":
+		return fmt.Errorf("The request must have exactly 1 '_file' field")
+	default:
+		// skip any fields we dont care about
+		if _, err := io.Copy(ioutil.Discard, part); err != nil {
+			return fmt.Errorf("Error reading multipart field '%s': %v", part.FormName(), err)
+		}
+	}
+	return nil
+}
+
+// Reads the fields after the file part and fills in the md5 of the
+// metadata if it arrived after the file
+func (m *multipartUploadReader) readRemainingFields() error {
+	for {
+		part, err := m.reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot parse multipart form: %v", err)
+		}
+		if err := m.readField(part); err != nil {
+			return err
+		}
+	}
+
+	fileMd5, err := decodeMd5Field(m.md5Fields)
+	if err != nil {
+		return err
+	}
+	m.meta.OriginalMd5 = fileMd5
+	return nil
+}
+
+// Gets and validates the URL parameters describing an upload
+func getUploadUrlParams(reqUrl *url.URL) (map[string]string, error) {
 	foundUrlParams := make(map[string]string)
-	const pkgUrlParam = "pkg"
-	const hostUrlParam = "host"
-	const timezoneUrlParam = "tz"
-	const compressionUrlParam = "compression"
 
 	// Get the URL params. Missing required params will be handled a bit later.
 	urlParams := [...]string{pkgUrlParam, hostUrlParam, timezoneUrlParam, compressionUrlParam}
 	for _, paramName := range urlParams {
-		paramVal, err := getUrlParam(req.URL, paramName)
+		paramVal, err := getUrlParam(reqUrl, paramName)
 		if err != nil {
 			continue
 		}
@@ -188,42 +479,45 @@ func MakeMetaFromRequest(req *http.Request) (*UploadMeta, multipart.File, error)
 	}
 
 	// compression parameter is optional, so it can be empty, but the others are required
-	err = validateUrlParams(foundUrlParams, pkgUrlParam, hostUrlParam, timezoneUrlParam)
-	if err != nil {
-		return nil, nil, err
+	if err := validateUrlParams(foundUrlParams, pkgUrlParam, hostUrlParam, timezoneUrlParam); err != nil {
+		return nil, err
 	}
 
-	// parse the timezone
-	// try to parse the timezone name
-	timezoneName := foundUrlParams[timezoneUrlParam]
-	sourceTimezone, err := time.LoadLocation(timezoneName)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Unknown time zone for agent  '%s': %v", timezoneName, err)
-	}
+	return foundUrlParams, nil
+}
 
-	// check the md5
-	md5Fields := req.MultipartForm.Value["_md5"]
+// Decodes the base64 encoded md5 sent by the agent in the '_md5' field
+func decodeMd5Field(md5Fields []string) ([]byte, error) {
 	if len(md5Fields) != 1 {
-		return nil, nil, fmt.Errorf("Only one instance of the '_md5' field allowed in the request, got: %v", len(md5Fields))
+		return nil, fmt.Errorf("Only one instance of the '_md5' field allowed in the request, got: %v", len(md5Fields))
 	}
 
 	fileMd5, err := base64.StdEncoding.DecodeString(md5Fields[0])
 	if err != nil {
-		return nil, nil, fmt.Errorf("Cannot Base64 decode the submitted MD5 '%s': %v", md5Fields[0], fileMd5)
+		return nil, fmt.Errorf("Cannot Base64 decode the submitted MD5 '%s': %v", md5Fields[0], err)
 	}
+	return fileMd5, nil
+}
 
-	// get the actual file
-	mainFile, fileName, err := getMultipartFile(req.MultipartForm, "_file")
+// Builds the upload metadata from the upload URL parameters and the name of the uploaded file
+func makeUploadMeta(urlParams map[string]string, fileName string, fileMd5 []byte) (*UploadMeta, error) {
+	// parse the timezone
+	// try to parse the timezone name
+	timezoneName := urlParams[timezoneUrlParam]
+	sourceTimezone, err := time.LoadLocation(timezoneName)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Cannot find the field '_file' in the upload request")
+		return nil, fmt.Errorf("Unknown time zone for agent  '%s': %v", timezoneName, err)
 	}
 
 	// get the table name
 	tableName, requestTime, seqIdx, partIdx, err := getInfoFromFilename(fileName)
 	if err != nil {
-		// Close the file if we have errors here
-		mainFile.Close()
-		return nil, nil, err
+		return nil, err
+	}
+
+	// reject the compressions we cannot decode before reading the upload
+	if err := checkUploadCompression(urlParams[compressionUrlParam]); err != nil {
+		return nil, err
 	}
 
 	// build the upload metadata
@@ -231,9 +525,9 @@ func MakeMetaFromRequest(req *http.Request) (*UploadMeta, multipart.File, error)
 		OriginalFilename: fileName,
 		OriginalMd5:      fileMd5,
 
-		Pkg:         foundUrlParams[pkgUrlParam],
-		Host:        foundUrlParams[hostUrlParam],
-		Compression: foundUrlParams[compressionUrlParam],
+		Pkg:         urlParams[pkgUrlParam],
+		Host:        urlParams[hostUrlParam],
+		Compression: urlParams[compressionUrlParam],
 		TableName:   tableName,
 
 		Date:     requestTime,
@@ -243,7 +537,7 @@ func MakeMetaFromRequest(req *http.Request) (*UploadMeta, multipart.File, error)
 
 		// default to not using the old format
 		UseOldFormatFilename: false,
-	}, mainFile, nil
+	}, nil
 }
 
 func validateUrlParams(urlParams map[string]string, paramNames ...string) error {
@@ -389,37 +683,37 @@ func extendAndCopyByLinesString(from io.Reader, to io.Writer, prefix, prefixHead
 	return extendAndCopyByLines(from, to, []byte(prefix), []byte(prefixHeader), []byte(postfix), []byte(postfixHeader))
 }
 
-// Shared handler to copy an uploaded file to a location
-func copyUploadedFileTo(meta *UploadMeta, reader io.Reader, baseDir, tmpDir string, hasLoaderColumns bool) (outFileName string, md5 []byte, err error) {
+// Shared handler to copy an uploaded file to a location. The output is kept
+// in its temporary file, the caller has to close (or drop) the returned writer.
+// The writer is returned even in case of errors if it was already created.
+// If schema is not nil, the start of the upload is checked against it.
+func copyUploadedFileTo(meta *UploadMeta, reader io.Reader, schema *TableSchema, baseDir, tmpDir string, hasLoaderColumns bool) (outputWriter *FileWriterWithTemp, outFileName string, md5 []byte, err error) {
 
 	// create the output writer
-	outputWriter, err := meta.GetOutputGzippedWriter(baseDir, tmpDir)
+	outputWriter, err = meta.GetOutputWriter(baseDir, tmpDir)
 	if err != nil {
-		return "", nil, fmt.Errorf("Error opening gzipped output: %v", err)
+		return nil, "", nil, fmt.Errorf("Error opening compressed output: %v", err)
 	}
 
 	// Get the filename we'll use for the output
 	outFileName = outputWriter.GetRandomFileName()
 
-	// safety defered close to always close the file with our new filename
-	defer outputWriter.CloseWithFileName(outFileName)
-
 	// create the md5 hasher that hashes input data
 	md5HashedReader := makeMd5Hasher(reader)
-	var inputReader io.Reader = md5HashedReader
 
 	// handle compressed uploads
-	switch meta.Compression {
-	case "gzip":
-		gz, err := gzip.NewReader(md5HashedReader)
-		if err != nil {
-			return "", nil, fmt.Errorf("Failed to create gzip reader on file: %v! Error: %v", meta.OriginalFilename, err)
-		}
-		defer gz.Close()
-		// This assignment is safe, because the deferred Close() functions will still do their work properly.
-		inputReader = gz
-	default:
-		// Nothing needs to be done in this case, no compression is presumed
+	decompressedReader, err := makeUploadDecompressor(meta.Compression, md5HashedReader)
+	if err != nil {
+		return outputWriter, outFileName, md5HashedReader.GetHash(), err
+	}
+	defer decompressedReader.Close()
+	var inputReader io.Reader = decompressedReader
+
+	// check the start of the file against the schema of the table. The file
+	// is still copied, so it ends up in the quarantine as a whole.
+	var schemaErr error
+	if schema != nil {
+		inputReader, schemaErr = schema.validateSample(inputReader)
 	}
 
 	// Create the pre & postfixes
@@ -433,34 +727,57 @@ func copyUploadedFileTo(meta *UploadMeta, reader io.Reader, baseDir, tmpDir stri
 	}
 
 	if err := extendAndCopyByLinesString(inputReader, outputWriter, prefixColumn, "p_filepath\v", postfixColumn, "\vp_cre_date"); err != nil {
-		return "", nil, fmt.Errorf("Error copying CSV content: %v", err)
+		return outputWriter, outFileName, md5HashedReader.GetHash(), fmt.Errorf("Error copying CSV content: %v", err)
 	}
 
-	// pick up any errors during close
-	if err := outputWriter.CloseWithFileName(outFileName); err != nil {
-		return "", nil, fmt.Errorf("Error writing uploaded bytes to '%s': %v", outFileName, err)
+	// make sure everything the agent sent is hashed (and the rest of the
+	// upload is read) even if the decompressor stopped early
+	if _, err := io.Copy(ioutil.Discard, md5HashedReader); err != nil {
+		return outputWriter, outFileName, md5HashedReader.GetHash(), fmt.Errorf("Error reading upload: %v", err)
 	}
 
-	log.Infof("Copied uploaded file: host=%s size=%d filename=%s table=%s destination=%s",
-		meta.Host, outputWriter.BytesWritten, meta.OriginalFilename, meta.TableName, outFileName)
+	if schemaErr != nil {
+		return outputWriter, outFileName, md5HashedReader.GetHash(), schemaErr
+	}
 
-	return outFileName, md5HashedReader.GetHash(), nil
+	return outputWriter, outFileName, md5HashedReader.GetHash(), nil
 }
 
-// Shared handler to copy an uploaded file to a location
-func copyUploadedFileAndCheckMd5(meta *UploadMeta, reader io.Reader, baseDir, tmpDir string, hasLoaderColumns bool) (outFileName string, err error) {
-	outFileName, fileMd5, err := copyUploadedFileTo(meta, reader, baseDir, tmpDir, hasLoaderColumns)
+// Shared handler to copy an uploaded file to a location. The output only gets
+// to its final location if the copy succeeded and the md5 matches, failed
+// uploads go to the quarantine.
+func copyUploadedFileAndCheckMd5(env *UploadHandlerEnv, meta *UploadMeta, reader io.Reader, schema *TableSchema, baseDir string, hasLoaderColumns bool) (outFileName string, err error) {
+	outputWriter, outFileName, fileMd5, err := copyUploadedFileTo(meta, reader, schema, baseDir, env.TmpDir, hasLoaderColumns)
+
+	// Check if the md5 isnt a match
+	if err == nil && !bytes.Equal(meta.OriginalMd5, fileMd5) {
+		err = fmt.Errorf("Invalid md5: agent sent '%032x' copy got '%032x'", meta.OriginalMd5, fileMd5)
+	}
 
 	// Check for errors
 	if err != nil {
+		if outputWriter != nil {
+			if qErr := env.Quarantine.Add(outputWriter, meta, outFileName, !hasLoaderColumns, fileMd5, err); qErr != nil {
+				log.Errorf("Error quarantining upload. file=%s err=%s", meta.OriginalFilename, qErr)
+			}
+		}
 		return outFileName, err
 	}
 
-	// Check if the md5 isnt a match
-	if bytes.Compare(meta.OriginalMd5, fileMd5) != 0 {
-		return outFileName, fmt.Errorf("Invalid md5: agent sent '%032x' copy got '%032x'", meta.OriginalMd5, fileMd5)
+	// only the files going to the loader are copied to the database
+	copier := env.PgCopy
+	if !hasLoaderColumns {
+		copier = nil
 	}
 
+	// pick up any errors during close
+	if _, err := outputWriter.CloseWithCopy(outFileName, copier, meta.TableName); err != nil {
+		return outFileName, fmt.Errorf("Error writing uploaded bytes to '%s': %v", outFileName, err)
+	}
+
+	log.Infof("Copied uploaded file: host=%s size=%d filename=%s table=%s destination=%s",
+		meta.Host, outputWriter.BytesWritten, meta.OriginalFilename, meta.TableName, outFileName)
+
 	return outFileName, nil
 }
 
@@ -468,7 +785,7 @@ func copyUploadedFileAndCheckMd5(meta *UploadMeta, reader io.Reader, baseDir, tm
 // ===================
 
 type FallbackUploadHandler struct {
-	tmpDir, baseDir string
+	env *UploadHandlerEnv
 }
 
 func (f *FallbackUploadHandler) CanHandle(meta *UploadMeta) bool {
@@ -477,9 +794,19 @@ func (f *FallbackUploadHandler) CanHandle(meta *UploadMeta) bool {
 }
 
 func (f *FallbackUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	// only the files going to the loader are checked against the table schemas
+	schema := f.env.Schemas.Get(meta.TableName)
+
+	if meta.GetOutputCodec().IsParquet() {
+		// archive the upload, the parquet file is written from the archived file
+		archivedFile, err := copyUploadedFileAndCheckMd5(f.env, meta, reader, schema, f.env.ArchivesDir, false)
+		if err != nil {
+			return err
+		}
+		return writeParquetFromArchive(f.env, meta, schema, archivedFile)
+	}
 
-	// skip adding filenames and datetimes for metadata files
-	_, err := copyUploadedFileAndCheckMd5(meta, reader, f.baseDir, f.tmpDir, true)
+	_, err := copyUploadedFileAndCheckMd5(f.env, meta, reader, schema, f.env.BaseDir, true)
 	return err
 }
 
@@ -487,23 +814,21 @@ func (f *FallbackUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader)
 // ==========================
 
 type ServerlogsUploadHandler struct {
-	tmpDir, baseDir, archivesDir string
+	env *UploadHandlerEnv
 
-	parserChan chan ServerlogInput
+	parsers *ServerlogsParserPool
 }
 
-func NewServerlogsUploadHandler(tmpDir, baseDir, archivesDir string) (UploadHandler, error) {
-	serverlogParser, err := MakeServerlogsParser(tmpDir, baseDir, archivesDir, 256)
+func NewServerlogsUploadHandler(env *UploadHandlerEnv) (UploadHandler, error) {
+	serverlogParser, err := MakeServerlogsParser(env, env.ParserWorkers, env.ParserQueueSize)
 	// handle errors
 	if err != nil {
 		return nil, err
 	}
 	// handle success
 	return &ServerlogsUploadHandler{
-		tmpDir:      tmpDir,
-		baseDir:     baseDir,
-		archivesDir: archivesDir,
-		parserChan:  serverlogParser,
+		env:     env,
+		parsers: serverlogParser,
 	}, nil
 }
 
@@ -521,44 +846,47 @@ func isPlainLog(fn string) bool {
 }
 
 func (j *ServerlogsUploadHandler) CanHandle(meta *UploadMeta) bool {
-	return isJsonLog(meta.TableName) || isPlainLog(meta.TableName)
+	_, _, isServerlog := serverlogFormatOf(j.env, meta.TableName)
+	return isServerlog
 }
 
 func (j *ServerlogsUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
+	// make sure there is room for the file before storing it, so the agent
+	// can retry later instead of waiting for the parsers
+	if !j.parsers.Reserve(meta) {
+		return &UploadError{http.StatusServiceUnavailable, fmt.Errorf("The serverlog parser queue is full or still queueing the files of the last run, cannot accept '%s' from '%s'", meta.OriginalFilename, meta.Host)}
+	}
+
 	// copy the serverlog to the archives, dont add filenames and datetimes for
 	// the loader since we will be adding them later during serverlog parsing
-	archivedFile, err := copyUploadedFileAndCheckMd5(meta, reader, j.archivesDir, j.tmpDir, false)
+	archivedFile, err := copyUploadedFileAndCheckMd5(j.env, meta, reader, nil, j.env.ArchivesDir, false)
 	if err != nil {
+		j.parsers.Cancel(meta)
 		return err
 	}
 
-	logFormat := LogFormatJson
-	if isPlainLog(meta.TableName) {
-		logFormat = LogFormatPlain
-	}
+	logFormat, formatName, _ := serverlogFormatOf(j.env, meta.TableName)
 
-	j.parserChan <- ServerlogInput{
+	return j.parsers.Enqueue(ServerlogInput{
 		Meta:         meta,
 		ArchivedFile: archivedFile,
 		Format:       logFormat,
-	}
-	return nil
+		FormatName:   formatName,
+	})
 }
 
 // Metadata revriting
 // ------------------
 
 type metadataUploadHandler struct {
-	tmpDir, baseDir, archivesDir string
+	env *UploadHandlerEnv
 }
 
 var isMetadataRegexp = regexp.MustCompile("^metadata")
 
-func NewMetadataUploadHandler(tmpDir, baseDir, archivesDir string) UploadHandler {
+func NewMetadataUploadHandler(env *UploadHandlerEnv) UploadHandler {
 	return &metadataUploadHandler{
-		tmpDir:      tmpDir,
-		baseDir:     baseDir,
-		archivesDir: archivesDir,
+		env: env,
 	}
 }
 
@@ -567,10 +895,10 @@ func (m *metadataUploadHandler) CanHandle(meta *UploadMeta) bool {
 }
 func (m *metadataUploadHandler) HandleUpload(meta *UploadMeta, reader io.Reader) error {
 	// copy the serverlog to the archives
-	archivedFile, err := copyUploadedFileAndCheckMd5(meta, reader, m.archivesDir, m.tmpDir, false)
+	archivedFile, err := copyUploadedFileAndCheckMd5(m.env, meta, reader, nil, m.env.ArchivesDir, false)
 	if err != nil {
 		return err
 	}
 
-	return MetadataUploadHandler(meta, m.tmpDir, m.baseDir, archivedFile)
+	return MetadataUploadHandler(meta, m.env.TmpDir, m.env.BaseDir, archivedFile, m.env.LogFormats)
 }
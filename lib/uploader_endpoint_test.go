@@ -36,3 +36,54 @@ binary data
 		tassert.Nil(t, err)
 	}
 }
+
+func TestMakeMetaFromRequest_Md5AfterFile(t *testing.T) {
+	postData :=
+		`--xxx
+Content-Disposition: form-data; name="_file"; filename="threadinfo-2016-10-07--15-48-25--seq0000--part0000.csv.gz"
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: binary
+
+binary data
+--xxx
+Content-Disposition: form-data; name="_md5"
+
+M2Y3ZWEwYTg2ZjkxOTUyZmU3Y2Y3ZGJhNjViMDcxYjM=
+--xxx--
+`
+	req, _ := http.NewRequest("PUT", "/upload?pkg=testpkg&host=local&tz=UTC", ioutil.NopCloser(strings.NewReader(postData)))
+	req.Header.Add("Content-Type", "multipart/form-data; boundary=xxx")
+	u, r, err := MakeMetaFromRequest(req)
+	tassert.Nil(t, err)
+	tassert.Nil(t, u.OriginalMd5)
+
+	contents, err := ioutil.ReadAll(r)
+	tassert.Nil(t, err)
+	tassert.Equal(t, "binary data", string(contents))
+	tassert.Equal(t, "3f7ea0a86f91952fe7cf7dba65b071b3", string(u.OriginalMd5))
+}
+
+func TestMakeMetaFromRequest_MissingMd5(t *testing.T) {
+	postData :=
+		`--xxx
+Content-Disposition: form-data; name="_file"; filename="threadinfo-2016-10-07--15-48-25--seq0000--part0000.csv.gz"
+Content-Type: application/octet-stream
+
+binary data
+--xxx--
+`
+	req, _ := http.NewRequest("PUT", "/upload?pkg=testpkg&host=local&tz=UTC", ioutil.NopCloser(strings.NewReader(postData)))
+	req.Header.Add("Content-Type", "multipart/form-data; boundary=xxx")
+	_, r, err := MakeMetaFromRequest(req)
+	tassert.Nil(t, err)
+
+	_, err = ioutil.ReadAll(r)
+	tassert.NotNil(t, err)
+}
+
+func TestMakeMetaFromRequest_MissingUrlParams(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/upload?pkg=testpkg&tz=UTC", ioutil.NopCloser(strings.NewReader("")))
+	req.Header.Add("Content-Type", "multipart/form-data; boundary=xxx")
+	_, _, err := MakeMetaFromRequest(req)
+	tassert.NotNil(t, err)
+}
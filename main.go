@@ -46,7 +46,14 @@ func RequestLogMiddleware(h http.Handler) http.Handler {
 // Middleware to maintain agent list
 func HeartbeatMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if hostname := r.FormValue("hostname"); hostname != "" {
+		// the multipart bodies are left for the upload handler to stream
+		// them (FormValue() would read and buffer them), so their hostname
+		// has to be in the URL
+		hostname := r.URL.Query().Get("hostname")
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			hostname = r.FormValue("hostname")
+		}
+		if hostname != "" {
 			insight_server.AgentHeartbeat(hostname)
 		}
 		h.ServeHTTP(w, r)
@@ -99,20 +106,178 @@ func main() {
 	// ENDPOINTS
 	// ---------
 
-	uploadHandler, err := insight_server.MakeUploadHandler(maxIdBackend, tempDir, config.UploadBasePath, config.ServerlogsArchivePath, config.UseOldFormatFilename)
+	// the index of the uploads we already accepted
+	uploadIndex, err := insight_server.MakeFileUploadIndex(config.UploadIndexPath, config.UploadIndexMaxAge)
+	if err != nil {
+		log.Error("Error during upload index creation", err)
+		os.Exit(-1)
+	}
+
+	// the routes for the uploads not handled by the default routes
+	uploadRoutes := []insight_server.UploadRoute{}
+	if config.UploadRoutesFile != "" {
+		uploadRoutes, err = insight_server.LoadUploadRoutes(config.UploadRoutesFile)
+		if err != nil {
+			log.Error("Error loading upload routes", err)
+			os.Exit(-1)
+		}
+	}
+
+	// the expected columns of the uploaded tables
+	var tableSchemas insight_server.TableSchemas
+	if config.TableSchemasFile != "" {
+		tableSchemas, err = insight_server.LoadTableSchemas(config.TableSchemasFile)
+		if err != nil {
+			log.Error("Error loading table schemas", err)
+			os.Exit(-1)
+		}
+	}
+
+	// the codecs of the output files
+	var tableOutputs *insight_server.TableOutputs
+	if config.TableOutputsFile != "" {
+		tableOutputs, err = insight_server.LoadTableOutputs(config.TableOutputsFile)
+		if err != nil {
+			log.Error("Error loading table outputs", err)
+			os.Exit(-1)
+		}
+	}
+
+	// the formats of the logs besides the serverlogs
+	var logFormats *insight_server.RegexLogFormats
+	if config.LogFormatsFile != "" {
+		logFormats, err = insight_server.LoadRegexLogFormats(config.LogFormatsFile)
+		if err != nil {
+			log.Error("Error loading log formats", err)
+			os.Exit(-1)
+		}
+	}
+
+	// the masking rules of the serverlogs
+	var maskingRules *insight_server.MaskingRules
+	if config.MaskingRulesFile != "" {
+		maskingRules, err = insight_server.LoadMaskingRules(config.MaskingRulesFile, config.MaskingKey)
+		if err != nil {
+			log.Error("Error loading masking rules", err)
+			os.Exit(-1)
+		}
+	}
+	// set once here, the parsers share the formats
+	logFormats.SetMasking(maskingRules)
+
+	// the latest parsed rows for the live view
+	var liveRows *insight_server.ServerlogsLiveRows
+	if config.LiveRows > 0 {
+		liveRows = insight_server.NewServerlogsLiveRows(config.LiveRows)
+	}
+
+	// the outputs are copied to the database if it is set
+	var pgCopier *insight_server.PgCopier
+	if config.PgCopy.ConnString != "" {
+		config.PgCopy.PendingDir = filepath.Join(tempDir, "_copy_pending")
+		pgCopier, err = insight_server.NewPgCopier(config.PgCopy)
+		if err != nil {
+			log.Error("Error creating database copier", err)
+			os.Exit(-1)
+		}
+	}
+
+	// failed uploads are moved here
+	quarantine, err := insight_server.NewQuarantine(config.QuarantinePath)
+	if err != nil {
+		log.Error("Error during quarantine creation", err)
+		os.Exit(-1)
+	}
+
+	// the serverlogs waiting for parsing are stored here
+	parseQueue, err := insight_server.NewServerlogsParseQueue(config.ParseQueuePath, config.ParseQueueMaxAge)
+	if err != nil {
+		log.Error("Error during parse queue creation", err)
+		os.Exit(-1)
+	}
+
+	uploadHandlerEnv := &insight_server.UploadHandlerEnv{
+		TmpDir:      tempDir,
+		BaseDir:     config.UploadBasePath,
+		ArchivesDir: config.ServerlogsArchivePath,
+		ParquetDir:  config.ParquetPath,
+		Quarantine:  quarantine,
+		Schemas:     tableSchemas,
+		Outputs:     tableOutputs,
+
+		ParseQueue:      parseQueue,
+		ParseStats:      insight_server.NewServerlogsStats(0),
+		ParserWorkers:   config.ParserWorkers,
+		ParserQueueSize: config.ParserQueueSize,
+		LogFormats:      logFormats,
+
+		CorrelateRequests: config.CorrelateRequests,
+		Masking:           maskingRules,
+		OutputRotation:    config.OutputRotation,
+		NdjsonDir:         config.NdjsonPath,
+		LiveRows:          liveRows,
+		PgCopy:            pgCopier,
+	}
+
+	// SUBCOMMANDS
+	// ===========
+	if len(config.Args) > 0 {
+		switch config.Args[0] {
+		case "reparse":
+			if err := insight_server.RunReparseCommand(uploadHandlerEnv, config.UseOldFormatFilename, config.Args[1:]); err != nil {
+				log.Error("Error during reparse", err)
+				os.Exit(1)
+			}
+		case "ddl":
+			if err := insight_server.RunDdlCommand(uploadHandlerEnv, config.Args[1:]); err != nil {
+				log.Error("Error generating DDL", err)
+				os.Exit(1)
+			}
+		default:
+			log.Errorf("Unknown command: %s", config.Args[0])
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	uploader, err := insight_server.NewUploader(uploadHandlerEnv, uploadRoutes, config.UseOldFormatFilename, uploadIndex)
 	if err != nil {
 		log.Error("Error during upload handler creation", err)
 		// Fail with an error here
 		os.Exit(-1)
 	}
 
+	// the resumable upload sessions are stored here
+	uploadSessions, err := insight_server.NewUploadSessionStore(filepath.Join(config.UploadBasePath, "_sessions"))
+	if err != nil {
+		log.Error("Error during upload session store creation", err)
+		os.Exit(-1)
+	}
+
+	// the concurrency and bandwidth limits of the uploads
+	uploadLimiter := insight_server.NewUploadLimiter(config.UploadLimits)
+
+	// re-parsing the archived serverlogs
+	reparser, err := insight_server.NewServerlogsReparser(uploadHandlerEnv, config.UseOldFormatFilename)
+	if err != nil {
+		log.Error("Error during reparser creation", err)
+		os.Exit(-1)
+	}
+
 	// HANDLERS
 	// ========
 
 	// CSV upload
 	// declare both endpoints for now. /upload-with-meta is deprecated
 	mainRouter := mux.NewRouter()
-	mainRouter.Handle("/upload", AuthMiddleware(config.LicenseKey, uploadHandler))
+	mainRouter.Handle("/upload", AuthMiddleware(config.LicenseKey, uploadLimiter.Middleware(insight_server.MakeUploadHandler(maxIdBackend, uploader))))
+
+	// Resumable uploads
+	mainRouter.Handle("/upload/sessions", AuthMiddleware(config.LicenseKey, insight_server.MakeCreateUploadSessionHandler(uploadSessions))).Methods("POST")
+	mainRouter.Handle("/upload/sessions/{id}", AuthMiddleware(config.LicenseKey, insight_server.MakeGetUploadSessionHandler(uploadSessions))).Methods("GET")
+	mainRouter.Handle("/upload/sessions/{id}", AuthMiddleware(config.LicenseKey, uploadLimiter.SessionMiddleware(uploadSessions, insight_server.MakeWriteUploadSessionHandler(uploadSessions)))).Methods("PUT")
+	mainRouter.Handle("/upload/sessions/{id}", AuthMiddleware(config.LicenseKey, insight_server.MakeDeleteUploadSessionHandler(uploadSessions))).Methods("DELETE")
+	mainRouter.Handle("/upload/sessions/{id}/commit", AuthMiddleware(config.LicenseKey, uploadLimiter.SessionMiddleware(uploadSessions, insight_server.MakeCommitUploadSessionHandler(uploadSessions, maxIdBackend, uploader)))).Methods("POST")
 	mainRouter.Handle("/maxid", AuthMiddleware(config.LicenseKey, insight_server.MakeMaxIdHandler(maxIdBackend)))
 
 	// Commands
@@ -131,6 +296,31 @@ func main() {
 	apiRouter.Handle("/command", insight_server.NewGetCommandHandler()).Methods("GET")
 	apiRouter.HandleFunc("/agents", insight_server.AgentListHandler).Methods("GET")
 
+	// Quarantined uploads
+	apiRouter.Handle("/quarantine", AuthMiddleware(config.LicenseKey, insight_server.MakeListQuarantineHandler(quarantine))).Methods("GET")
+	apiRouter.Handle("/quarantine/{id}", AuthMiddleware(config.LicenseKey, insight_server.MakeGetQuarantineHandler(quarantine))).Methods("GET")
+	apiRouter.Handle("/quarantine/{id}", AuthMiddleware(config.LicenseKey, insight_server.MakeDeleteQuarantineHandler(quarantine))).Methods("DELETE")
+	apiRouter.Handle("/quarantine/{id}/file", AuthMiddleware(config.LicenseKey, insight_server.MakeGetQuarantineFileHandler(quarantine))).Methods("GET")
+	apiRouter.Handle("/quarantine/{id}/release", AuthMiddleware(config.LicenseKey, insight_server.MakeReleaseQuarantineHandler(quarantine))).Methods("POST")
+
+	// Serverlog parsing status
+	apiRouter.Handle("/serverlogs/status", AuthMiddleware(config.LicenseKey, insight_server.MakeServerlogsStatusHandler(uploadHandlerEnv.ParseStats))).Methods("GET")
+
+	// The latest parsed serverlog rows
+	apiRouter.Handle("/serverlogs/live", AuthMiddleware(config.LicenseKey, insight_server.MakeServerlogsLiveHandler(liveRows))).Methods("GET")
+
+	// Serverlog re-parsing
+	apiRouter.Handle("/serverlogs/reparse", AuthMiddleware(config.LicenseKey, insight_server.MakeStartReparseHandler(reparser))).Methods("POST")
+	apiRouter.Handle("/serverlogs/reparse", AuthMiddleware(config.LicenseKey, insight_server.MakeListReparseHandler(reparser))).Methods("GET")
+	apiRouter.Handle("/serverlogs/reparse/{id}", AuthMiddleware(config.LicenseKey, insight_server.MakeGetReparseHandler(reparser))).Methods("GET")
+
+	// DDL of the tables
+	apiRouter.Handle("/ddl", AuthMiddleware(config.LicenseKey, insight_server.MakeDdlHandler(uploadHandlerEnv, false))).Methods("GET")
+	apiRouter.Handle("/ddl/diff", AuthMiddleware(config.LicenseKey, insight_server.MakeDdlHandler(uploadHandlerEnv, true))).Methods("POST")
+
+	// Upload limits
+	apiRouter.Handle("/limits", AuthMiddleware(config.LicenseKey, insight_server.MakeUploadLimiterStatusHandler(uploadLimiter))).Methods("GET")
+
 	// DEPRECATING
 	mainRouter.Handle("/updates/products/agent/{version}/{rest}", http.StripPrefix("/updates/products/agent/", http.FileServer(http.Dir(config.UpdatesDirectory)))).Methods("GET")
 	mainRouter.HandleFunc("/commands/new", insight_server.AddCommandHandler)
@@ -151,13 +341,13 @@ func main() {
 
 		err := http.ListenAndServeTLS(bindAddressWithPort, config.TlsCert, config.TlsKey, handlers.CORS(
 			handlers.AllowedOrigins([]string{"*"}),
-			handlers.AllowedMethods([]string{"GET", "PUT"}),
+			handlers.AllowedMethods([]string{"GET", "PUT", "POST", "DELETE"}),
 		)(handlerWithLogging))
 		log.Errorf("Exiting. err=%s", err)
 	} else {
 		err := http.ListenAndServe(bindAddressWithPort, handlers.CORS(
 			handlers.AllowedOrigins([]string{"*"}),
-			handlers.AllowedMethods([]string{"GET", "PUT"}),
+			handlers.AllowedMethods([]string{"GET", "PUT", "POST", "DELETE"}),
 		)(handlerWithLogging))
 		log.Errorf("Exiting. err=%s", err)
 	}